@@ -0,0 +1,228 @@
+package api
+
+import (
+	"log"
+	"time"
+
+	"github.com/sammy007/open-ethereum-pool/storage"
+	"github.com/sammy007/open-ethereum-pool/util"
+)
+
+// Shares are written in batches, leave them time to land before a bucket is closed
+const historyLag = 30 * time.Second
+
+// Closed buckets are looked for in this interval
+const historyCheckInterval = time.Minute
+
+type HistoryConfig struct {
+	Enabled bool `json:"enabled"`
+	// Finest tier is built from raw shares, every next one from the previous tier
+	Tiers []HistoryTierConfig `json:"tiers"`
+}
+
+type HistoryTierConfig struct {
+	// Bucket length, also used as tier name in API requests
+	Bucket    string `json:"bucket"`
+	Retention string `json:"retention"`
+}
+
+type historyTier struct {
+	name      string
+	length    int64
+	retention time.Duration
+	// Timestamp of the last processed bucket, 0 until known
+	last int64
+}
+
+// Writes pool, miner and worker hashrate, share and worker counts into time buckets
+type Downsampler struct {
+	backend storage.Backend
+	tiers   []*historyTier
+	// Raw shares are purged after large hashrate window
+	rawWindow int64
+}
+
+func NewDownsampler(cfg *HistoryConfig, backend storage.Backend, largeWindow time.Duration) *Downsampler {
+	if len(cfg.Tiers) == 0 {
+		log.Fatal("History requires at least one tier")
+	}
+	d := &Downsampler{backend: backend, rawWindow: int64(largeWindow / time.Second)}
+	for i, c := range cfg.Tiers {
+		t := &historyTier{
+			name:      c.Bucket,
+			length:    int64(util.MustParseDuration(c.Bucket) / time.Second),
+			retention: util.MustParseDuration(c.Retention),
+		}
+		if t.length <= 0 || int64(t.retention/time.Second) < t.length {
+			log.Fatalf("Invalid history tier %v, retention must cover at least one bucket", t.name)
+		}
+		if i == 0 && t.length > d.rawWindow {
+			log.Fatalf("History bucket %v exceeds hashrateLargeWindow, raw shares are purged before it closes", t.name)
+		}
+		if i > 0 {
+			prev := d.tiers[i-1]
+			if t.length <= prev.length || t.length%prev.length != 0 {
+				log.Fatalf("History bucket %v must be a multiple of %v", t.name, prev.name)
+			}
+		}
+		d.tiers = append(d.tiers, t)
+	}
+	return d
+}
+
+// Empty name selects the finest tier
+func (d *Downsampler) tier(name string) *historyTier {
+	if len(name) == 0 {
+		return d.tiers[0]
+	}
+	for _, t := range d.tiers {
+		if t.name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+// Writes every bucket closed since the last run. Pool point is written even for idle bucket,
+// so the last pool point marks progress of a tier across restarts.
+func (d *Downsampler) run(now int64) {
+	start := time.Now()
+	written := 0
+	available := now - int64(historyLag/time.Second)
+
+	for i, t := range d.tiers {
+		if t.last == 0 {
+			points, err := d.backend.GetPoolHistory(t.name, now-int64(t.retention/time.Second))
+			if err != nil {
+				log.Printf("Failed to read %v history: %v", t.name, err)
+				return
+			}
+			if len(points) > 0 {
+				t.last = points[len(points)-1].Timestamp
+			}
+		}
+
+		end := available / t.length * t.length
+		from := end - t.length
+		if t.last > 0 {
+			from = t.last + t.length
+		}
+		// Don't rebuild what is already gone from the source
+		min := end - int64(t.retention/time.Second)
+		if i == 0 {
+			min = (now - d.rawWindow + t.length - 1) / t.length * t.length
+		}
+		if from < min {
+			from = min
+		}
+
+		for ts := from; ts+t.length <= end; ts += t.length {
+			var bucket *storage.HistoryBucket
+			var err error
+			if i == 0 {
+				bucket, err = d.collect(ts, t.length)
+			} else {
+				bucket, err = d.downsample(d.tiers[i-1], ts, t.length)
+			}
+			if err == nil && bucket != nil {
+				err = d.backend.WriteHistory(t.name, t.retention, bucket)
+				written++
+			}
+			if err != nil {
+				log.Printf("Failed to write %v history bucket %v: %v", t.name, ts, err)
+				return
+			}
+			t.last = ts
+		}
+
+		if t.last == 0 {
+			return
+		}
+		available = t.last + t.length
+	}
+	if written > 0 {
+		log.Printf("Wrote %v history buckets, elapsed time %v", written, time.Since(start))
+	}
+}
+
+// Builds finest bucket from raw shares
+func (d *Downsampler) collect(ts, length int64) (*storage.HistoryBucket, error) {
+	shares, err := d.backend.CollectShares(ts, ts+length)
+	if err != nil {
+		return nil, err
+	}
+	bucket := newHistoryBucket(ts)
+	var poolDiff int64
+	for login, workers := range shares {
+		var minerDiff int64
+		miner := &storage.HistoryPoint{Timestamp: ts}
+		bucket.Workers[login] = make(map[string]*storage.HistoryPoint)
+		for id, total := range workers {
+			bucket.Workers[login][id] = &storage.HistoryPoint{Timestamp: ts, Hashrate: total.Difficulty / length, Shares: total.Count}
+			minerDiff += total.Difficulty
+			miner.Shares += total.Count
+			miner.Workers++
+		}
+		miner.Hashrate = minerDiff / length
+		bucket.Miners[login] = miner
+
+		poolDiff += minerDiff
+		bucket.Pool.Shares += miner.Shares
+		bucket.Pool.Workers += miner.Workers
+		bucket.Pool.Miners++
+	}
+	bucket.Pool.Hashrate = poolDiff / length
+	return bucket, nil
+}
+
+// Merges buckets of finer tier into one, nil if finer tier has nothing for it
+func (d *Downsampler) downsample(fine *historyTier, ts, length int64) (*storage.HistoryBucket, error) {
+	series, err := d.backend.GetHistory(fine.name, ts, ts+length)
+	if err != nil {
+		return nil, err
+	}
+	// Pool wasn't running
+	if len(series.Pool) == 0 {
+		return nil, nil
+	}
+	ratio := length / fine.length
+	bucket := newHistoryBucket(ts)
+	bucket.Pool = mergeHistoryPoints(ts, ratio, series.Pool)
+	for login, points := range series.Miners {
+		bucket.Miners[login] = mergeHistoryPoints(ts, ratio, points)
+	}
+	for login, workers := range series.Workers {
+		bucket.Workers[login] = make(map[string]*storage.HistoryPoint)
+		for id, points := range workers {
+			bucket.Workers[login][id] = mergeHistoryPoints(ts, ratio, points)
+		}
+	}
+	return bucket, nil
+}
+
+func newHistoryBucket(ts int64) *storage.HistoryBucket {
+	return &storage.HistoryBucket{
+		Timestamp: ts,
+		Pool:      &storage.HistoryPoint{Timestamp: ts},
+		Miners:    make(map[string]*storage.HistoryPoint),
+		Workers:   make(map[string]map[string]*storage.HistoryPoint),
+	}
+}
+
+// Hashrate is averaged over the whole bucket with missing points counted as idle,
+// shares are summed, miners and workers are peak counts
+func mergeHistoryPoints(ts, ratio int64, points []*storage.HistoryPoint) *storage.HistoryPoint {
+	p := &storage.HistoryPoint{Timestamp: ts}
+	for _, v := range points {
+		p.Hashrate += v.Hashrate
+		p.Shares += v.Shares
+		if v.Miners > p.Miners {
+			p.Miners = v.Miners
+		}
+		if v.Workers > p.Workers {
+			p.Workers = v.Workers
+		}
+	}
+	p.Hashrate /= ratio
+	return p
+}
@@ -0,0 +1,92 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sammy007/open-ethereum-pool/storage"
+)
+
+// Hour boundary
+const historyBase = int64(1499997600)
+
+func newTestDownsampler(backend storage.Backend) *Downsampler {
+	cfg := &HistoryConfig{Tiers: []HistoryTierConfig{
+		{Bucket: "10m", Retention: "168h"},
+		{Bucket: "1h", Retention: "2160h"},
+	}}
+	return NewDownsampler(cfg, backend, 3*time.Hour)
+}
+
+func TestDownsamplerCollect(t *testing.T) {
+	backend := storage.NewMemoryBackend("test")
+	backend.WriteShares("1", []*storage.Share{
+		{Login: "x", Id: "a", Diff: 9000, Timestamp: (historyBase + 10) * 1000},
+		{Login: "x", Id: "a", Diff: 9000, Timestamp: (historyBase + 20) * 1000},
+		{Login: "x", Id: "b", Diff: 9000, Timestamp: (historyBase + 30) * 1000},
+		{Login: "y", Id: "a", Diff: 9000, Timestamp: (historyBase + 40) * 1000},
+	}, 3*time.Hour)
+
+	d := newTestDownsampler(backend)
+	d.run(historyBase + 660)
+
+	pool, _ := backend.GetPoolHistory("10m", 0)
+	if len(pool) != 1 {
+		t.Fatalf("Must write single bucket: %+v", pool)
+	}
+	if p := pool[0]; p.Timestamp != historyBase || p.Hashrate != 60 || p.Shares != 4 || p.Miners != 2 || p.Workers != 3 {
+		t.Errorf("Invalid pool point: %+v", p)
+	}
+	miner, workers, _ := backend.GetMinerHistory("10m", "x", 0)
+	if len(miner) != 1 || miner[0].Hashrate != 45 || miner[0].Workers != 2 {
+		t.Errorf("Invalid miner point: %+v", miner)
+	}
+	if len(workers["a"]) != 1 || workers["a"][0].Hashrate != 30 || workers["a"][0].Shares != 2 {
+		t.Errorf("Invalid worker point: %+v", workers)
+	}
+	if hourly, _ := backend.GetPoolHistory("1h", 0); len(hourly) != 0 {
+		t.Errorf("Hour bucket is not closed yet: %+v", hourly)
+	}
+
+	// Rerun must not rewrite closed buckets
+	d.run(historyBase + 660)
+	if pool, _ = backend.GetPoolHistory("10m", 0); len(pool) != 1 {
+		t.Errorf("Must not duplicate buckets: %+v", pool)
+	}
+}
+
+func TestDownsamplerTiers(t *testing.T) {
+	backend := storage.NewMemoryBackend("test")
+	backend.WriteShares("2", []*storage.Share{
+		{Login: "x", Id: "a", Diff: 36000, Timestamp: (historyBase + 10) * 1000},
+	}, 3*time.Hour)
+
+	newTestDownsampler(backend).run(historyBase + 660)
+
+	// Progress is restored from written buckets after restart
+	d := newTestDownsampler(backend)
+	d.run(historyBase + 3660)
+
+	pool, _ := backend.GetPoolHistory("10m", 0)
+	if len(pool) != 6 {
+		t.Fatalf("Must fill buckets since the last run: %+v", pool)
+	}
+	hourly, _ := backend.GetPoolHistory("1h", 0)
+	if len(hourly) != 1 {
+		t.Fatalf("Must downsample closed hour: %+v", hourly)
+	}
+	if p := hourly[0]; p.Timestamp != historyBase || p.Hashrate != 10 || p.Shares != 1 || p.Workers != 1 {
+		t.Errorf("Invalid hourly point: %+v", p)
+	}
+	_, workers, _ := backend.GetMinerHistory("1h", "x", 0)
+	if len(workers["a"]) != 1 || workers["a"][0].Hashrate != 10 {
+		t.Errorf("Invalid hourly worker point: %+v", workers)
+	}
+}
+
+func TestDownsamplerTier(t *testing.T) {
+	d := newTestDownsampler(storage.NewMemoryBackend("test"))
+	if d.tier("").name != "10m" || d.tier("1h").name != "1h" || d.tier("1d") != nil {
+		t.Error("Invalid tier lookup")
+	}
+}
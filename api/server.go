@@ -1,6 +1,7 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"log"
 	"net/http"
@@ -17,6 +18,9 @@ import (
 	"github.com/sammy007/open-ethereum-pool/util"
 )
 
+// Limits time to finish requests in flight on shutdown
+const shutdownTimeout = 10 * time.Second
+
 type ApiConfig struct {
 	Enabled              bool   `json:"enabled"`
 	Listen               string `json:"listen"`
@@ -28,17 +32,24 @@ type ApiConfig struct {
 	Blocks               int64  `json:"blocks"`
 	PurgeOnly            bool   `json:"purgeOnly"`
 	PurgeInterval        string `json:"purgeInterval"`
+	// Hashrate time series, written in every mode
+	History HistoryConfig `json:"history"`
 }
 
 type ApiServer struct {
 	config              *ApiConfig
-	backend             *storage.RedisClient
+	backend             storage.Backend
 	hashrateWindow      time.Duration
 	hashrateLargeWindow time.Duration
 	stats               atomic.Value
 	miners              map[string]*Entry
 	minersMu            sync.RWMutex
 	statsIntv           time.Duration
+	history             *Downsampler
+	server              *http.Server
+	serverMu            sync.Mutex
+	quit                chan struct{}
+	done                chan struct{}
 }
 
 type Entry struct {
@@ -46,16 +57,22 @@ type Entry struct {
 	updatedAt int64
 }
 
-func NewApiServer(cfg *ApiConfig, backend *storage.RedisClient) *ApiServer {
+func NewApiServer(cfg *ApiConfig, backend storage.Backend) *ApiServer {
 	hashrateWindow := util.MustParseDuration(cfg.HashrateWindow)
 	hashrateLargeWindow := util.MustParseDuration(cfg.HashrateLargeWindow)
-	return &ApiServer{
+	s := &ApiServer{
 		config:              cfg,
 		backend:             backend,
 		hashrateWindow:      hashrateWindow,
 		hashrateLargeWindow: hashrateLargeWindow,
 		miners:              make(map[string]*Entry),
+		quit:                make(chan struct{}),
+		done:                make(chan struct{}),
+	}
+	if cfg.History.Enabled {
+		s.history = NewDownsampler(&cfg.History, backend, hashrateLargeWindow)
 	}
+	return s
 }
 
 func (s *ApiServer) Start() {
@@ -73,6 +90,13 @@ func (s *ApiServer) Start() {
 	purgeTimer := time.NewTimer(purgeIntv)
 	log.Printf("Set purge interval to %v", purgeIntv)
 
+	historyTimer := time.NewTimer(historyCheckInterval)
+	if s.history != nil {
+		log.Printf("Set history check interval to %v", historyCheckInterval)
+	} else {
+		historyTimer.Stop()
+	}
+
 	sort.Ints(s.config.LuckWindow)
 
 	if s.config.PurgeOnly {
@@ -81,10 +105,19 @@ func (s *ApiServer) Start() {
 		s.purgeStale()
 		s.collectStats()
 	}
+	if s.history != nil {
+		s.history.run(util.MakeTimestamp() / 1000)
+	}
 
 	go func() {
+		defer close(s.done)
 		for {
 			select {
+			case <-s.quit:
+				statsTimer.Stop()
+				purgeTimer.Stop()
+				historyTimer.Stop()
+				return
 			case <-statsTimer.C:
 				if !s.config.PurgeOnly {
 					s.collectStats()
@@ -93,6 +126,9 @@ func (s *ApiServer) Start() {
 			case <-purgeTimer.C:
 				s.purgeStale()
 				purgeTimer.Reset(purgeIntv)
+			case <-historyTimer.C:
+				s.history.run(util.MakeTimestamp() / 1000)
+				historyTimer.Reset(historyCheckInterval)
 			}
 		}
 	}()
@@ -109,13 +145,49 @@ func (s *ApiServer) listen() {
 	r.HandleFunc("/api/blocks", s.BlocksIndex)
 	r.HandleFunc("/api/payments", s.PaymentsIndex)
 	r.HandleFunc("/api/accounts/{login:M[0-9a-zA-Z]{10,50}}", s.AccountIndex)
+	if s.history != nil {
+		r.HandleFunc("/api/history", s.HistoryIndex)
+		r.HandleFunc("/api/accounts/{login:M[0-9a-zA-Z]{10,50}}/history", s.AccountHistoryIndex)
+	}
 	r.NotFoundHandler = http.HandlerFunc(notFound)
-	err := http.ListenAndServe(s.config.Listen, r)
-	if err != nil {
+
+	s.serverMu.Lock()
+	select {
+	case <-s.quit:
+		s.serverMu.Unlock()
+		return
+	default:
+	}
+	s.server = &http.Server{Addr: s.config.Listen, Handler: r}
+	s.serverMu.Unlock()
+
+	err := s.server.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
 		log.Fatalf("Failed to start API: %v", err)
 	}
 }
 
+// Stops serving requests and waits for running stats collection or purge
+func (s *ApiServer) Stop() {
+	log.Println("Stopping API")
+
+	s.serverMu.Lock()
+	close(s.quit)
+	srv := s.server
+	s.serverMu.Unlock()
+
+	if srv != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		err := srv.Shutdown(ctx)
+		cancel()
+		if err != nil {
+			log.Printf("Failed to shutdown API gracefully: %v", err)
+		}
+	}
+	<-s.done
+	log.Println("API stopped")
+}
+
 func notFound(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
@@ -173,6 +245,7 @@ func (s *ApiServer) StatsIndex(w http.ResponseWriter, r *http.Request) {
 		reply["maturedTotal"] = stats["maturedTotal"]
 		reply["immatureTotal"] = stats["immatureTotal"]
 		reply["candidatesTotal"] = stats["candidatesTotal"]
+		reply["finances"] = stats["finances"]
 	}
 
 	err = json.NewEncoder(w).Encode(reply)
@@ -300,6 +373,78 @@ func (s *ApiServer) AccountIndex(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Pool series of requested tier, finest one by default
+func (s *ApiServer) HistoryIndex(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	t := s.history.tier(r.URL.Query().Get("tier"))
+	if t == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	from := util.MakeTimestamp()/1000 - int64(t.retention/time.Second)
+	points, err := s.backend.GetPoolHistory(t.name, from)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Failed to fetch history from backend: %v", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	reply := make(map[string]interface{})
+	reply["tier"] = t.name
+	reply["bucket"] = t.length
+	reply["history"] = points
+	err = json.NewEncoder(w).Encode(reply)
+	if err != nil {
+		log.Println("Error serializing API response: ", err)
+	}
+}
+
+// Miner series and series of each worker
+func (s *ApiServer) AccountHistoryIndex(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	login := mux.Vars(r)["login"]
+	t := s.history.tier(r.URL.Query().Get("tier"))
+	if t == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	exist, err := s.backend.IsMinerExists(login)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Failed to fetch stats from backend: %v", err)
+		return
+	}
+	if !exist {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	from := util.MakeTimestamp()/1000 - int64(t.retention/time.Second)
+	miner, workers, err := s.backend.GetMinerHistory(t.name, login, from)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Failed to fetch history from backend: %v", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	reply := make(map[string]interface{})
+	reply["tier"] = t.name
+	reply["bucket"] = t.length
+	reply["history"] = miner
+	reply["workers"] = workers
+	err = json.NewEncoder(w).Encode(reply)
+	if err != nil {
+		log.Println("Error serializing API response: ", err)
+	}
+}
+
 func (s *ApiServer) getStats() map[string]interface{} {
 	stats := s.stats.Load()
 	if stats != nil {
@@ -0,0 +1,291 @@
+package archiver
+
+import (
+	"bytes"
+	"database/sql"
+	"log"
+	"strconv"
+	"time"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/sammy007/open-ethereum-pool/storage"
+	"github.com/sammy007/open-ethereum-pool/util"
+)
+
+type ArchiverConfig struct {
+	Enabled bool `json:"enabled"`
+	// "sqlite3" or "postgres"
+	Driver   string `json:"driver"`
+	Dsn      string `json:"dsn"`
+	Interval string `json:"interval"`
+}
+
+var schema = []string{
+	`CREATE TABLE IF NOT EXISTS blocks (
+		height BIGINT NOT NULL,
+		nonce VARCHAR(18) NOT NULL,
+		hash VARCHAR(66) NOT NULL,
+		uncle BOOLEAN NOT NULL,
+		uncle_height BIGINT NOT NULL,
+		timestamp BIGINT NOT NULL,
+		difficulty BIGINT NOT NULL,
+		shares BIGINT NOT NULL,
+		reward VARCHAR(80) NOT NULL,
+		PRIMARY KEY (height, nonce)
+	)`,
+	`CREATE TABLE IF NOT EXISTS orphans (
+		height BIGINT NOT NULL,
+		nonce VARCHAR(18) NOT NULL,
+		uncle BOOLEAN NOT NULL,
+		timestamp BIGINT NOT NULL,
+		difficulty BIGINT NOT NULL,
+		shares BIGINT NOT NULL,
+		PRIMARY KEY (height, nonce)
+	)`,
+	`CREATE TABLE IF NOT EXISTS credits (
+		height BIGINT NOT NULL,
+		hash VARCHAR(66) NOT NULL,
+		login VARCHAR(64) NOT NULL,
+		amount BIGINT NOT NULL,
+		PRIMARY KEY (height, hash, login)
+	)`,
+	`CREATE TABLE IF NOT EXISTS payments (
+		tx_hash VARCHAR(66) NOT NULL,
+		login VARCHAR(64) NOT NULL,
+		amount BIGINT NOT NULL,
+		timestamp BIGINT NOT NULL,
+		PRIMARY KEY (tx_hash, login)
+	)`,
+	`CREATE TABLE IF NOT EXISTS archiver_checkpoints (
+		name VARCHAR(32) NOT NULL PRIMARY KEY,
+		value BIGINT NOT NULL
+	)`,
+}
+
+// Copies accounting history from backend into SQL tables.
+// Rows are inserted with ON CONFLICT DO NOTHING and checkpoints are inclusive, so every run is idempotent.
+// Empty database is backfilled with everything backend holds.
+type Archiver struct {
+	config  *ArchiverConfig
+	backend storage.Backend
+	db      *sql.DB
+	quit    chan struct{}
+	done    chan struct{}
+}
+
+func NewArchiver(cfg *ArchiverConfig, backend storage.Backend) *Archiver {
+	if cfg.Driver != "sqlite3" && cfg.Driver != "postgres" {
+		log.Fatalf("Unsupported archiver driver: %v", cfg.Driver)
+	}
+	db, err := sql.Open(cfg.Driver, cfg.Dsn)
+	if err != nil {
+		log.Fatalf("Failed to open archive database: %v", err)
+	}
+	a := &Archiver{config: cfg, backend: backend, db: db, quit: make(chan struct{}), done: make(chan struct{})}
+	if err := a.createSchema(); err != nil {
+		log.Fatalf("Failed to create archive schema: %v", err)
+	}
+	return a
+}
+
+func (a *Archiver) Start() {
+	log.Printf("Starting archiver with %v driver", a.config.Driver)
+	intv := util.MustParseDuration(a.config.Interval)
+	timer := time.NewTimer(intv)
+	log.Printf("Set archive interval to %v", intv)
+
+	go func() {
+		defer close(a.done)
+
+		a.archive()
+		timer.Reset(intv)
+
+		for {
+			select {
+			case <-a.quit:
+				timer.Stop()
+				return
+			case <-timer.C:
+				a.archive()
+				timer.Reset(intv)
+			}
+		}
+	}()
+}
+
+// Waits for running archive cycle to finish
+func (a *Archiver) Stop() {
+	log.Println("Stopping archiver")
+	close(a.quit)
+	<-a.done
+	a.db.Close()
+	log.Println("Archiver stopped")
+}
+
+func (a *Archiver) archive() {
+	if err := a.archiveBlocks(); err != nil {
+		log.Printf("Failed to archive blocks: %v", err)
+	}
+	if err := a.archivePayments(); err != nil {
+		log.Printf("Failed to archive payments: %v", err)
+	}
+}
+
+func (a *Archiver) createSchema() error {
+	for _, q := range schema {
+		if _, err := a.db.Exec(q); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Matured blocks with their credits and orphans, checkpoint is the last archived height
+func (a *Archiver) archiveBlocks() error {
+	from, err := a.checkpoint("blocks")
+	if err != nil {
+		return err
+	}
+	blocks, err := a.backend.GetMaturedBlocks(from)
+	if err != nil {
+		return err
+	}
+	if len(blocks) == 0 {
+		return nil
+	}
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var archived, orphans, credits int64
+	for _, block := range blocks {
+		if block.Orphan {
+			n, err := a.exec(tx, `INSERT INTO orphans (height, nonce, uncle, timestamp, difficulty, shares)
+				VALUES (?, ?, ?, ?, ?, ?) ON CONFLICT DO NOTHING`,
+				block.Height, block.Nonce, block.Uncle, block.Timestamp, block.Difficulty, block.TotalShares)
+			if err != nil {
+				return err
+			}
+			orphans += n
+			continue
+		}
+		n, err := a.exec(tx, `INSERT INTO blocks (height, nonce, hash, uncle, uncle_height, timestamp, difficulty, shares, reward)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT DO NOTHING`,
+			block.Height, block.Nonce, block.Hash, block.Uncle, block.UncleHeight, block.Timestamp, block.Difficulty, block.TotalShares, block.RewardString)
+		if err != nil {
+			return err
+		}
+		archived += n
+
+		rewards, err := a.backend.GetBlockCredits(block.Height, block.Hash)
+		if err != nil {
+			return err
+		}
+		for login, amount := range rewards {
+			n, err := a.exec(tx, `INSERT INTO credits (height, hash, login, amount) VALUES (?, ?, ?, ?) ON CONFLICT DO NOTHING`,
+				block.Height, block.Hash, login, amount)
+			if err != nil {
+				return err
+			}
+			credits += n
+		}
+	}
+	if err := a.setCheckpoint(tx, "blocks", blocks[len(blocks)-1].Height); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if archived+orphans+credits > 0 {
+		log.Printf("Archived %v blocks, %v orphans and %v credits", archived, orphans, credits)
+	}
+	return nil
+}
+
+// Checkpoint is timestamp of the last archived payment
+func (a *Archiver) archivePayments() error {
+	from, err := a.checkpoint("payments")
+	if err != nil {
+		return err
+	}
+	payments, err := a.backend.GetPayments(from)
+	if err != nil {
+		return err
+	}
+	if len(payments) == 0 {
+		return nil
+	}
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var archived int64
+	for _, p := range payments {
+		n, err := a.exec(tx, `INSERT INTO payments (tx_hash, login, amount, timestamp) VALUES (?, ?, ?, ?) ON CONFLICT DO NOTHING`,
+			p.TxHash, p.Address, p.Amount, p.Timestamp)
+		if err != nil {
+			return err
+		}
+		archived += n
+	}
+	if err := a.setCheckpoint(tx, "payments", payments[len(payments)-1].Timestamp); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if archived > 0 {
+		log.Printf("Archived %v payments", archived)
+	}
+	return nil
+}
+
+func (a *Archiver) checkpoint(name string) (int64, error) {
+	var value int64
+	err := a.db.QueryRow(a.rebind(`SELECT value FROM archiver_checkpoints WHERE name = ?`), name).Scan(&value)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return value, err
+}
+
+func (a *Archiver) setCheckpoint(tx *sql.Tx, name string, value int64) error {
+	_, err := a.exec(tx, `INSERT INTO archiver_checkpoints (name, value) VALUES (?, ?)
+		ON CONFLICT (name) DO UPDATE SET value = excluded.value`, name, value)
+	return err
+}
+
+// Returns number of inserted rows
+func (a *Archiver) exec(tx *sql.Tx, query string, args ...interface{}) (int64, error) {
+	result, err := tx.Exec(a.rebind(query), args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// Queries are written with ? placeholders, postgres expects $1, $2...
+func (a *Archiver) rebind(query string) string {
+	if a.config.Driver != "postgres" {
+		return query
+	}
+	var buf bytes.Buffer
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			buf.WriteString("$" + strconv.Itoa(n))
+		} else {
+			buf.WriteRune(c)
+		}
+	}
+	return buf.String()
+}
@@ -0,0 +1,120 @@
+package archiver
+
+import (
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sammy007/open-ethereum-pool/storage"
+)
+
+func newTestArchiver(t *testing.T, backend storage.Backend) (*Archiver, func()) {
+	dir, err := ioutil.TempDir("", "archiver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &ArchiverConfig{Driver: "sqlite3", Dsn: filepath.Join(dir, "archive.db"), Interval: "1m"}
+	a := NewArchiver(cfg, backend)
+	return a, func() {
+		a.db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func matureBlock(t *testing.T, backend storage.Backend, height uint64, nonce string, orphan bool) {
+	_, err := backend.WriteBlock("x", "x", []string{nonce, "0x0", "0x0"}, 100, 1000, 0, false, height, 0, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	candidates, _ := backend.GetCandidates(int64(height))
+	block := candidates[len(candidates)-1]
+	block.Hash = "0xa" + nonce
+	block.Reward = big.NewInt(5e18)
+	rewards := map[string]int64{"x": 4e9, "y": 1e9}
+	if err := backend.WriteImmatureBlock(block, rewards); err != nil {
+		t.Fatal(err)
+	}
+	immature, _ := backend.GetImmatureBlocks(int64(height))
+	block = immature[len(immature)-1]
+	block.Reward = big.NewInt(5e18)
+	if orphan {
+		block.Orphan = true
+		err = backend.WriteOrphan(block)
+	} else {
+		err = backend.WriteMaturedBlock(block, rewards)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func count(t *testing.T, a *Archiver, table string) int {
+	var n int
+	if err := a.db.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestArchiveBackfillAndIdempotency(t *testing.T) {
+	backend := storage.NewMemoryBackend("test")
+	matureBlock(t, backend, 100, "0x1", false)
+	matureBlock(t, backend, 200, "0x2", true)
+	backend.UpdateBalance("x", 4e9)
+	backend.WritePayment("x", "0xf", 4e9)
+
+	a, cleanup := newTestArchiver(t, backend)
+	defer cleanup()
+
+	for i := 0; i < 2; i++ {
+		a.archive()
+		if n := count(t, a, "blocks"); n != 1 {
+			t.Errorf("Invalid number of blocks: %v", n)
+		}
+		if n := count(t, a, "orphans"); n != 1 {
+			t.Errorf("Invalid number of orphans: %v", n)
+		}
+		if n := count(t, a, "credits"); n != 2 {
+			t.Errorf("Invalid number of credits: %v", n)
+		}
+		if n := count(t, a, "payments"); n != 1 {
+			t.Errorf("Invalid number of payments: %v", n)
+		}
+	}
+	if v, _ := a.checkpoint("blocks"); v != 200 {
+		t.Errorf("Invalid blocks checkpoint: %v", v)
+	}
+
+	var amount int64
+	a.db.QueryRow("SELECT amount FROM credits WHERE login = 'y'").Scan(&amount)
+	if amount != 1e9 {
+		t.Errorf("Invalid credit: %v", amount)
+	}
+}
+
+func TestArchiveFromCheckpoint(t *testing.T) {
+	backend := storage.NewMemoryBackend("test")
+	matureBlock(t, backend, 100, "0x1", false)
+
+	a, cleanup := newTestArchiver(t, backend)
+	defer cleanup()
+
+	a.archive()
+	matureBlock(t, backend, 300, "0x3", false)
+	a.archive()
+	if n := count(t, a, "blocks"); n != 2 {
+		t.Errorf("Invalid number of blocks: %v", n)
+	}
+	if v, _ := a.checkpoint("blocks"); v != 300 {
+		t.Errorf("Invalid blocks checkpoint: %v", v)
+	}
+}
+
+func TestRebind(t *testing.T) {
+	a := &Archiver{config: &ArchiverConfig{Driver: "postgres"}}
+	if q := a.rebind("INSERT INTO t (a, b) VALUES (?, ?)"); q != "INSERT INTO t (a, b) VALUES ($1, $2)" {
+		t.Errorf("Invalid query: %v", q)
+	}
+}
@@ -4,47 +4,72 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
 	"log"
 	"math/rand"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
+	"syscall"
 	"time"
 
 	"github.com/yvasiyarov/gorelic"
 
 	"github.com/sammy007/open-ethereum-pool/api"
+	"github.com/sammy007/open-ethereum-pool/archiver"
 	"github.com/sammy007/open-ethereum-pool/payouts"
 	"github.com/sammy007/open-ethereum-pool/proxy"
 	"github.com/sammy007/open-ethereum-pool/storage"
 )
 
 var cfg proxy.Config
-var backend *storage.RedisClient
+var backend storage.Backend
 
-func startProxy() {
+// Module which finishes its work in flight on shutdown
+type stopper interface {
+	Stop()
+}
+
+func startProxy() stopper {
 	s := proxy.NewProxy(&cfg, backend)
-	s.Start()
+	go s.Start()
+	return s
 }
 
-func startApi() {
+func startApi() stopper {
 	s := api.NewApiServer(&cfg.Api, backend)
-	s.Start()
+	go s.Start()
+	return s
 }
 
-func startBlockUnlocker() {
+func startBlockUnlocker() stopper {
 	cfg.BlockUnlocker.Account = cfg.Account
 	cfg.BlockUnlocker.Password = cfg.Password
 	cfg.BlockUnlocker.Address = cfg.Payouts.Address
 	u := payouts.NewBlockUnlocker(&cfg.BlockUnlocker, backend)
 	u.Start()
+	return u
 }
 
-func startPayoutsProcessor() {
+func startPayoutsProcessor() stopper {
 	cfg.Payouts.Account = cfg.Account
 	cfg.Payouts.Password = cfg.Password
 	u := payouts.NewPayoutsProcessor(&cfg.Payouts, backend)
-	u.Start()
+	go u.Start()
+	return u
+}
+
+func startArchiver() stopper {
+	a := archiver.NewArchiver(&cfg.Archiver, backend)
+	a.Start()
+	return a
+}
+
+func startAuditor() stopper {
+	a := payouts.NewAuditor(&cfg.Auditor, backend)
+	a.Start()
+	return a
 }
 
 func startNewrelic() {
@@ -57,10 +82,10 @@ func startNewrelic() {
 	}
 }
 
-func readConfig(cfg *proxy.Config) {
+func readConfig(cfg *proxy.Config, args []string) {
 	configFileName := "config.json"
-	if len(os.Args) > 1 {
-		configFileName = os.Args[1]
+	if len(args) > 0 {
+		configFileName = args[0]
 	}
 	configFileName, _ = filepath.Abs(configFileName)
 	log.Printf("Loading config: %v", configFileName)
@@ -76,8 +101,48 @@ func readConfig(cfg *proxy.Config) {
 	}
 }
 
+// Upgrades redis data to the schema version of this build, modules must be stopped
+func migrate(args []string) {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "Report pending changes without writing them")
+	flags.Parse(args)
+	readConfig(&cfg, flags.Args())
+
+	if len(cfg.Backend) > 0 && cfg.Backend != "redis" {
+		log.Fatalf("Nothing to migrate for %v backend", cfg.Backend)
+	}
+	r := storage.NewRedisClient(&cfg.Redis, cfg.Coin)
+	if err := r.Migrate(*dryRun); err != nil {
+		log.Fatalf("Migration failed: %v", err)
+	}
+}
+
+// Runs accounting audit once, exits with non-zero status on mismatch
+func audit(args []string) {
+	readConfig(&cfg, args)
+	if len(cfg.Backend) > 0 && cfg.Backend != "redis" {
+		log.Fatalf("Nothing to audit for %v backend", cfg.Backend)
+	}
+	r := storage.NewRedisClient(&cfg.Redis, cfg.Coin)
+	if err := r.CheckSchema(); err != nil {
+		log.Fatalf("Backend schema check failed: %v", err)
+	}
+	mismatches, err := payouts.NewAuditor(&cfg.Auditor, r).Audit()
+	if err != nil || len(mismatches) > 0 {
+		os.Exit(1)
+	}
+}
+
 func main() {
-	readConfig(&cfg)
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		migrate(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "audit" {
+		audit(os.Args[2:])
+		return
+	}
+	readConfig(&cfg, os.Args[1:])
 	rand.Seed(time.Now().UnixNano())
 
 	if cfg.Threads > 0 {
@@ -87,26 +152,59 @@ func main() {
 
 	startNewrelic()
 
-	backend = storage.NewRedisClient(&cfg.Redis, cfg.Coin)
+	switch cfg.Backend {
+	case "", "redis":
+		backend = storage.NewRedisClient(&cfg.Redis, cfg.Coin)
+	case "memory":
+		log.Println("Using in-memory backend, state is lost on exit and not shared with other processes")
+		backend = storage.NewMemoryBackend(cfg.Coin)
+	default:
+		log.Fatalf("Unknown backend: %v", cfg.Backend)
+	}
 	pong, err := backend.Check()
 	if err != nil {
 		log.Printf("Can't establish connection to backend: %v", err)
 	} else {
 		log.Printf("Backend check reply: %v", pong)
 	}
+	if err := backend.CheckSchema(); err != nil {
+		log.Fatalf("Backend schema check failed: %v", err)
+	}
+	// Proxies keep the window, unlocker rewards it
+	backend.SetPPLNS(cfg.BlockUnlocker.PPLNS)
 
+	var modules []stopper
 	if cfg.Proxy.Enabled {
-		go startProxy()
+		modules = append(modules, startProxy())
 	}
 	if cfg.Api.Enabled {
-		go startApi()
+		modules = append(modules, startApi())
 	}
 	if cfg.BlockUnlocker.Enabled {
-		go startBlockUnlocker()
+		modules = append(modules, startBlockUnlocker())
 	}
 	if cfg.Payouts.Enabled {
-		go startPayoutsProcessor()
+		modules = append(modules, startPayoutsProcessor())
+	}
+	if cfg.Archiver.Enabled {
+		modules = append(modules, startArchiver())
+	}
+	if cfg.Auditor.Enabled {
+		modules = append(modules, startAuditor())
+	}
+
+	quit := make(chan os.Signal, 2)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-quit
+	log.Printf("Received %v, shutting down, send it again to exit immediately", sig)
+	go func() {
+		<-quit
+		log.Fatal("Forced shutdown")
+	}()
+
+	// Proxy goes first, so shares in flight land before unlocker and payouts stop
+	for _, m := range modules {
+		m.Stop()
 	}
-	quit := make(chan bool)
-	<-quit
+	log.Println("Shutdown complete")
 }
@@ -0,0 +1,98 @@
+package payouts
+
+import (
+	"log"
+	"time"
+
+	"github.com/sammy007/open-ethereum-pool/storage"
+	"github.com/sammy007/open-ethereum-pool/util"
+)
+
+type AuditorConfig struct {
+	Enabled  bool   `json:"enabled"`
+	Interval string `json:"interval"`
+	// Suspend payouts while books don't balance
+	BlockPayouts bool `json:"blockPayouts"`
+}
+
+// Recomputes totals from miners, credit logs and payments and compares them with finances
+type Auditor struct {
+	config  *AuditorConfig
+	backend storage.Backend
+	quit    chan struct{}
+	done    chan struct{}
+}
+
+func NewAuditor(cfg *AuditorConfig, backend storage.Backend) *Auditor {
+	return &Auditor{config: cfg, backend: backend, quit: make(chan struct{}), done: make(chan struct{})}
+}
+
+func (a *Auditor) Start() {
+	log.Println("Starting accounting auditor")
+	intv := util.MustParseDuration(a.config.Interval)
+	timer := time.NewTimer(intv)
+	log.Printf("Set audit interval to %v", intv)
+
+	go func() {
+		defer close(a.done)
+
+		a.Audit()
+		timer.Reset(intv)
+
+		for {
+			select {
+			case <-a.quit:
+				timer.Stop()
+				return
+			case <-timer.C:
+				a.Audit()
+				timer.Reset(intv)
+			}
+		}
+	}()
+}
+
+func (a *Auditor) Stop() {
+	log.Println("Stopping accounting auditor")
+	close(a.quit)
+	<-a.done
+	log.Println("Accounting auditor stopped")
+}
+
+// Returns mismatches found, result is stored so payouts processor can honour it
+func (a *Auditor) Audit() ([]*storage.AuditMismatch, error) {
+	mismatches, err := a.audit()
+	if err == nil && len(mismatches) > 0 {
+		// Keys are scanned outside of snapshot transaction, rule out a write racing with the scan
+		mismatches, err = a.audit()
+	}
+	if err != nil {
+		log.Printf("Failed to audit accounting: %v", err)
+		return nil, err
+	}
+
+	if len(mismatches) == 0 {
+		log.Println("Accounting audit passed")
+	} else {
+		log.Printf("Accounting audit found %v mismatches:", len(mismatches))
+		for _, m := range mismatches {
+			log.Printf("  %v", m)
+		}
+		if a.config.BlockPayouts {
+			log.Println("Payouts are blocked until books balance")
+		}
+	}
+	if err := a.backend.WriteAuditResult(mismatches, a.config.BlockPayouts); err != nil {
+		log.Printf("Failed to write audit result: %v", err)
+		return mismatches, err
+	}
+	return mismatches, nil
+}
+
+func (a *Auditor) audit() ([]*storage.AuditMismatch, error) {
+	snapshot, err := a.backend.GetAccountingSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	return snapshot.Audit(), nil
+}
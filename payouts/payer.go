@@ -4,8 +4,7 @@ import (
 	"fmt"
 	"log"
 	"math/big"
-	"os"
-	"strconv"
+	"sort"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common/hexutil"
@@ -15,7 +14,7 @@ import (
 	"github.com/sammy007/open-ethereum-pool/util"
 )
 
-const txCheckInterval = 5 * time.Second
+var txCheckInterval = 5 * time.Second
 
 type PayoutsConfig struct {
 	Enabled      bool   `json:"enabled"`
@@ -30,8 +29,11 @@ type PayoutsConfig struct {
 	// In Shannon
 	Threshold int64 `json:"threshold"`
 	BgSave    bool  `json:"bgsave"`
-	Account   string
-	Password  string
+	// Limits of a single payout tx, payees over them are split into batches, 0 means no limit
+	MaxReceivers int   `json:"maxReceivers"`
+	MaxAmount    int64 `json:"maxAmount"`
+	Account      string
+	Password     string
 }
 
 func (self PayoutsConfig) GasHex() string {
@@ -46,14 +48,16 @@ func (self PayoutsConfig) GasPriceHex() string {
 
 type PayoutsProcessor struct {
 	config   *PayoutsConfig
-	backend  *storage.RedisClient
+	backend  storage.Backend
 	rpc      *rpc.RPCClient
 	halt     bool
 	lastFail error
+	quit     chan struct{}
+	done     chan struct{}
 }
 
-func NewPayoutsProcessor(cfg *PayoutsConfig, backend *storage.RedisClient) *PayoutsProcessor {
-	u := &PayoutsProcessor{config: cfg, backend: backend}
+func NewPayoutsProcessor(cfg *PayoutsConfig, backend storage.Backend) *PayoutsProcessor {
+	u := &PayoutsProcessor{config: cfg, backend: backend, quit: make(chan struct{}), done: make(chan struct{})}
 	u.rpc = rpc.NewRPCClient("PayoutsProcessor", cfg.Daemon, cfg.Account, cfg.Password, cfg.Timeout)
 	return u
 }
@@ -61,41 +65,27 @@ func NewPayoutsProcessor(cfg *PayoutsConfig, backend *storage.RedisClient) *Payo
 func (u *PayoutsProcessor) Start() {
 	log.Println("Starting payouts")
 
-	if u.mustResolvePayout() {
-		log.Println("Running with env RESOLVE_PAYOUT=1, now trying to resolve locked payouts")
-		u.resolvePayouts()
-		log.Println("Now you have to restart payouts module with RESOLVE_PAYOUT=0 for normal run")
-		return
-	}
-
 	intv := util.MustParseDuration(u.config.Interval)
 	timer := time.NewTimer(intv)
 	log.Printf("Set payouts interval to %v", intv)
 
-	payments := u.backend.GetPendingPayments()
-	if len(payments) > 0 {
-		log.Printf("Previous payout failed, you have to resolve it. List of failed payments:\n %v",
-			formatPendingPayments(payments))
-		return
-	}
+	go func() {
+		defer close(u.done)
 
-	locked, err := u.backend.IsPayoutsLocked()
-	if err != nil {
-		log.Println("Unable to start payouts:", err)
-		return
-	}
-	if locked {
-		log.Println("Unable to start payouts because they are locked")
-		return
-	}
+		if !u.recoverPayouts() {
+			timer.Stop()
+			return
+		}
 
-	// Immediately process payouts after start
-	u.process()
-	timer.Reset(intv)
+		// Immediately process payouts after start
+		u.process()
+		timer.Reset(intv)
 
-	go func() {
 		for {
 			select {
+			case <-u.quit:
+				timer.Stop()
+				return
 			case <-timer.C:
 				u.process()
 				timer.Reset(intv)
@@ -104,157 +94,39 @@ func (u *PayoutsProcessor) Start() {
 	}()
 }
 
-func (u *PayoutsProcessor) XXprocess() {
+// Waits for running payout cycle to finish
+func (u *PayoutsProcessor) Stop() {
+	log.Println("Stopping payouts")
+	close(u.quit)
+	<-u.done
+	log.Println("Payouts stopped")
+}
+
+func (u *PayoutsProcessor) process() {
 	if u.halt {
 		log.Println("Payments suspended due to last critical error:", u.lastFail)
 		return
 	}
-	mustPay := 0
-	minersPaid := 0
-	totalAmount := big.NewInt(0)
-	payees, err := u.backend.GetPayees()
+	blocked, err := u.backend.IsPayoutsBlocked()
 	if err != nil {
-		log.Println("Error while retrieving payees from backend:", err)
+		log.Println("Unable to check accounting audit result:", err)
 		return
 	}
-
-	for _, login := range payees {
-		amount, _ := u.backend.GetBalance(login)
-		amountInShannon := big.NewInt(amount)
-
-		if !u.reachedThreshold(amountInShannon) {
-			continue
-		}
-		mustPay++
-
-		// Require active peers before processing
-		if !u.checkPeers() {
-			break
-		}
-		// Require unlocked account
-		//if !u.isUnlockedAccount() {
-		//	break
-		//}
-
-		// Check if we have enough funds
-		log.Printf("u.rpc.GetBalance(u.config.Address) %s", u.config.Address)
-		poolBalance, err := u.rpc.GetBalance(u.config.Address)
-		if err != nil {
-			u.halt = true
-			u.lastFail = err
-			break
-		}
-		if poolBalance.Cmp(amountInShannon) < 0 {
-			err := fmt.Errorf("Not enough balance for payment, need %s Wei, pool has %s Wei",
-				amountInShannon.String(), poolBalance.String())
-			u.halt = true
-			u.lastFail = err
-			break
-		}
-
-		// Lock payments for current payout
-		err = u.backend.LockPayouts(login, amount)
-		if err != nil {
-			log.Printf("Failed to lock payment for %s: %v", login, err)
-			u.halt = true
-			u.lastFail = err
-			break
-		}
-		log.Printf("Locked payment for %s, %v Satoshi", login, amount)
-
-		// Debit miner's balance and update stats
-		err = u.backend.UpdateBalance(login, amount)
-		if err != nil {
-			log.Printf("Failed to update balance for %s, %v Satoshi: %v", login, amount, err)
-			u.halt = true
-			u.lastFail = err
-			break
-		}
-
-		//value := hexutil.EncodeBig(amountInWei)
-		txHash, err := u.rpc.SendTransaction(u.config.Address, login, strconv.FormatInt(amount, 10))
-		if err != nil {
-			log.Printf("Failed to send payment to %s, %v Satoshi: %v. Check outgoing tx for %s in block explorer and docs/PAYOUTS.md",
-				login, amount, err, login)
-			u.halt = true
-			u.lastFail = err
-			break
-		}
-
-		// Log transaction hash
-		err = u.backend.WritePayment(login, txHash, amount)
-		if err != nil {
-			log.Printf("Failed to log payment data for %s, %v Satoshi, tx: %s: %v", login, amount, txHash, err)
-			u.halt = true
-			u.lastFail = err
-			break
-		}
-
-		minersPaid++
-		totalAmount.Add(totalAmount, big.NewInt(amount))
-		log.Printf("Paid %v Satoshi to %v, TxHash: %v", amount, login, txHash)
-
-		// Wait for TX confirmation before further payouts
-		for {
-			log.Printf("Waiting for tx confirmation: %v", txHash)
-			time.Sleep(txCheckInterval)
-			receipt, err := u.rpc.GetTxReceipt(txHash)
-			if err != nil {
-				log.Printf("Failed to get tx receipt for %v: %v", txHash, err)
-				continue
-			}
-			// Tx has been mined
-			if receipt != nil && receipt.Confirmed() {
-				if receipt.Successful() {
-					log.Printf("Payout tx successful for %s: %s", login, txHash)
-				} else {
-					log.Printf("Payout tx failed for %s: %s. Address contract throws on incoming tx.", login, txHash)
-				}
-				break
-			}
-		}
-	}
-
-	if mustPay > 0 {
-		log.Printf("Paid total %v Satoshi to %v of %v payees", totalAmount, minersPaid, mustPay)
-	} else {
-		log.Println("No payees that have reached payout threshold")
-	}
-
-	// Save redis state to disk
-	if minersPaid > 0 && u.config.BgSave {
-		u.bgSave()
-	}
-}
-
-
-func (u *PayoutsProcessor) process() {
-	if u.halt {
-		log.Println("Payments suspended due to last critical error:", u.lastFail)
+	if blocked {
+		log.Println("Payouts are blocked until accounting audit passes")
 		return
 	}
 	mustPay := 0
 	minersPaid := 0
-	totalAmount := big.NewInt(0)
-	
-	toPay := make(map[string]int64)
-	payees, err := u.backend.GetPayees()
+
+	toPay, err := u.backend.GetPayeesAbove(u.config.Threshold)
 	if err != nil {
 		log.Println("Error while retrieving payees from backend:", err)
 		return
 	}
 
-	for _, login := range payees {
-		amount, _ := u.backend.GetBalance(login)
-		amountInSatoshi := big.NewInt(amount)
-		log.Printf("check payment for %s, %v Satoshi", login, amount)
-		if !u.reachedThreshold(amountInSatoshi) {
-			continue
-		}
+	for login, amount := range toPay {
 		mustPay++
-
-		toPay[login] = amount
-		totalAmount.Add(totalAmount, amountInSatoshi)
 		log.Printf("To Pay %v Satoshi to %v", amount, login)
 	}
 
@@ -262,13 +134,21 @@ func (u *PayoutsProcessor) process() {
 		return
 	}
 
-	if mustPay > 0 {
-		log.Printf("Paid total %v Satoshi to %v of %v payees", totalAmount, minersPaid, mustPay)
-	} else {
+	if mustPay == 0 {
 		log.Println("No payees that have reached payout threshold")
 		return
 	}
 
+	// Balance above maxAmount is left for the next session
+	batches := splitPayouts(toPay, u.config.MaxReceivers, u.config.MaxAmount)
+	totalAmount := big.NewInt(0)
+	for _, payees := range batches {
+		for _, amount := range payees {
+			totalAmount.Add(totalAmount, big.NewInt(amount))
+		}
+	}
+	log.Printf("To pay total %v Satoshi to %v payees in %v batches", totalAmount, mustPay, len(batches))
+
 	// Require active peers before processing
 	if !u.checkPeers() {
 		return
@@ -290,49 +170,158 @@ func (u *PayoutsProcessor) process() {
 		return
 	}
 
-	txHash, err := u.rpc.SendMore(u.config.Address, toPay)
-	if err != nil {
-		log.Printf("Failed to send payment to miners! %s, %v", txHash, err)
-		u.halt = true
-		u.lastFail = err
-		return
-	}
-
-	for	login, amount := range toPay {
-		// Lock payments for current payout
-		err = u.backend.LockPayouts(login, amount)
+	ts := util.MakeTimestamp() / 1000
+	for i, payees := range batches {
+		batch := &storage.PayoutBatch{Id: fmt.Sprintf("%d-%d", ts, i), Payees: payees}
+		err := u.backend.PlanPayoutBatch(batch)
 		if err != nil {
-			log.Printf("Failed to lock payment for %s: %v", login, err)
+			log.Printf("Failed to plan payout batch %v: %v", batch.Id, err)
 			u.halt = true
 			u.lastFail = err
 			break
 		}
-		log.Printf("Locked payment for %s, %v Satoshi", login, amount)
+		log.Printf("Planned payout batch %v, %v Satoshi to %v payees", batch.Id, batch.Total(), len(payees))
 
-		// Debit miner's balance and update stats
-		err = u.backend.UpdateBalance(login, amount)
-		if err != nil {
-			log.Printf("Failed to update balance for %s, %v Satoshi: %v", login, amount, err)
-			u.halt = true
-			u.lastFail = err
+		if !u.settleBatch(batch, false) {
 			break
 		}
+		if batch.State == storage.PayoutConfirmed {
+			minersPaid += len(payees)
+		}
+	}
+	log.Printf("Paid %v of %v payees in %v batches", minersPaid, mustPay, len(batches))
+
+	// Save redis state to disk
+	if minersPaid > 0 && u.config.BgSave {
+		u.bgSave()
+	}
+}
 
-		minersPaid++
-		// Log transaction hash
-		err = u.backend.WritePayment(login, txHash, amount)
+// Settles batch left open by previous run, payouts don't start until it is confirmed or failed
+func (u *PayoutsProcessor) recoverPayouts() bool {
+	batch, err := u.backend.GetOpenPayoutBatch()
+	if err != nil {
+		log.Println("Unable to start payouts:", err)
+		return false
+	}
+	if batch != nil {
+		log.Printf("Resuming payout batch %v of %v payees in state %v", batch.Id, len(batch.Payees), batch.State)
+		if !u.settleBatch(batch, true) {
+			log.Printf("Unable to start payouts, payout batch %v is left %v", batch.Id, batch.State)
+			return false
+		}
+		log.Printf("Payout batch %v is %v", batch.Id, batch.State)
+	}
+
+	payments := u.backend.GetPendingPayments()
+	if len(payments) > 0 {
+		log.Printf("Pending payments without payout journal, you have to resolve them manually:\n %v",
+			formatPendingPayments(payments))
+		return false
+	}
+	return true
+}
+
+// Moves batch from its journaled state to confirmed or failed, every step is journaled before
+// the next one starts. Batch fails and is credited back only if its tx was never signed or
+// was mined and failed, signed tx is broadcast again as is, so it can't be paid twice.
+// Returns false if payouts must not go on with the next batch.
+func (u *PayoutsProcessor) settleBatch(batch *storage.PayoutBatch, resume bool) bool {
+	for {
+		var err error
+		switch batch.State {
+		case storage.PayoutPlanned:
+			err = u.backend.AdvancePayoutBatch(batch, storage.PayoutDebited)
+		case storage.PayoutDebited:
+			batch.RawTx, err = u.rpc.CreateSendMore(u.config.Address, batch.Payees)
+			if err != nil {
+				return u.failBatch(batch, "create", err)
+			}
+			err = u.backend.AdvancePayoutBatch(batch, storage.PayoutCreated)
+		case storage.PayoutCreated:
+			batch.TxHash, batch.SignedTx, err = u.rpc.SignTx(batch.RawTx)
+			if err != nil {
+				return u.failBatch(batch, "sign", err)
+			}
+			err = u.backend.AdvancePayoutBatch(batch, storage.PayoutSigned)
+		case storage.PayoutSigned:
+			// Tx might have reached the node before previous run died
+			if !resume || !u.txKnown(batch.TxHash) {
+				txHash, err := u.rpc.BroadcastTx(batch.SignedTx)
+				if rpc.IsTxKnown(err) {
+					log.Printf("Node already has payout batch %v, tx: %v: %v", batch.Id, batch.TxHash, err)
+					txHash, err = batch.TxHash, nil
+				}
+				if err != nil {
+					log.Printf("Failed to broadcast payout batch %v, tx: %v: %v. Check outgoing tx in block explorer and docs/PAYOUTS.md",
+						batch.Id, batch.TxHash, err)
+					u.halt = true
+					u.lastFail = err
+					return false
+				}
+				if txHash != batch.TxHash {
+					log.Printf("Node broadcast payout batch %v as %v, signed as %v", batch.Id, txHash, batch.TxHash)
+					batch.TxHash = txHash
+				}
+			}
+			err = u.backend.AdvancePayoutBatch(batch, storage.PayoutBroadcast)
+		case storage.PayoutBroadcast:
+			var mined bool
+			mined, err = u.waitForTx(batch.TxHash)
+			if err != nil {
+				// Mined tx moved no coins
+				return u.failBatch(batch, "confirm", err)
+			}
+			if !mined {
+				return false
+			}
+			err = u.backend.AdvancePayoutBatch(batch, storage.PayoutConfirmed)
+			if err == nil {
+				for login, amount := range batch.Payees {
+					log.Printf("Paid %v Satoshi to %v, TxHash: %v", amount, login, batch.TxHash)
+				}
+			}
+		default:
+			return true
+		}
 		if err != nil {
-			log.Printf("Failed to log payment data for %s, %v Satoshi, tx: %s: %v", login, amount, txHash, err)
+			log.Printf("Failed to journal payout batch %v: %v", batch.Id, err)
 			u.halt = true
 			u.lastFail = err
-			break
+			return false
 		}
 	}
+}
 
-	// Wait for TX confirmation before further payouts
+// Nothing was paid, payees of the batch are credited back and next batch goes
+func (u *PayoutsProcessor) failBatch(batch *storage.PayoutBatch, step string, cause error) bool {
+	log.Printf("Failed to %s tx of payout batch %v: %v", step, batch.Id, cause)
+	err := u.backend.AdvancePayoutBatch(batch, storage.PayoutFailed)
+	if err != nil {
+		log.Printf("Failed to roll back payout batch %v: %v", batch.Id, err)
+		u.halt = true
+		u.lastFail = err
+		return false
+	}
+	log.Printf("Credited %v Satoshi of payout batch %v back to %v payees", batch.Total(), batch.Id, len(batch.Payees))
+	return true
+}
+
+func (u *PayoutsProcessor) txKnown(txHash string) bool {
+	receipt, err := u.rpc.GetTxReceipt(txHash)
+	return err == nil && receipt != nil
+}
+
+// Returns false if payouts are stopped first, batch is resumed on next start then.
+// Mined tx which failed is an error, it must never be confirmed as paid.
+func (u *PayoutsProcessor) waitForTx(txHash string) (bool, error) {
 	for {
 		log.Printf("Waiting for tx confirmation: %v", txHash)
-		time.Sleep(txCheckInterval)
+		select {
+		case <-u.quit:
+			return false, nil
+		case <-time.After(txCheckInterval):
+		}
 		receipt, err := u.rpc.GetTxReceipt(txHash)
 		if err != nil {
 			log.Printf("Failed to get tx receipt for %v: %v", txHash, err)
@@ -340,23 +329,48 @@ func (u *PayoutsProcessor) process() {
 		}
 		// Tx has been mined
 		if receipt != nil && receipt.Confirmed() {
-			if receipt.Successful() {
-				log.Printf("Payout tx successful %s", txHash)
-			} else {
-				log.Printf("Payout tx failed %s. Address contract throws on incoming tx.", txHash)
+			if !receipt.Successful() {
+				return false, fmt.Errorf("Payout tx %s was mined but failed", txHash)
 			}
-			break
+			log.Printf("Payout tx successful %s", txHash)
+			return true, nil
 		}
 	}
+}
 
-	// Save redis state to disk
-	if minersPaid > 0 && u.config.BgSave {
-		u.bgSave()
+// Largest balances go first, balance above maxAmount is paid partially, 0 means no limit
+func splitPayouts(payees map[string]int64, maxReceivers int, maxAmount int64) []map[string]int64 {
+	logins := make([]string, 0, len(payees))
+	for login := range payees {
+		logins = append(logins, login)
 	}
-
+	sort.Slice(logins, func(i, j int) bool {
+		if payees[logins[i]] != payees[logins[j]] {
+			return payees[logins[i]] > payees[logins[j]]
+		}
+		return logins[i] < logins[j]
+	})
+
+	var batches []map[string]int64
+	var batch map[string]int64
+	var total int64
+	for _, login := range logins {
+		amount := payees[login]
+		if maxAmount > 0 && amount > maxAmount {
+			amount = maxAmount
+		}
+		full := batch != nil && ((maxReceivers > 0 && len(batch) >= maxReceivers) || (maxAmount > 0 && total+amount > maxAmount))
+		if batch == nil || full {
+			batch = make(map[string]int64)
+			batches = append(batches, batch)
+			total = 0
+		}
+		batch[login] = amount
+		total += amount
+	}
+	return batches
 }
 
-
 func (self PayoutsProcessor) isUnlockedAccount() bool {
 	_, err := self.rpc.Sign(self.config.Address, "0x0")
 	if err != nil {
@@ -402,37 +416,3 @@ func (self PayoutsProcessor) bgSave() {
 	}
 	log.Println("Saving backend state to disk:", result)
 }
-
-func (self PayoutsProcessor) resolvePayouts() {
-	payments := self.backend.GetPendingPayments()
-
-	if len(payments) > 0 {
-		log.Printf("Will credit back following balances:\n%s", formatPendingPayments(payments))
-
-		for _, v := range payments {
-			err := self.backend.RollbackBalance(v.Address, v.Amount)
-			if err != nil {
-				log.Printf("Failed to credit %v Satoshi back to %s, error is: %v", v.Amount, v.Address, err)
-				return
-			}
-			log.Printf("Credited %v Satoshi back to %s", v.Amount, v.Address)
-		}
-		err := self.backend.UnlockPayouts()
-		if err != nil {
-			log.Println("Failed to unlock payouts:", err)
-			return
-		}
-	} else {
-		log.Println("No pending payments to resolve")
-	}
-
-	if self.config.BgSave {
-		self.bgSave()
-	}
-	log.Println("Payouts unlocked")
-}
-
-func (self PayoutsProcessor) mustResolvePayout() bool {
-	v, _ := strconv.ParseBool(os.Getenv("RESOLVE_PAYOUT"))
-	return v
-}
@@ -0,0 +1,283 @@
+package payouts
+
+import (
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sammy007/open-ethereum-pool/storage"
+)
+
+// Node stub, tx is mined as soon as it's broadcast
+type stubNode struct {
+	sync.Mutex
+	createErr string
+	signErr   string
+	sendErr   string
+	mined     bool
+	calls     map[string]int
+}
+
+func (n *stubNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Method string `json:"method"`
+	}
+	json.NewDecoder(r.Body).Decode(&req)
+
+	n.Lock()
+	defer n.Unlock()
+	n.calls[req.Method]++
+
+	var result interface{}
+	var errMsg string
+	switch req.Method {
+	case "createrawtx":
+		result, errMsg = "0x01", n.createErr
+	case "signrawtx":
+		result, errMsg = map[string]string{"hash": "0xf", "rawtx": "0x02"}, n.signErr
+	case "sendrawtx":
+		result, errMsg = "0xf", n.sendErr
+		n.mined = n.mined || len(errMsg) == 0
+	case "gettx":
+		result = map[string]interface{}{"hash": "0xf", "height": 1000}
+		if !n.mined {
+			errMsg = "transaction not found"
+		}
+	default:
+		errMsg = "method not found"
+	}
+	reply := map[string]interface{}{"id": 0, "result": result}
+	if len(errMsg) > 0 {
+		reply = map[string]interface{}{"id": 0, "error": map[string]interface{}{"code": -1, "message": errMsg}}
+	}
+	json.NewEncoder(w).Encode(reply)
+}
+
+func (n *stubNode) called(method string) int {
+	n.Lock()
+	defer n.Unlock()
+	return n.calls[method]
+}
+
+func newTestPayer(node *stubNode) (*PayoutsProcessor, *storage.MemoryBackend, *httptest.Server) {
+	txCheckInterval = time.Millisecond
+	node.calls = make(map[string]int)
+	server := httptest.NewServer(node)
+
+	m := storage.NewMemoryBackend("test")
+	block := &storage.BlockData{Height: 1000, RoundHeight: 1000, Hash: "0xa", Reward: big.NewInt(5e18)}
+	m.WriteMaturedBlock(block, map[string]int64{"x": 1000, "y": 500})
+	cfg := &PayoutsConfig{Address: "0xpool", Daemon: server.URL, Timeout: "1s"}
+	return NewPayoutsProcessor(cfg, m), m, server
+}
+
+// Journals batch paying x and y up to the given state, like a run that died there
+func openTestBatch(t *testing.T, m *storage.MemoryBackend, state string) *storage.PayoutBatch {
+	batch := &storage.PayoutBatch{Id: "1-0", Payees: map[string]int64{"x": 600, "y": 500}}
+	if err := m.PlanPayoutBatch(batch); err != nil {
+		t.Fatalf("Must plan batch: %v", err)
+	}
+	steps := []string{storage.PayoutDebited, storage.PayoutCreated, storage.PayoutSigned, storage.PayoutBroadcast}
+	for _, step := range steps {
+		if batch.State == state {
+			break
+		}
+		batch.RawTx, batch.SignedTx, batch.TxHash = "0x01", "0x02", "0xf"
+		if err := m.AdvancePayoutBatch(batch, step); err != nil {
+			t.Fatalf("Must advance batch to %v: %v", step, err)
+		}
+	}
+	return batch
+}
+
+func checkBalances(t *testing.T, m *storage.MemoryBackend, expected map[string]int64) {
+	for login, amount := range expected {
+		if balance, _ := m.GetBalance(login); balance != amount {
+			t.Errorf("Invalid balance of %v: %v, expected %v", login, balance, amount)
+		}
+	}
+	snapshot, _ := m.GetAccountingSnapshot()
+	if mismatches := snapshot.Audit(); len(mismatches) != 0 {
+		t.Errorf("Books must balance: %v", mismatches)
+	}
+}
+
+func checkPaid(t *testing.T, m *storage.MemoryBackend) {
+	if batch, _ := m.GetOpenPayoutBatch(); batch != nil {
+		t.Errorf("Must close batch: %+v", batch)
+	}
+	if locked, _ := m.IsPayoutsLocked(); locked {
+		t.Error("Must unlock payouts")
+	}
+	if pending := m.GetPendingPayments(); len(pending) != 0 {
+		t.Errorf("Must remove pending payments: %v", pending)
+	}
+	payments, _ := m.GetPayments(0)
+	if len(payments) != 2 {
+		t.Fatalf("Must write 2 payments: %v", payments)
+	}
+	for _, p := range payments {
+		if p.TxHash != "0xf" {
+			t.Errorf("Invalid payment tx: %+v", p)
+		}
+	}
+	checkBalances(t, m, map[string]int64{"x": 400, "y": 0})
+}
+
+func TestRecoverPayouts(t *testing.T) {
+	tests := []struct {
+		state  string
+		mined  bool
+		create int
+		sign   int
+		send   int
+	}{
+		{storage.PayoutPlanned, false, 1, 1, 1},
+		{storage.PayoutDebited, false, 1, 1, 1},
+		{storage.PayoutCreated, false, 0, 1, 1},
+		{storage.PayoutSigned, false, 0, 0, 1},
+		{storage.PayoutSigned, true, 0, 0, 0},
+		{storage.PayoutBroadcast, true, 0, 0, 0},
+	}
+	for _, tt := range tests {
+		node := &stubNode{mined: tt.mined}
+		u, m, server := newTestPayer(node)
+		defer server.Close()
+		openTestBatch(t, m, tt.state)
+
+		if !u.recoverPayouts() {
+			t.Fatalf("Must resume %v batch", tt.state)
+		}
+		checkPaid(t, m)
+		if create, sign, send := node.called("createrawtx"), node.called("signrawtx"), node.called("sendrawtx"); create != tt.create || sign != tt.sign || send != tt.send {
+			t.Errorf("Invalid calls resuming %v batch: create %v, sign %v, send %v", tt.state, create, sign, send)
+		}
+	}
+}
+
+func TestRecoverPayoutsWithoutJournal(t *testing.T) {
+	u, m, server := newTestPayer(&stubNode{})
+	defer server.Close()
+	m.UpdateBalance("x", 600)
+
+	if u.recoverPayouts() {
+		t.Error("Must not start with pending payments without journal")
+	}
+}
+
+func TestSettleBatchBuildFailure(t *testing.T) {
+	nodes := map[string]*stubNode{
+		"create": {createErr: "insufficient balance"},
+		"sign":   {signErr: "invalid account"},
+	}
+	for step, node := range nodes {
+		u, m, server := newTestPayer(node)
+		defer server.Close()
+		batch := openTestBatch(t, m, storage.PayoutPlanned)
+
+		if !u.settleBatch(batch, false) || u.halt {
+			t.Errorf("Must go on after %v failure", step)
+		}
+		if batch.State != storage.PayoutFailed {
+			t.Errorf("Must fail batch on %v failure, got %v", step, batch.State)
+		}
+		if locked, _ := m.IsPayoutsLocked(); locked {
+			t.Errorf("Must unlock payouts after %v failure", step)
+		}
+		if pending := m.GetPendingPayments(); len(pending) != 0 {
+			t.Errorf("Must remove pending payments after %v failure: %v", step, pending)
+		}
+		if node.called("sendrawtx") != 0 {
+			t.Errorf("Must not broadcast after %v failure", step)
+		}
+		checkBalances(t, m, map[string]int64{"x": 1000, "y": 500})
+	}
+}
+
+func TestSettleBatchBroadcastFailure(t *testing.T) {
+	node := &stubNode{sendErr: "connection refused"}
+	u, m, server := newTestPayer(node)
+	defer server.Close()
+	batch := openTestBatch(t, m, storage.PayoutPlanned)
+
+	if u.settleBatch(batch, false) || !u.halt {
+		t.Fatal("Must halt on broadcast failure")
+	}
+	open, _ := m.GetOpenPayoutBatch()
+	if open == nil || open.State != storage.PayoutSigned {
+		t.Fatalf("Must keep batch signed: %+v", open)
+	}
+	if pending := m.GetPendingPayments(); len(pending) != 2 {
+		t.Errorf("Must keep pending payments: %v", pending)
+	}
+	checkBalances(t, m, map[string]int64{"x": 400, "y": 0})
+
+	// Next start broadcasts the same signed tx, balances are not debited again
+	node.Lock()
+	node.sendErr = ""
+	node.Unlock()
+	u = NewPayoutsProcessor(u.config, m)
+	if !u.recoverPayouts() {
+		t.Fatal("Must resume signed batch")
+	}
+	checkPaid(t, m)
+	if sign, send := node.called("signrawtx"), node.called("sendrawtx"); sign != 1 || send != 2 {
+		t.Errorf("Must broadcast signed tx again: sign %v, send %v", sign, send)
+	}
+}
+
+func TestSettleBatchTxInMempool(t *testing.T) {
+	node := &stubNode{sendErr: "Transaction already in mempool"}
+	u, m, server := newTestPayer(node)
+	defer server.Close()
+	openTestBatch(t, m, storage.PayoutSigned)
+	close(u.quit)
+
+	// Stopped while waiting for confirmation, node has the tx
+	if u.recoverPayouts() || u.halt {
+		t.Error("Must wait for tx known to the node")
+	}
+	open, _ := m.GetOpenPayoutBatch()
+	if open == nil || open.State != storage.PayoutBroadcast {
+		t.Errorf("Must move batch to broadcast: %+v", open)
+	}
+	checkBalances(t, m, map[string]int64{"x": 400, "y": 0})
+}
+
+func TestSplitPayouts(t *testing.T) {
+	payees := map[string]int64{"a": 100, "b": 300, "c": 200, "d": 200}
+	tests := []struct {
+		name         string
+		maxReceivers int
+		maxAmount    int64
+		expected     []map[string]int64
+	}{
+		{"no limits", 0, 0, []map[string]int64{payees}},
+		{"receiver cap", 3, 0, []map[string]int64{{"b": 300, "c": 200, "d": 200}, {"a": 100}}},
+		{"amount cap", 0, 500, []map[string]int64{{"b": 300, "c": 200}, {"d": 200, "a": 100}}},
+		{"both caps", 1, 1000, []map[string]int64{{"b": 300}, {"c": 200}, {"d": 200}, {"a": 100}}},
+		{"balance above cap", 2, 250, []map[string]int64{{"b": 250}, {"c": 200}, {"d": 200}, {"a": 100}}},
+	}
+	for _, tt := range tests {
+		batches := splitPayouts(payees, tt.maxReceivers, tt.maxAmount)
+		if !reflect.DeepEqual(batches, tt.expected) {
+			t.Errorf("%v: invalid batches %v, expected %v", tt.name, batches, tt.expected)
+		}
+	}
+}
+
+func TestSplitPayoutsOrder(t *testing.T) {
+	// Largest balances go first, ties by login
+	batches := splitPayouts(map[string]int64{"z": 10, "y": 10, "x": 5, "w": 20}, 1, 0)
+	order := []string{"w", "y", "z", "x"}
+	for i, batch := range batches {
+		if _, ok := batch[order[i]]; !ok {
+			t.Errorf("Batch %v must pay %v, got %v", i, order[i], batch)
+		}
+	}
+}
@@ -19,17 +19,48 @@ import (
 type UnlockerConfig struct {
 	Enabled        bool    `json:"enabled"`
 	PoolFee        float64 `json:"poolFee"`
+	SoloFee        float64 `json:"soloFee"`
 	PoolFeeAddress string  `json:"poolFeeAddress"`
 	Donate         bool    `json:"donate"`
 	Depth          int64   `json:"depth"`
 	ImmatureDepth  int64   `json:"immatureDepth"`
 	KeepTxFees     bool    `json:"keepTxFees"`
-	Interval       string  `json:"interval"`
-	Daemon         string  `json:"daemon"`
-	Timeout        string  `json:"timeout"`
-	Account        string
-	Password       string
-	Address        string
+	// Reward shares of the last pplns × network difficulty across rounds, 0 pays per round
+	PPLNS float64 `json:"pplns"`
+	// "pps" or "fpps" credits shares as they come, found blocks go to the pool reserve
+	Mode     string `json:"mode"`
+	Interval string `json:"interval"`
+	Daemon   string `json:"daemon"`
+	Timeout  string `json:"timeout"`
+	Account  string
+	Password string
+	Address  string
+}
+
+const (
+	ModePPS  = "pps"
+	ModeFPPS = "fpps"
+)
+
+// Miners are paid per share instead of per block found
+func (c *UnlockerConfig) IsPPS() bool {
+	return c.Mode == ModePPS || c.Mode == ModeFPPS
+}
+
+// Expected value of a share less pool fee: subsidy, and average tx fees for FPPS,
+// scaled by share to network difficulty. 0 unless pool pays per share.
+func (c *UnlockerConfig) ShareReward(shareDiff, netDiff, height, txFees int64) int64 {
+	if !c.IsPPS() || netDiff <= 0 {
+		return 0
+	}
+	value := new(big.Rat).SetInt(getConstReward(height))
+	if c.Mode == ModeFPPS && txFees > 0 {
+		value.Add(value, new(big.Rat).SetInt64(txFees))
+	}
+	value.Mul(value, big.NewRat(shareDiff, netDiff))
+	value, _ = chargeFee(value, c.PoolFee)
+	reward, _ := strconv.ParseInt(value.FloatString(0), 10, 64)
+	return reward
 }
 
 const minDepth = 16
@@ -44,13 +75,15 @@ const donationAccount = "0xb85150eb365e7df0941f0cf08235f987ba91506a"
 
 type BlockUnlocker struct {
 	config   *UnlockerConfig
-	backend  *storage.RedisClient
+	backend  storage.Backend
 	rpc      *rpc.RPCClient
 	halt     bool
 	lastFail error
+	quit     chan struct{}
+	done     chan struct{}
 }
 
-func NewBlockUnlocker(cfg *UnlockerConfig, backend *storage.RedisClient) *BlockUnlocker {
+func NewBlockUnlocker(cfg *UnlockerConfig, backend storage.Backend) *BlockUnlocker {
 	if len(cfg.PoolFeeAddress) != 0 && !util.IsValidBitcoinAddress(cfg.PoolFeeAddress) {
 		log.Fatalln("Invalid poolFeeAddress", cfg.PoolFeeAddress)
 	}
@@ -60,7 +93,13 @@ func NewBlockUnlocker(cfg *UnlockerConfig, backend *storage.RedisClient) *BlockU
 	if cfg.ImmatureDepth < minDepth {
 		log.Fatalf("Immature depth can't be < %v, your depth is %v", minDepth, cfg.ImmatureDepth)
 	}
-	u := &BlockUnlocker{config: cfg, backend: backend}
+	if len(cfg.Mode) > 0 && !cfg.IsPPS() {
+		log.Fatalf("Unknown unlocker mode %v", cfg.Mode)
+	}
+	if cfg.IsPPS() && cfg.PPLNS > 0 {
+		log.Fatalf("PPLNS can't be used in %v mode", cfg.Mode)
+	}
+	u := &BlockUnlocker{config: cfg, backend: backend, quit: make(chan struct{}), done: make(chan struct{})}
 	u.rpc = rpc.NewRPCClient("BlockUnlocker", cfg.Daemon, cfg.Account, cfg.Password, cfg.Timeout)
 	return u
 }
@@ -71,14 +110,19 @@ func (u *BlockUnlocker) Start() {
 	timer := time.NewTimer(intv)
 	log.Printf("Set block unlock interval to %v", intv)
 
-	// Immediately unlock after start
-	u.unlockPendingBlocks()
-	u.unlockAndCreditMiners()
-	timer.Reset(intv)
-
 	go func() {
+		defer close(u.done)
+
+		// Immediately unlock after start
+		u.unlockPendingBlocks()
+		u.unlockAndCreditMiners()
+		timer.Reset(intv)
+
 		for {
 			select {
+			case <-u.quit:
+				timer.Stop()
+				return
 			case <-timer.C:
 				u.unlockPendingBlocks()
 				u.unlockAndCreditMiners()
@@ -88,6 +132,14 @@ func (u *BlockUnlocker) Start() {
 	}()
 }
 
+// Waits for running unlock cycle to finish
+func (u *BlockUnlocker) Stop() {
+	log.Println("Stopping block unlocker")
+	close(u.quit)
+	<-u.done
+	log.Println("Block unlocker stopped")
+}
+
 type UnlockResult struct {
 	maturedBlocks  []*storage.BlockData
 	orphanedBlocks []*storage.BlockData
@@ -363,7 +415,11 @@ func (u *BlockUnlocker) unlockAndCreditMiners() {
 			log.Printf("Failed to calculate rewards for round %v: %v", block.RoundKey(), err)
 			return
 		}
-		err = u.backend.WriteMaturedBlock(block, roundRewards)
+		if u.config.IsPPS() && !block.Solo {
+			err = u.backend.WriteReserveBlock(block, getTxFees(block))
+		} else {
+			err = u.backend.WriteMaturedBlock(block, roundRewards)
+		}
 		if err != nil {
 			u.halt = true
 			u.lastFail = err
@@ -398,14 +454,26 @@ func (u *BlockUnlocker) unlockAndCreditMiners() {
 
 func (u *BlockUnlocker) calculateRewards(block *storage.BlockData) (*big.Rat, *big.Rat, *big.Rat, map[string]int64, error) {
 	revenue := new(big.Rat).SetInt(block.Reward)
-	minersProfit, poolProfit := chargeFee(revenue, u.config.PoolFee)
 
-	shares, err := u.backend.GetRoundShares(block.RoundHeight, block.Nonce)
+	// Shares were paid already, whole block goes to the reserve
+	if u.config.IsPPS() && !block.Solo {
+		if block.ExtraReward != nil {
+			revenue.Add(revenue, new(big.Rat).SetInt(block.ExtraReward))
+		}
+		return revenue, new(big.Rat), new(big.Rat).Set(revenue), make(map[string]int64), nil
+	}
+	poolFee := u.config.PoolFee
+	if block.Solo {
+		poolFee = u.config.SoloFee
+	}
+	minersProfit, poolProfit := chargeFee(revenue, poolFee)
+
+	shares, total, err := u.getRoundShares(block)
 	if err != nil {
 		return nil, nil, nil, nil, err
 	}
 
-	rewards := calculateRewardsForShares(shares, block.TotalShares, minersProfit)
+	rewards := calculateRewardsForShares(shares, total, minersProfit)
 
 	if block.ExtraReward != nil {
 		extraReward := new(big.Rat).SetInt(block.ExtraReward)
@@ -429,6 +497,27 @@ func (u *BlockUnlocker) calculateRewards(block *storage.BlockData) (*big.Rat, *b
 	return revenue, minersProfit, poolProfit, rewards, nil
 }
 
+// Returns PPLNS window snapshot stored with the block, round shares for blocks found without it.
+// Round of solo block holds shares of the finder only.
+func (u *BlockUnlocker) getRoundShares(block *storage.BlockData) (map[string]int64, int64, error) {
+	if u.config.PPLNS > 0 && !block.Solo {
+		window, err := u.backend.GetWindowShares(block.Nonce)
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(window) > 0 {
+			total := int64(0)
+			for _, n := range window {
+				total += n
+			}
+			return window, total, nil
+		}
+		log.Printf("No PPLNS window for round %v, rewarding round shares", block.RoundKey())
+	}
+	shares, err := u.backend.GetRoundShares(block.RoundHeight, block.Nonce)
+	return shares, block.TotalShares, err
+}
+
 func calculateRewardsForShares(shares map[string]int64, total int64, reward *big.Rat) map[string]int64 {
 	rewards := make(map[string]int64)
 
@@ -452,6 +541,15 @@ func getConstReward(height int64) *big.Int {
 	return big.NewInt(int64(300000000 * _math.Pow(0.95 , float64(height/500000))))
 }
 
+// Coinbase value above subsidy, whether kept aside or included in reward
+func getTxFees(block *storage.BlockData) int64 {
+	fees := new(big.Int).Sub(block.Reward, getConstReward(block.Height))
+	if block.ExtraReward != nil {
+		fees.Add(fees, block.ExtraReward)
+	}
+	return fees.Int64()
+}
+
 func (u *BlockUnlocker) getRewardWithFee(block *rpc.GetBlockReply) (*big.Int, error) {
 	if len(block.Transactions[0].Outputs) != 1 {
 		return nil, fmt.Errorf("coinbase invalid output length")
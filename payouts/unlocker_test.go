@@ -3,10 +3,13 @@ package payouts
 import (
 	"math/big"
 	"os"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/sammy007/open-ethereum-pool/rpc"
 	"github.com/sammy007/open-ethereum-pool/storage"
+	"github.com/sammy007/open-ethereum-pool/util"
 )
 
 func TestMain(m *testing.M) {
@@ -14,7 +17,7 @@ func TestMain(m *testing.M) {
 }
 
 func TestCalculateRewards(t *testing.T) {
-	blockReward, _ := new(big.Rat).SetString("5000000000000000000")
+	blockReward, _ := new(big.Rat).SetString("5000000000")
 	shares := map[string]int64{"0x0": 1000000, "0x1": 20000, "0x2": 5000, "0x3": 10, "0x4": 1}
 	expectedRewards := map[string]int64{"0x0": 4877996431, "0x1": 97559929, "0x2": 24389982, "0x3": 48780, "0x4": 4878}
 	totalShares := int64(1025011)
@@ -31,7 +34,7 @@ func TestCalculateRewards(t *testing.T) {
 		}
 	}
 	if totalAmount != expectedTotalAmount {
-		t.Errorf("Total reward must be equal to block reward in Shannon: %v vs %v", expectedTotalAmount, totalAmount)
+		t.Errorf("Total reward must be equal to block reward: %v vs %v", expectedTotalAmount, totalAmount)
 	}
 }
 
@@ -53,99 +56,191 @@ func TestChargeFee(t *testing.T) {
 	}
 }
 
-func TestWeiToShannonInt64(t *testing.T) {
-	wei, _ := new(big.Rat).SetString("1000000000000000000")
-	origWei, _ := new(big.Rat).SetString("1000000000000000000")
-	shannon := int64(1000000000)
+func TestMatchCandidate(t *testing.T) {
+	u := &BlockUnlocker{config: &UnlockerConfig{Address: "MPool"}}
+	coinbase := []rpc.MVSTx{{Outputs: []rpc.MVSTxOutput{{Address: "MPool"}}}}
+	block := &rpc.GetBlockReply{Hash: "0x12345A", Nonce: "26", Transactions: coinbase}
+	candidate := &storage.BlockData{Nonce: "0x1a"}
+	orphan := &storage.BlockData{Nonce: "0x1abc"}
 
-	if weiToShannonInt64(wei) != shannon {
-		t.Error("Must convert to Shannon")
+	if !u.matchCandidate(block, candidate) {
+		t.Error("Must match with nonce")
 	}
-	if wei.Cmp(origWei) != 0 {
-		t.Error("Must charge original value")
+	if u.matchCandidate(block, orphan) {
+		t.Error("Must not match orphan with nonce")
+	}
+
+	immature := &storage.BlockData{Hash: "0x12345a", Nonce: "0x1a"}
+	if !u.matchCandidate(block, immature) {
+		t.Error("Must match with hash")
+	}
+	immature.Hash = "0x12345b"
+	if u.matchCandidate(block, immature) {
+		t.Error("Must not match other hash")
+	}
+
+	foreign := &rpc.GetBlockReply{Hash: "0x12345A", Nonce: "26",
+		Transactions: []rpc.MVSTx{{Outputs: []rpc.MVSTxOutput{{Address: "MOther"}}}}}
+	if u.matchCandidate(foreign, candidate) {
+		t.Error("Must not match block paying other coinbase address")
 	}
 }
 
-func TestGetUncleReward(t *testing.T) {
-	rewards := make(map[int64]string)
-	expectedRewards := map[int64]string{
-		1: "4375000000000000000",
-		2: "3750000000000000000",
-		3: "3125000000000000000",
-		4: "2500000000000000000",
-		5: "1875000000000000000",
-		6: "1250000000000000000",
-		7: "625000000000000000",
-	}
-	for i := int64(1); i < 8; i++ {
-		rewards[i] = getUncleReward(1, i+1).String()
-	}
-	for i, reward := range rewards {
-		if expectedRewards[i] != rewards[i] {
-			t.Errorf("Incorrect uncle reward for %v, expected %v vs %v", i, expectedRewards[i], reward)
+// Returns the only candidate found at height with its reward set
+func findCandidate(t *testing.T, m *storage.MemoryBackend, height int64, reward int64) *storage.BlockData {
+	candidates, _ := m.GetCandidates(height)
+	for _, c := range candidates {
+		if c.Height == height {
+			c.Reward = big.NewInt(reward)
+			return c
 		}
 	}
+	t.Fatalf("No candidate at height %v", height)
+	return nil
 }
 
-func TestGetByzantiumUncleReward(t *testing.T) {
-	rewards := make(map[int64]string)
-	expectedRewards := map[int64]string{
-		1: "2625000000000000000",
-		2: "2250000000000000000",
-		3: "1875000000000000000",
-		4: "1500000000000000000",
-		5: "1125000000000000000",
-		6: "750000000000000000",
-		7: "375000000000000000",
-	}
-	for i := int64(1); i < 8; i++ {
-		rewards[i] = getUncleReward(byzantiumHardForkHeight, byzantiumHardForkHeight+i).String()
-	}
-	for i, reward := range rewards {
-		if expectedRewards[i] != rewards[i] {
-			t.Errorf("Incorrect uncle reward for %v, expected %v vs %v", i, expectedRewards[i], reward)
+func TestCalculatePPLNSRewards(t *testing.T) {
+	tests := []struct {
+		name     string
+		pplns    float64
+		setup    func(m *storage.MemoryBackend) *storage.BlockData
+		expected map[string]int64
+	}{
+		{
+			// Window of 2 × 125 takes both shares of the second round and half of the block share of the first one
+			name:  "window spanning two rounds",
+			pplns: 2,
+			setup: func(m *storage.MemoryBackend) *storage.BlockData {
+				ms := util.MakeTimestamp()
+				m.SetPPLNS(2)
+				m.WriteShares("1", []*storage.Share{{Login: "y", Id: "a", Diff: 100, Timestamp: ms - 1000}}, time.Hour)
+				m.WriteBlock("y", "a", []string{"0x1", "0x2", "0x3"}, 100, 1000, 0, false, 1000, time.Hour, nil, nil)
+				// Window is ordered by share time in ms
+				time.Sleep(2 * time.Millisecond)
+				m.WriteShares("2", []*storage.Share{{Login: "z", Id: "a", Diff: 100, Timestamp: util.MakeTimestamp()}}, time.Hour)
+				time.Sleep(2 * time.Millisecond)
+				m.WriteBlock("x", "a", []string{"0x4", "0x5", "0x6"}, 100, 125, 0, false, 1001, time.Hour, nil, nil)
+				return findCandidate(t, m, 1001, 250000)
+			},
+			expected: map[string]int64{"x": 100000, "y": 50000, "z": 100000},
+		},
+		{
+			name:  "block without snapshot",
+			pplns: 2,
+			setup: func(m *storage.MemoryBackend) *storage.BlockData {
+				m.WriteShares("3", []*storage.Share{{Login: "y", Id: "a", Diff: 300, Height: 1000, Timestamp: util.MakeTimestamp()}}, time.Hour)
+				m.WriteBlock("x", "a", []string{"0x1", "0x2", "0x3"}, 100, 125, 0, false, 1000, time.Hour, nil, nil)
+				return findCandidate(t, m, 1000, 250000)
+			},
+			expected: map[string]int64{"x": 62500, "y": 187500},
+		},
+		{
+			name: "round shares",
+			setup: func(m *storage.MemoryBackend) *storage.BlockData {
+				m.SetPPLNS(2)
+				m.WriteShares("4", []*storage.Share{{Login: "y", Id: "a", Diff: 300, Height: 1000, Timestamp: util.MakeTimestamp()}}, time.Hour)
+				m.WriteBlock("x", "a", []string{"0x1", "0x2", "0x3"}, 100, 125, 0, false, 1000, time.Hour, nil, nil)
+				return findCandidate(t, m, 1000, 250000)
+			},
+			expected: map[string]int64{"x": 62500, "y": 187500},
+		},
+	}
+	for _, tt := range tests {
+		m := storage.NewMemoryBackend("test")
+		u := &BlockUnlocker{config: &UnlockerConfig{PPLNS: tt.pplns}, backend: m}
+		block := tt.setup(m)
+
+		_, _, _, rewards, err := u.calculateRewards(block)
+		if err != nil {
+			t.Fatalf("%v: failed to calculate rewards: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(rewards, tt.expected) {
+			t.Errorf("%v: invalid rewards %v, expected %v", tt.name, rewards, tt.expected)
 		}
 	}
 }
 
-func TestGetRewardForUngle(t *testing.T) {
-	reward := getRewardForUncle(1).String()
-	expectedReward := "156250000000000000"
-	if expectedReward != reward {
-		t.Errorf("Incorrect uncle bonus for height %v, expected %v vs %v", 1, expectedReward, reward)
+func TestShareReward(t *testing.T) {
+	tests := []struct {
+		name                               string
+		config                             UnlockerConfig
+		shareDiff, netDiff, height, txFees int64
+		expected                           int64
+	}{
+		{"prop", UnlockerConfig{PoolFee: 1}, 100, 1000, 0, 0, 0},
+		{"pps", UnlockerConfig{Mode: ModePPS, PoolFee: 1}, 100, 1000, 0, 1000000, 29700000},
+		{"pps reduced subsidy", UnlockerConfig{Mode: ModePPS, PoolFee: 1}, 100, 1000, 500000, 0, 28215000},
+		{"fpps with tx fees", UnlockerConfig{Mode: ModeFPPS, PoolFee: 1}, 100, 1000, 0, 1000000, 29799000},
+		{"fpps without tx fees", UnlockerConfig{Mode: ModeFPPS}, 100, 1000, 0, 0, 30000000},
+		{"zero network difficulty", UnlockerConfig{Mode: ModeFPPS, PoolFee: 1}, 100, 0, 0, 1000000, 0},
+		{"negative network difficulty", UnlockerConfig{Mode: ModePPS}, 100, -1, 0, 0, 0},
+	}
+	for _, tt := range tests {
+		if reward := tt.config.ShareReward(tt.shareDiff, tt.netDiff, tt.height, tt.txFees); reward != tt.expected {
+			t.Errorf("%v: invalid share reward %v, expected %v", tt.name, reward, tt.expected)
+		}
 	}
 }
 
-func TestGetByzantiumRewardForUngle(t *testing.T) {
-	reward := getRewardForUncle(byzantiumHardForkHeight).String()
-	expectedReward := "93750000000000000"
-	if expectedReward != reward {
-		t.Errorf("Incorrect uncle bonus for height %v, expected %v vs %v", byzantiumHardForkHeight, expectedReward, reward)
+func TestGetTxFees(t *testing.T) {
+	block := &storage.BlockData{Height: 0, Reward: big.NewInt(300000500)}
+	if fees := getTxFees(block); fees != 500 {
+		t.Errorf("Invalid tx fees in reward: %v", fees)
+	}
+	block.ExtraReward = big.NewInt(100)
+	if fees := getTxFees(block); fees != 600 {
+		t.Errorf("Must add tx fees kept aside: %v", fees)
 	}
 }
 
-func TestMatchCandidate(t *testing.T) {
-	gethBlock := &rpc.GetBlockReply{Hash: "0x12345A", Nonce: "0x1A"}
-	parityBlock := &rpc.GetBlockReply{Hash: "0x12345A", SealFields: []string{"0x0A", "0x1A"}}
-	candidate := &storage.BlockData{Nonce: "0x1a"}
-	orphan := &storage.BlockData{Nonce: "0x1abc"}
+func TestCalculatePPSRewards(t *testing.T) {
+	m := storage.NewMemoryBackend("test")
+	m.WriteShares("5", []*storage.Share{{Login: "x", Id: "a", Diff: 300, Height: 1000, Timestamp: util.MakeTimestamp()}}, time.Hour)
+	m.WriteBlock("x", "a", []string{"0x1", "0x2", "0x3"}, 100, 1000, 30, false, 1000, time.Hour, nil, nil)
+	block := findCandidate(t, m, 1000, 1000)
+	block.ExtraReward = big.NewInt(50)
 
-	if !matchCandidate(gethBlock, candidate) {
-		t.Error("Must match with nonce")
+	u := &BlockUnlocker{config: &UnlockerConfig{Mode: ModePPS, PoolFee: 1, PoolFeeAddress: "x"}, backend: m}
+	revenue, minersProfit, poolProfit, rewards, err := u.calculateRewards(block)
+	if err != nil {
+		t.Fatalf("Failed to calculate rewards: %v", err)
 	}
-	if !matchCandidate(parityBlock, candidate) {
-		t.Error("Must match with seal fields")
+	if revenue.Cmp(big.NewRat(1050, 1)) != 0 || poolProfit.Cmp(revenue) != 0 || minersProfit.Sign() != 0 {
+		t.Errorf("Whole block must go to the reserve: %v %v %v", revenue, minersProfit, poolProfit)
 	}
-	if matchCandidate(gethBlock, orphan) {
-		t.Error("Must not match with orphan with nonce")
-	}
-	if matchCandidate(parityBlock, orphan) {
-		t.Error("Must not match orphan with seal fields")
+	if len(rewards) != 0 {
+		t.Errorf("Must not credit shares paid already: %v", rewards)
 	}
+}
 
-	block := &rpc.GetBlockReply{Hash: "0x12345A"}
-	immature := &storage.BlockData{Hash: "0x12345a", Nonce: "0x0"}
-	if !matchCandidate(block, immature) {
-		t.Error("Must match with hash")
+func TestCalculateSoloRewards(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   UnlockerConfig
+		expected map[string]int64
+	}{
+		{"prop", UnlockerConfig{PoolFee: 5, SoloFee: 1, PoolFeeAddress: "fee"}, map[string]int64{"y": 990, "fee": 10}},
+		{"pplns", UnlockerConfig{PoolFee: 5, SoloFee: 1, PPLNS: 2}, map[string]int64{"y": 990}},
+		{"pps", UnlockerConfig{Mode: ModePPS, PoolFee: 5, SoloFee: 2}, map[string]int64{"y": 980}},
+	}
+	for _, tt := range tests {
+		m := storage.NewMemoryBackend("test")
+		m.SetPPLNS(2)
+		ms := util.MakeTimestamp()
+		m.WriteShares("6", []*storage.Share{
+			{Login: "x", Id: "a", Diff: 100, Timestamp: ms},
+			{Login: "y", Id: "a", Diff: 100, Timestamp: ms, Solo: true},
+		}, time.Hour)
+		m.WriteBlock("y", "a", []string{"0x1", "0x2", "0x3"}, 100, 1000, 0, true, 1000, time.Hour, nil, nil)
+		block := findCandidate(t, m, 1000, 1000)
+
+		u := &BlockUnlocker{config: &tt.config, backend: m}
+		_, _, _, rewards, err := u.calculateRewards(block)
+		if err != nil {
+			t.Fatalf("%v: failed to calculate rewards: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(rewards, tt.expected) {
+			t.Errorf("%v: invalid solo rewards %v, expected %v", tt.name, rewards, tt.expected)
+		}
 	}
 }
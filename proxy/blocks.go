@@ -4,7 +4,7 @@ import (
 	"log"
 	"math/big"
 	"strconv"
-	//"strings"
+	"strings"
 	"sync"
 
 	"github.com/ethereum/go-ethereum/common"
@@ -45,6 +45,19 @@ func (b Block) Nonce() uint64            { return b.nonce }
 func (b Block) MixDigest() common.Hash   { return b.mixDigest }
 func (b Block) NumberU64() uint64        { return b.number }
 
+// Looks up header in job backlog, current job is included
+func (t *BlockTemplate) jobHeight(header string) (heightDiffPair, bool) {
+	if h, ok := t.headers[header]; ok {
+		return h, true
+	}
+	for k, h := range t.headers {
+		if strings.EqualFold(k, header) {
+			return h, true
+		}
+	}
+	return heightDiffPair{}, false
+}
+
 func (s *ProxyServer) fetchBlockTemplate() {
 	rpc := s.rpc()
 	t := s.currentBlockTemplate()
@@ -97,6 +110,7 @@ func (s *ProxyServer) fetchBlockTemplate() {
 		}
 	}
 	s.blockTemplate.Store(&newTemplate)
+	s.epochs.update(height)
 	log.Printf("New block to mine on %s at height %d / %s", rpc.Name, height, reply[0][0:10])
 
 	// Stratums
@@ -2,6 +2,7 @@ package proxy
 
 import (
 	"github.com/sammy007/open-ethereum-pool/api"
+	"github.com/sammy007/open-ethereum-pool/archiver"
 	"github.com/sammy007/open-ethereum-pool/payouts"
 	"github.com/sammy007/open-ethereum-pool/policy"
 	"github.com/sammy007/open-ethereum-pool/storage"
@@ -16,13 +17,19 @@ type Config struct {
 	Upstream              []Upstream    `json:"upstream"`
 	UpstreamCheckInterval string        `json:"upstreamCheckInterval"`
 
+	UpstreamSelection UpstreamSelection `json:"upstreamSelection"`
+
 	Threads int `json:"threads"`
 
 	Coin  string         `json:"coin"`
 	Redis storage.Config `json:"redis"`
+	// "redis" or "memory", in-memory state is lost on exit and not shared between processes
+	Backend string `json:"backend"`
 
-	BlockUnlocker payouts.UnlockerConfig `json:"unlocker"`
-	Payouts       payouts.PayoutsConfig  `json:"payouts"`
+	BlockUnlocker payouts.UnlockerConfig  `json:"unlocker"`
+	Payouts       payouts.PayoutsConfig   `json:"payouts"`
+	Archiver      archiver.ArchiverConfig `json:"archiver"`
+	Auditor       payouts.AuditorConfig   `json:"auditor"`
 
 	NewrelicName    string `json:"newrelicName"`
 	NewrelicKey     string `json:"newrelicKey"`
@@ -47,14 +54,91 @@ type Proxy struct {
 	HealthCheck bool  `json:"healthCheck"`
 
 	Stratums []Stratum `json:"stratums"`
+	// Login with this suffix, e.g. "+solo", mines solo on any stratum, HTTP getwork has no solo
+	SoloSuffix string `json:"soloSuffix"`
+
+	ShareWriter storage.ShareWriterConfig `json:"shareWriter"`
+
+	Verify Verify `json:"verify"`
+	Ethash Ethash `json:"ethash"`
+
+	// Sources of new block notifications, templates are also refreshed every blockRefreshInterval
+	BlockNotify []BlockNotify `json:"blockNotify"`
 }
 
-type Stratum struct {
-	Enabled bool   `json:"enabled"`
-	Listen  string `json:"listen"`
+type Verify struct {
+	// Defaults to number of CPUs
+	Workers int `json:"workers"`
+	// Shares waiting for verification, shares are rejected if the queue is full.
+	// Shares claiming to be a block skip it. Defaults to 16 per worker.
+	QueueSize int `json:"queueSize"`
+}
+
+type Ethash struct {
+	// Number of epoch caches kept in memory, defaults to 3
+	Epochs int `json:"epochs"`
+	// Build next epoch cache this number of blocks before the boundary, defaults to 1000
+	PregenerateBlocks uint64 `json:"pregenerateBlocks"`
+}
+
+type BlockNotify struct {
+	Name string `json:"name"`
+	// One of "websocket", "http" or "poll"
+	Type string `json:"type"`
+	// Node websocket endpoint
+	Url     string `json:"url"`
 	Timeout string `json:"timeout"`
-	Difficulty           int64  `json:"difficulty"`
-	MaxConn int    `json:"maxConn"`
+	// Address of HTTP endpoint for node blocknotify hook
+	Listen string `json:"listen"`
+	// Polling interval
+	Interval string `json:"interval"`
+}
+
+type Stratum struct {
+	Enabled    bool    `json:"enabled"`
+	Listen     string  `json:"listen"`
+	Timeout    string  `json:"timeout"`
+	Difficulty int64   `json:"difficulty"`
+	MaxConn    int     `json:"maxConn"`
+	VarDiff    VarDiff `json:"varDiff"`
+	// One of "auto", "stratum" or "ethereumstratum"
+	Protocol string `json:"protocol"`
+
+	// Serve stratum over TLS if certificate and key are set
+	TLSCert string `json:"tlsCert"`
+	TLSKey  string `json:"tlsKey"`
+	// Require client certificates signed by this CA
+	TLSClientCA string `json:"tlsClientCA"`
+
+	// Accept HAProxy PROXY protocol v1/v2 header from these CIDRs, other peers connect directly
+	ProxyProtocol  bool     `json:"proxyProtocol"`
+	TrustedProxies []string `json:"trustedProxies"`
+
+	// Every miner of this stratum mines solo
+	Solo bool `json:"solo"`
+}
+
+type VarDiff struct {
+	Enabled bool  `json:"enabled"`
+	MinDiff int64 `json:"minDiff"`
+	MaxDiff int64 `json:"maxDiff"`
+	// Desired interval between shares of a single session
+	TargetTime string `json:"targetTime"`
+	// Minimum interval between two retargets
+	RetargetTime string `json:"retargetTime"`
+	// Allowed deviation of observed share interval from target, in percent
+	VariancePercent float64 `json:"variancePercent"`
+}
+
+type UpstreamSelection struct {
+	// Never select upstream lagging more blocks behind the best known height
+	MaxHeightLag int64 `json:"maxHeightLag"`
+	// Score is heightWeight * blocks behind + latencyWeight * latency in ms, the lowest wins.
+	// Ties are resolved by config order.
+	HeightWeight  float64 `json:"heightWeight"`
+	LatencyWeight float64 `json:"latencyWeight"`
+	// Keep current upstream unless another one scores better by this amount
+	Hysteresis float64 `json:"hysteresis"`
 }
 
 type Upstream struct {
@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	defaultEthashEpochs      = 3
+	defaultPregenerateBlocks = 1000
+)
+
+type EthashState struct {
+	Epoch        uint64   `json:"epoch"`
+	Epochs       int      `json:"epochs"`
+	Pregenerated []uint64 `json:"pregenerated"`
+	Generating   bool     `json:"generating"`
+	// Duration of the last pregeneration in milliseconds
+	LastDuration float64 `json:"lastDuration"`
+}
+
+// Builds verification caches of the next epoch in background, so shares at epoch boundary don't stall
+type epochWatcher struct {
+	sync.Mutex
+	epochs int
+	// Start pregeneration this number of blocks before the boundary
+	window uint64
+
+	epoch        uint64
+	pregenerated map[uint64]bool
+	generating   bool
+	lastDuration time.Duration
+}
+
+func newEpochWatcher(cfg *Ethash) *epochWatcher {
+	w := &epochWatcher{epochs: cfg.Epochs, window: cfg.PregenerateBlocks, pregenerated: make(map[uint64]bool)}
+	if w.epochs <= 0 {
+		w.epochs = defaultEthashEpochs
+	}
+	// Current and the next epoch must fit
+	if w.epochs < 2 {
+		w.epochs = 2
+	}
+	if w.window == 0 {
+		w.window = defaultPregenerateBlocks
+	}
+	if w.window > epochLength {
+		w.window = epochLength
+	}
+	lightHash.setSize(w.epochs)
+	return w
+}
+
+// Called on each new block template
+func (w *epochWatcher) update(height uint64) {
+	w.Lock()
+	defer w.Unlock()
+
+	epoch := height / epochLength
+	if epoch != w.epoch {
+		w.epoch = epoch
+		for k := range w.pregenerated {
+			if k <= epoch {
+				delete(w.pregenerated, k)
+			}
+		}
+	}
+	next := epoch + 1
+	if w.generating || w.pregenerated[next] || height+w.window < next*epochLength {
+		return
+	}
+	w.generating = true
+	go w.pregenerate(next)
+}
+
+func (w *epochWatcher) pregenerate(epoch uint64) {
+	log.Printf("Generating ethash cache for epoch %v", epoch)
+	start := time.Now()
+
+	lightHash.get(epoch)
+	elapsed := time.Since(start)
+	log.Printf("Generated ethash cache for epoch %v in %v", epoch, elapsed)
+
+	w.Lock()
+	w.generating = false
+	w.pregenerated[epoch] = true
+	w.lastDuration = elapsed
+	w.Unlock()
+}
+
+func (w *epochWatcher) state() EthashState {
+	w.Lock()
+	defer w.Unlock()
+
+	s := EthashState{Epoch: w.epoch, Epochs: w.epochs, Generating: w.generating, LastDuration: w.lastDuration.Seconds() * 1000}
+	for k := range w.pregenerated {
+		s.Pregenerated = append(s.Pregenerated, k)
+	}
+	return s
+}
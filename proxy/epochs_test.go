@@ -0,0 +1,29 @@
+package proxy
+
+import "testing"
+
+func TestEpochWatcherWaitsForWindow(t *testing.T) {
+	w := newEpochWatcher(&Ethash{Epochs: 3, PregenerateBlocks: 100})
+
+	w.update(epochLength - 101)
+	if state := w.state(); state.Generating || state.Epoch != 0 {
+		t.Errorf("Must not pregenerate before window, got %+v", state)
+	}
+	// Pretend next epoch was built already
+	w.pregenerated[1] = true
+	w.update(epochLength - 50)
+	if w.state().Generating {
+		t.Error("Must not pregenerate the same epoch twice")
+	}
+	w.update(epochLength + 1)
+	if state := w.state(); state.Epoch != 1 || len(state.Pregenerated) != 0 {
+		t.Errorf("Must forget passed epochs, got %+v", state)
+	}
+}
+
+func TestEpochWatcherDefaults(t *testing.T) {
+	w := newEpochWatcher(&Ethash{Epochs: 1})
+	if w.epochs != 2 || w.window != defaultPregenerateBlocks {
+		t.Errorf("Must keep at least current and next epoch, got %v epochs", w.epochs)
+	}
+}
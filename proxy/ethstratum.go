@@ -0,0 +1,204 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"sync/atomic"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+const (
+	ProtocolAuto            = "auto"
+	ProtocolStratum         = "stratum"
+	ProtocolEthereumStratum = "ethereumstratum"
+)
+
+const ethereumStratumVersion = "EthereumStratum/1.0.0"
+
+// Difficulty 1 in EthereumStratum/1.0.0 is 2^32 hashes
+const ethereumStratumDiff1 = 4294967296.0
+
+// Extranonce takes 3 bytes of 8 bytes nonce, miner iterates the rest
+const extranonceSize = 3
+
+var nonceSuffixPattern = regexp.MustCompile(fmt.Sprintf("^[0-9a-f]{%d}$", 16-extranonceSize*2))
+
+func isValidProtocol(protocol string) bool {
+	switch protocol {
+	case "", ProtocolAuto, ProtocolStratum, ProtocolEthereumStratum:
+		return true
+	}
+	return false
+}
+
+// Uses protocol from stratum config or detects it from the first request
+func (s *ProxyServer) detectProtocol(stratum_id int, method string) string {
+	protocol := s.config.Proxy.Stratums[stratum_id].Protocol
+	if protocol == ProtocolStratum || protocol == ProtocolEthereumStratum {
+		return protocol
+	}
+	if strings.HasPrefix(method, "mining.") {
+		return ProtocolEthereumStratum
+	}
+	return ProtocolStratum
+}
+
+func (s *ProxyServer) nextExtranonce() string {
+	n := atomic.AddUint32(&s.extranonce, 1) & (1<<(extranonceSize*8) - 1)
+	return fmt.Sprintf("%0*x", extranonceSize*2, n)
+}
+
+// Job id is a short form of header hash, shares refer to the job by it
+func jobId(header string) string {
+	header = strings.TrimPrefix(header, "0x")
+	if len(header) > 16 {
+		return header[0:16]
+	}
+	return header
+}
+
+func (t *BlockTemplate) headerByJobId(id string) (string, bool) {
+	for header := range t.headers {
+		if jobId(header) == id {
+			return header, true
+		}
+	}
+	return "", false
+}
+
+func (cs *Session) handleEthereumStratumMessage(s *ProxyServer, req *StratumReq) error {
+	var params []string
+	if req.Params != nil {
+		err := json.Unmarshal(*req.Params, &params)
+		if err != nil {
+			log.Println("Malformed stratum request params from", cs.ip)
+			return err
+		}
+	}
+
+	// Handle RPC methods
+	switch req.Method {
+	case "mining.subscribe":
+		if len(params) > 1 && params[1] != ethereumStratumVersion {
+			return cs.sendTCPError(req.Id, &ErrorReply{Code: -1, Message: "Unsupported protocol version"})
+		}
+		if len(cs.extranonce) == 0 {
+			cs.extranonce = s.nextExtranonce()
+		}
+		reply := []interface{}{[]string{"mining.notify", cs.extranonce, ethereumStratumVersion}, cs.extranonce}
+		return cs.sendTCPResult(req.Id, reply)
+	case "mining.extranonce.subscribe":
+		return cs.sendTCPResult(req.Id, true)
+	case "mining.authorize":
+		if len(cs.extranonce) == 0 {
+			return cs.sendTCPError(req.Id, &ErrorReply{Code: 25, Message: "Not subscribed"})
+		}
+		if len(params) == 0 {
+			return cs.sendTCPError(req.Id, &ErrorReply{Code: -1, Message: "Invalid params"})
+		}
+		login, worker := splitLoginWorker(params[0])
+		reply, errReply := s.handleLoginRPC(cs, []string{login}, worker)
+		if errReply != nil {
+			return cs.sendTCPError(req.Id, errReply)
+		}
+		cs.worker = worker
+		err := cs.sendTCPResult(req.Id, reply)
+		if err != nil {
+			return err
+		}
+		t := s.currentBlockTemplate()
+		if t == nil || len(t.Header) == 0 || s.isSick() {
+			return nil
+		}
+		return cs.pushEthereumStratumJob(t)
+	case "mining.submit":
+		if len(params) < 3 {
+			s.policy.ApplyMalformedPolicy(cs.ip)
+			log.Printf("Malformed params from %s@%s %v", cs.login, cs.ip, params)
+			return cs.sendTCPError(req.Id, &ErrorReply{Code: -1, Message: "Invalid params"})
+		}
+		reply, errReply := s.handleEthereumStratumSubmitRPC(cs, params[1], params[2])
+		if errReply == errReplyBusy {
+			return cs.sendTCPReply(req.Id, errReply)
+		}
+		if errReply != nil {
+			return cs.sendTCPError(req.Id, errReply)
+		}
+		return cs.sendTCPResult(req.Id, reply)
+	case "eth_submitHashrate":
+		reply := s.handleSubmitHashrateRPC(cs, cs.login, cs.worker, params)
+		return cs.sendTCPResult(req.Id, reply)
+	default:
+		errReply := s.handleUnknownRPC(cs, req.Method)
+		return cs.sendTCPError(req.Id, errReply)
+	}
+}
+
+func (s *ProxyServer) handleEthereumStratumSubmitRPC(cs *Session, id, nonceSuffix string) (bool, *ErrorReply) {
+	s.stratums[cs.stratum_id].sessionsMu.RLock()
+	_, ok := s.stratums[cs.stratum_id].sessions[cs]
+	s.stratums[cs.stratum_id].sessionsMu.RUnlock()
+
+	if !ok {
+		return false, &ErrorReply{Code: 25, Message: "Not subscribed"}
+	}
+
+	nonceSuffix = strings.ToLower(strings.TrimPrefix(nonceSuffix, "0x"))
+	if !nonceSuffixPattern.MatchString(nonceSuffix) {
+		s.policy.ApplyMalformedPolicy(cs.ip)
+		log.Printf("Malformed nonce from %s@%s %v", cs.login, cs.ip, nonceSuffix)
+		return false, &ErrorReply{Code: -1, Message: "Malformed PoW result"}
+	}
+
+	t := s.currentBlockTemplate()
+	if t == nil {
+		return false, &ErrorReply{Code: 0, Message: "Work not ready"}
+	}
+	header, ok := t.headerByJobId(id)
+	if !ok {
+		log.Printf("Stale share from %v@%v, unknown job %v", cs.login, cs.ip, id)
+		s.policy.ApplySharePolicy(cs.ip, false)
+		return false, nil
+	}
+	// Mix digest is left zero, verifier recovers it from the result
+	params := []string{"0x" + cs.extranonce + nonceSuffix, header, common.Hash{}.Hex()}
+	return s.handleSubmitRPC(cs, cs.login, cs.worker, params)
+}
+
+// Sends difficulty if changed and notifies miner about new job
+func (cs *Session) pushEthereumStratumJob(t *BlockTemplate) error {
+	diff := cs.jobDiff()
+
+	cs.Lock()
+	defer cs.Unlock()
+
+	if cs.notifiedDiff != diff {
+		message := JSONRpcNotify{Method: "mining.set_difficulty", Params: []float64{float64(diff) / ethereumStratumDiff1}}
+		err := cs.enc.Encode(&message)
+		if err != nil {
+			return err
+		}
+		cs.notifiedDiff = diff
+	}
+	params := []interface{}{
+		jobId(t.Header),
+		strings.TrimPrefix(t.Seed, "0x"),
+		strings.TrimPrefix(t.Header, "0x"),
+		true,
+	}
+	message := JSONRpcNotify{Method: "mining.notify", Params: params}
+	return cs.enc.Encode(&message)
+}
+
+// EthereumStratum miners authorize as "login.worker"
+func splitLoginWorker(s string) (string, string) {
+	parts := strings.SplitN(s, ".", 2)
+	if len(parts) == 2 {
+		return parts[0], parts[1]
+	}
+	return parts[0], "0"
+}
@@ -3,8 +3,9 @@ package proxy
 import (
 	"log"
 	"regexp"
-
-	//"strings"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/sammy007/open-ethereum-pool/rpc"
 	"github.com/sammy007/open-ethereum-pool/util"
@@ -21,7 +22,7 @@ func (s *ProxyServer) handleLoginRPC(cs *Session, params []string, id string) (b
 		return false, &ErrorReply{Code: -1, Message: "Invalid params"}
 	}
 
-	login := params[0]
+	login, solo := s.splitSoloLogin(params[0])
 	if !util.IsValidBitcoinAddress(login) {
 		return false, &ErrorReply{Code: -1, Message: "Invalid login"}
 	}
@@ -29,20 +30,36 @@ func (s *ProxyServer) handleLoginRPC(cs *Session, params []string, id string) (b
 		return false, &ErrorReply{Code: -1, Message: "You are blacklisted"}
 	}
 	cs.login = login
+	cs.solo = solo || s.config.Proxy.Stratums[cs.stratum_id].Solo
 	s.registerSession(cs)
-	log.Printf("Stratum miner connected %v@%v", login, cs.ip)
+	if cs.solo {
+		log.Printf("Stratum solo miner connected %v@%v", login, cs.ip)
+	} else {
+		log.Printf("Stratum miner connected %v@%v", login, cs.ip)
+	}
 	return true, nil
 }
 
+// Strips solo suffix from login if it is enabled
+func (s *ProxyServer) splitSoloLogin(login string) (string, bool) {
+	suffix := s.config.Proxy.SoloSuffix
+	if len(suffix) > 0 && strings.HasSuffix(login, suffix) {
+		return strings.TrimSuffix(login, suffix), true
+	}
+	return login, false
+}
+
 func (s *ProxyServer) handleGetWorkRPC(cs *Session) ([]string, *ErrorReply) {
 	t := s.currentBlockTemplate()
 	if t == nil || len(t.Header) == 0 || s.isSick() {
 		return nil, &ErrorReply{Code: 0, Message: "Work not ready"}
 	}
-	diff := s.stratums[cs.stratum_id].diff
-	return []string{t.Header, t.Seed, diff}, nil
+	return []string{t.Header, t.Seed, cs.jobTarget()}, nil
 }
 
+// Share was shed, stratum session is kept so miner just goes on
+var errReplyBusy = &ErrorReply{Code: -1, Message: "Pool is busy, share dropped"}
+
 // Stratum
 func (s *ProxyServer) handleTCPSubmitRPC(cs *Session, id string, params []string) (bool, *ErrorReply) {
 	s.stratums[cs.stratum_id].sessionsMu.RLock()
@@ -71,10 +88,25 @@ func (s *ProxyServer) handleSubmitRPC(cs *Session, login, id string, params []st
 		log.Printf("Malformed PoW result from %s@%s %v", LoginID, cs.ip, params)
 		return false, &ErrorReply{Code: -1, Message: "Malformed PoW result"}
 	}
+	// Stop waits for shares in flight
+	s.sharesMu.RLock()
+	defer s.sharesMu.RUnlock()
+	if s.stopped {
+		return false, &ErrorReply{Code: -1, Message: "Pool is shutting down"}
+	}
+
 	t := s.currentBlockTemplate()
-	exist, validShare := s.processShare(login, id, cs.ip, t, params, cs.stratum_id)
+	exist, validShare, err := s.processShare(login, id, cs.ip, t, params, cs.shareDiff(), cs.solo)
+	if err != nil {
+		log.Printf("Share from %s@%s dropped: %v", LoginID, cs.ip, err)
+		return false, errReplyBusy
+	}
 	ok := s.policy.ApplySharePolicy(cs.ip, !exist && validShare)
 
+	if cs.vardiff != nil && !exist && validShare {
+		cs.vardiff.submitShare(time.Now())
+	}
+
 	if exist {
 		log.Printf("Duplicate share from %s@%s %v", LoginID, cs.ip, params)
 		return false, &ErrorReply{Code: 22, Message: "Duplicate share"}
@@ -97,6 +129,31 @@ func (s *ProxyServer) handleSubmitRPC(cs *Session, login, id string, params []st
 	return true, nil
 }
 
+func (s *ProxyServer) handleSubmitHashrateRPC(cs *Session, login, id string, params []string) bool {
+	if len(login) == 0 {
+		return false
+	}
+	if !workerPattern.MatchString(id) {
+		id = "0"
+	}
+	if len(params) != 2 || !hashPattern.MatchString(params[1]) {
+		s.policy.ApplyMalformedPolicy(cs.ip)
+		log.Printf("Malformed hashrate report from %s:%s@%s %v", login, id, cs.ip, params)
+		return false
+	}
+	hashrate, err := strconv.ParseInt(strings.TrimPrefix(params[0], "0x"), 16, 64)
+	if err != nil || hashrate < 0 {
+		s.policy.ApplyMalformedPolicy(cs.ip)
+		log.Printf("Malformed hashrate report from %s:%s@%s %v", login, id, cs.ip, params)
+		return false
+	}
+	err = s.backend.WriteReportedHashrate(login, id, hashrate, params[1], s.hashrateExpiration)
+	if err != nil {
+		log.Printf("Failed to write reported hashrate of %s:%s to backend: %v", login, id, err)
+	}
+	return true
+}
+
 func (s *ProxyServer) handleGetBlockByNumberRPC() *rpc.GetBlockReplyPart {
 	t := s.currentBlockTemplate()
 	var reply *rpc.GetBlockReplyPart
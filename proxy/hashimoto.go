@@ -0,0 +1,261 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"hash"
+	"math/big"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"golang.org/x/crypto/sha3"
+)
+
+// Ethash light evaluation, used to verify shares and to recover mix digest for protocols
+// where miner submits only a nonce (EthereumStratum/1.0.0).
+const (
+	epochLength        = 30000
+	cacheInitBytes     = 1 << 24
+	cacheGrowthBytes   = 1 << 17
+	datasetInitBytes   = 1 << 30
+	datasetGrowthBytes = 1 << 23
+	hashBytes          = 64
+	hashWords          = 16
+	mixBytes           = 128
+	datasetParents     = 256
+	cacheRounds        = 3
+	loopAccesses       = 64
+)
+
+type lightCache struct {
+	epoch   uint64
+	cache   []uint32
+	dataset uint64
+	// Closed once cache is generated
+	generated chan struct{}
+}
+
+type lightHasher struct {
+	sync.Mutex
+	caches map[uint64]*lightCache
+	order  []uint64
+	// Number of epochs kept in memory
+	size int
+}
+
+var lightHash = &lightHasher{caches: make(map[uint64]*lightCache), size: 2}
+
+// PoW is valid if result is at most 2^256 / difficulty
+var maxUint256 = new(big.Int).Lsh(big.NewInt(1), 256)
+
+// Evaluates hashimoto once and checks the result against share difficulty and, if set,
+// network difficulty. Zero mix digest is taken from the result, EthereumStratum miners
+// submit only a nonce.
+func (l *lightHasher) verify(block Block, netDiff *big.Int) verifyResult {
+	if block.difficulty == nil || block.difficulty.Sign() <= 0 {
+		return verifyResult{}
+	}
+	c := l.get(block.number / epochLength)
+	digest, result := hashimotoLight(c.dataset, c.cache, block.hashNoNonce.Bytes(), block.nonce)
+	mixDigest := common.BytesToHash(digest)
+	if block.mixDigest != (common.Hash{}) && block.mixDigest != mixDigest {
+		return verifyResult{}
+	}
+	if !meetsTarget(result, block.difficulty) {
+		return verifyResult{}
+	}
+	return verifyResult{share: true, block: meetsTarget(result, netDiff), mixDigest: mixDigest}
+}
+
+// Result is keccak of the seed and mix digest, so the submitted mix digest tells cheaply
+// whether share claims to be a block. Only hashimoto proves it.
+func claimsBlock(block Block, netDiff *big.Int) bool {
+	if block.mixDigest == (common.Hash{}) {
+		return false
+	}
+	keccak512 := sha3.NewLegacyKeccak512()
+	seed := make([]byte, 40)
+	copy(seed, block.hashNoNonce.Bytes())
+	binary.LittleEndian.PutUint64(seed[32:], block.nonce)
+	keccak512.Write(seed)
+	keccak256 := sha3.NewLegacyKeccak256()
+	keccak256.Write(keccak512.Sum(nil))
+	keccak256.Write(block.mixDigest.Bytes())
+	return meetsTarget(keccak256.Sum(nil), netDiff)
+}
+
+func meetsTarget(result []byte, diff *big.Int) bool {
+	if diff == nil || diff.Sign() <= 0 {
+		return false
+	}
+	return new(big.Int).SetBytes(result).Cmp(new(big.Int).Div(maxUint256, diff)) <= 0
+}
+
+func (l *lightHasher) setSize(size int) {
+	l.Lock()
+	l.size = size
+	l.Unlock()
+}
+
+// Cache is generated without the lock, so shares of cached epochs don't wait for it.
+// The first caller builds the epoch, later callers wait for it.
+func (l *lightHasher) get(epoch uint64) *lightCache {
+	l.Lock()
+	c, ok := l.caches[epoch]
+	if !ok {
+		c = &lightCache{epoch: epoch, dataset: datasetSize(epoch), generated: make(chan struct{})}
+		for len(l.order) > 0 && len(l.order) >= l.size {
+			delete(l.caches, l.order[0])
+			l.order = l.order[1:]
+		}
+		l.caches[epoch] = c
+		l.order = append(l.order, epoch)
+	}
+	l.Unlock()
+
+	if ok {
+		<-c.generated
+		return c
+	}
+	c.cache = generateCache(cacheSize(epoch), seedHash(epoch))
+	close(c.generated)
+	return c
+}
+
+func cacheSize(epoch uint64) uint64 {
+	size := cacheInitBytes + cacheGrowthBytes*epoch - hashBytes
+	for !new(big.Int).SetUint64(size / hashBytes).ProbablyPrime(1) {
+		size -= 2 * hashBytes
+	}
+	return size
+}
+
+func datasetSize(epoch uint64) uint64 {
+	size := datasetInitBytes + datasetGrowthBytes*epoch - mixBytes
+	for !new(big.Int).SetUint64(size / mixBytes).ProbablyPrime(1) {
+		size -= 2 * mixBytes
+	}
+	return size
+}
+
+func seedHash(epoch uint64) []byte {
+	seed := make([]byte, 32)
+	keccak256 := sha3.NewLegacyKeccak256()
+	for i := uint64(0); i < epoch; i++ {
+		keccak256.Reset()
+		keccak256.Write(seed)
+		seed = keccak256.Sum(seed[:0])
+	}
+	return seed
+}
+
+func keccak(h hash.Hash, dest, data []byte) {
+	h.Reset()
+	h.Write(data)
+	h.Sum(dest[:0])
+}
+
+func generateCache(size uint64, seed []byte) []uint32 {
+	keccak512 := sha3.NewLegacyKeccak512()
+	cache := make([]byte, size)
+	rows := int(size / hashBytes)
+
+	keccak(keccak512, cache, seed)
+	for offset := uint64(hashBytes); offset < size; offset += hashBytes {
+		keccak(keccak512, cache[offset:], cache[offset-hashBytes:offset])
+	}
+	temp := make([]byte, hashBytes)
+	for i := 0; i < cacheRounds; i++ {
+		for j := 0; j < rows; j++ {
+			srcOff := ((j - 1 + rows) % rows) * hashBytes
+			dstOff := j * hashBytes
+			xorOff := int(binary.LittleEndian.Uint32(cache[dstOff:])%uint32(rows)) * hashBytes
+			for k := 0; k < hashBytes; k++ {
+				temp[k] = cache[srcOff+k] ^ cache[xorOff+k]
+			}
+			keccak(keccak512, cache[dstOff:], temp)
+		}
+	}
+	words := make([]uint32, size/4)
+	for i := range words {
+		words[i] = binary.LittleEndian.Uint32(cache[i*4:])
+	}
+	return words
+}
+
+func fnv(a, b uint32) uint32 {
+	return a*0x01000193 ^ b
+}
+
+func fnvHash(mix []uint32, data []uint32) {
+	for i := 0; i < len(mix); i++ {
+		mix[i] = mix[i]*0x01000193 ^ data[i]
+	}
+}
+
+func generateDatasetItem(keccak512 hash.Hash, cache []uint32, index uint32) []uint32 {
+	rows := uint32(len(cache) / hashWords)
+	mix := make([]byte, hashBytes)
+
+	binary.LittleEndian.PutUint32(mix, cache[(index%rows)*hashWords]^index)
+	for i := 1; i < hashWords; i++ {
+		binary.LittleEndian.PutUint32(mix[i*4:], cache[(index%rows)*hashWords+uint32(i)])
+	}
+	keccak(keccak512, mix, mix)
+
+	intMix := make([]uint32, hashWords)
+	for i := range intMix {
+		intMix[i] = binary.LittleEndian.Uint32(mix[i*4:])
+	}
+	for i := uint32(0); i < datasetParents; i++ {
+		parent := fnv(index^i, intMix[i%16]) % rows
+		fnvHash(intMix, cache[parent*hashWords:])
+	}
+	for i, val := range intMix {
+		binary.LittleEndian.PutUint32(mix[i*4:], val)
+	}
+	keccak(keccak512, mix, mix)
+
+	for i := range intMix {
+		intMix[i] = binary.LittleEndian.Uint32(mix[i*4:])
+	}
+	return intMix
+}
+
+// Returns mix digest and PoW result
+func hashimotoLight(size uint64, cache []uint32, hash []byte, nonce uint64) ([]byte, []byte) {
+	keccak512 := sha3.NewLegacyKeccak512()
+	rows := uint32(size / mixBytes)
+
+	seed := make([]byte, 40)
+	copy(seed, hash)
+	binary.LittleEndian.PutUint64(seed[32:], nonce)
+	keccak512.Write(seed)
+	seed = keccak512.Sum(nil)
+	seedHead := binary.LittleEndian.Uint32(seed)
+
+	mix := make([]uint32, mixBytes/4)
+	for i := range mix {
+		mix[i] = binary.LittleEndian.Uint32(seed[i%16*4:])
+	}
+	temp := make([]uint32, len(mix))
+	for i := 0; i < loopAccesses; i++ {
+		parent := fnv(uint32(i)^seedHead, mix[i%len(mix)]) % rows
+		for j := uint32(0); j < mixBytes/hashBytes; j++ {
+			copy(temp[j*hashWords:], generateDatasetItem(keccak512, cache, 2*parent+j))
+		}
+		fnvHash(mix, temp)
+	}
+	for i := 0; i < len(mix); i += 4 {
+		mix[i/4] = fnv(fnv(fnv(mix[i], mix[i+1]), mix[i+2]), mix[i+3])
+	}
+	mix = mix[:len(mix)/4]
+
+	digest := make([]byte, common.HashLength)
+	for i, val := range mix {
+		binary.LittleEndian.PutUint32(digest[i*4:], val)
+	}
+	keccak256 := sha3.NewLegacyKeccak256()
+	keccak256.Write(seed)
+	keccak256.Write(digest)
+	return digest, keccak256.Sum(nil)
+}
@@ -0,0 +1,192 @@
+package proxy
+
+import (
+	"encoding/hex"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestHashimotoLight(t *testing.T) {
+	cache := generateCache(1024, make([]byte, 32))
+	hash, _ := hex.DecodeString("c9149cc0386e689d789a1c2f3d5d169a61a6218ed30e74414dc736e442ef3d1f")
+	expectedDigest := "e4073cffaef931d37117cefd9afd27ea0f1cad6a981dd2605c4a1ac97c519800"
+	expectedResult := "d3539235ee2e6f8db665c0a72169f55b7f6c605712330b778ec3944f0eb5a557"
+
+	digest, result := hashimotoLight(32*1024, cache, hash, 0)
+	if hex.EncodeToString(digest) != expectedDigest {
+		t.Errorf("Invalid mix digest: %x", digest)
+	}
+	if hex.EncodeToString(result) != expectedResult {
+		t.Errorf("Invalid result: %x", result)
+	}
+}
+
+func TestEpochSizes(t *testing.T) {
+	tests := []struct {
+		epoch   uint64
+		cache   uint64
+		dataset uint64
+		seed    string
+	}{
+		{0, 16776896, 1073739904, "0000000000000000000000000000000000000000000000000000000000000000"},
+		{1, 16907456, 1082130304, "290decd9548b62a8d60345a988386fc84ba6bc95484008f6362f93160ef3e563"},
+		{2, 17039296, 1090514816, "510e4e770828ddbf7f7b00ab00a9f6adaf81c0dc9cc85f1f8249c256942d61d9"},
+		{110, 31195072, 1996487552, "1dca8a85e74aa76301699f50d3f66d17034fceb6c458d62fb48a2248dd8790b0"},
+	}
+	for _, tt := range tests {
+		if size := cacheSize(tt.epoch); size != tt.cache {
+			t.Errorf("Invalid cache size for epoch %v: %v", tt.epoch, size)
+		}
+		if size := datasetSize(tt.epoch); size != tt.dataset {
+			t.Errorf("Invalid dataset size for epoch %v: %v", tt.epoch, size)
+		}
+		if seed := hex.EncodeToString(seedHash(tt.epoch)); seed != tt.seed {
+			t.Errorf("Invalid seed hash for epoch %v: %v", tt.epoch, seed)
+		}
+	}
+}
+
+func TestMixDigestAcrossEpochs(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Builds full epoch caches")
+	}
+	l := &lightHasher{caches: make(map[uint64]*lightCache), size: 1}
+	hash := common.HexToHash("0xc9149cc0386e689d789a1c2f3d5d169a61a6218ed30e74414dc736e442ef3d1f")
+	tests := []struct {
+		height uint64
+		digest string
+	}{
+		// Last block of epoch 0 and first blocks of epochs 1 and 2
+		{29999, "0xe7fbf2275ee88da2e0949c0f8c5548db2452e6559a14c02e05ff4d69a080b746"},
+		{30000, "0xf50db54cdcced0640cb977080b39221b1f5c51b27af74e3a698099e713351c3e"},
+		{60000, "0xa39b248d9317750c4858c24fa3bc5f227325a2f5ce6d721133fe34088232f48d"},
+	}
+	for _, tt := range tests {
+		block := Block{number: tt.height, hashNoNonce: hash, nonce: 1, difficulty: big.NewInt(1)}
+		if result := l.verify(block, nil); result.mixDigest.Hex() != tt.digest {
+			t.Errorf("Invalid mix digest at height %v: %v", tt.height, result.mixDigest.Hex())
+		}
+	}
+
+	// Mainnet block 3311058
+	block := Block{
+		number:      3311058,
+		hashNoNonce: common.HexToHash("0x543e8c0c744afd5ca511d4080dc71bc8206c9e34d991bc06462b938e37cda38c"),
+		nonce:       0xf400cd0006070c49,
+		mixDigest:   common.HexToHash("0x3e140b0784516af5e5ec6730f2fb20cca22f32be399b9e4ad77d32541f798cd0"),
+		difficulty:  big.NewInt(167925187834220),
+	}
+	if result := l.verify(block, block.difficulty); !result.share || !result.block {
+		t.Errorf("Must verify mainnet block, got %+v", result)
+	}
+	if !claimsBlock(block, block.difficulty) {
+		t.Error("Must claim mainnet block")
+	}
+}
+
+func TestLightVerify(t *testing.T) {
+	l := &lightHasher{caches: make(map[uint64]*lightCache), size: 1}
+	l.caches[0] = generatedCache(generateCache(1024, make([]byte, 32)), 32*1024)
+	l.order = []uint64{0}
+
+	hash, _ := hex.DecodeString("c9149cc0386e689d789a1c2f3d5d169a61a6218ed30e74414dc736e442ef3d1f")
+	digest, _ := hex.DecodeString("e4073cffaef931d37117cefd9afd27ea0f1cad6a981dd2605c4a1ac97c519800")
+	block := Block{hashNoNonce: common.BytesToHash(hash), mixDigest: common.BytesToHash(digest), difficulty: big.NewInt(1)}
+
+	// Result is 0xd353..., above 2^256 / 2
+	if result := l.verify(block, big.NewInt(2)); !result.share || result.block {
+		t.Errorf("Must accept share below network target, got %+v", result)
+	}
+	if result := l.verify(block, big.NewInt(1)); !result.share || !result.block {
+		t.Errorf("Must find block, got %+v", result)
+	}
+	block.difficulty = big.NewInt(2)
+	if result := l.verify(block, nil); result.share {
+		t.Error("Must reject share above its target")
+	}
+	block.difficulty = big.NewInt(1)
+	block.mixDigest = common.HexToHash("0x01")
+	if result := l.verify(block, nil); result.share {
+		t.Error("Must reject invalid mix digest")
+	}
+	// EthereumStratum share has no mix digest
+	block.mixDigest = common.Hash{}
+	if result := l.verify(block, nil); !result.share || result.mixDigest != common.BytesToHash(digest) {
+		t.Errorf("Must recover mix digest, got %+v", result)
+	}
+}
+
+func TestClaimsBlock(t *testing.T) {
+	hash, _ := hex.DecodeString("c9149cc0386e689d789a1c2f3d5d169a61a6218ed30e74414dc736e442ef3d1f")
+	digest, _ := hex.DecodeString("e4073cffaef931d37117cefd9afd27ea0f1cad6a981dd2605c4a1ac97c519800")
+	block := Block{hashNoNonce: common.BytesToHash(hash), mixDigest: common.BytesToHash(digest)}
+
+	// Result is 0xd353..., above 2^256 / 2
+	if !claimsBlock(block, big.NewInt(1)) {
+		t.Error("Must claim block below network target")
+	}
+	if claimsBlock(block, big.NewInt(2)) {
+		t.Error("Must not claim block above network target")
+	}
+	if claimsBlock(block, nil) {
+		t.Error("Must not claim block of superseded job")
+	}
+	block.mixDigest = common.Hash{}
+	if claimsBlock(block, big.NewInt(1)) {
+		t.Error("Must not claim block without mix digest")
+	}
+}
+
+func TestLightCacheGeneratedWithoutLock(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Builds full epoch cache")
+	}
+	l := &lightHasher{caches: make(map[uint64]*lightCache), size: 2}
+	cached := generatedCache([]uint32{0}, 0)
+	l.caches[0] = cached
+	l.order = []uint64{0}
+
+	done := make(chan *lightCache)
+	go func() { done <- l.get(1) }()
+	// Wait until generation of the next epoch is running
+	time.Sleep(10 * time.Millisecond)
+	start := time.Now()
+	if c := l.get(0); c != cached {
+		t.Error("Must return cached epoch")
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("Cached epoch must not wait for generation, took %v", elapsed)
+	}
+
+	// Epoch being generated is registered, so it's built once
+	l.Lock()
+	building, ok := l.caches[1]
+	l.Unlock()
+	if !ok {
+		t.Fatal("Must register epoch before generating it")
+	}
+	select {
+	case <-building.generated:
+		t.Error("Must not mark epoch generated before it is")
+	default:
+	}
+	waiting := make(chan *lightCache)
+	go func() { waiting <- l.get(1) }()
+
+	c := <-done
+	if c.epoch != 1 || len(l.order) != 2 || len(c.cache) == 0 {
+		t.Errorf("Must insert generated epoch, got %v of %v", c.epoch, l.order)
+	}
+	if w := <-waiting; w != c {
+		t.Error("Must wait for epoch being generated instead of building it again")
+	}
+}
+
+func generatedCache(cache []uint32, dataset uint64) *lightCache {
+	c := &lightCache{cache: cache, dataset: dataset, generated: make(chan struct{})}
+	close(c.generated)
+	return c
+}
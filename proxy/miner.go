@@ -6,80 +6,93 @@ import (
 	"strconv"
 	"strings"
 
-	"github.com/ethereum/ethash"
 	"github.com/ethereum/go-ethereum/common"
 )
 
-var hasher = ethash.New()
-
-func (s *ProxyServer) processShare(login, id, ip string, t *BlockTemplate, params []string, stratum_id int) (bool, bool) {
+// Share is verified on the pool of workers, block candidate check uses the same hashimoto result.
+// Solo shares are neither paid per share nor credited to the pool round.
+func (s *ProxyServer) processShare(login, id, ip string, t *BlockTemplate, params []string, shareDiff int64, solo bool) (bool, bool, error) {
 	nonceHex := params[0]
 	hashNoNonce := params[1]
 	mixDigest := params[2]
 	nonce, _ := strconv.ParseUint(strings.Replace(nonceHex, "0x", "", -1), 16, 64)
-	shareDiff := s.config.Proxy.Stratums[stratum_id].Difficulty
 
-	if !strings.EqualFold(t.Header, hashNoNonce) {
+	h, ok := t.jobHeight(hashNoNonce)
+	if !ok {
 		log.Printf("Stale share from %v@%v", login, ip)
-		return false, false
+		return false, false, nil
 	}
 
 	share := Block{
-		number:      t.Height,
+		number:      h.height,
 		hashNoNonce: common.HexToHash(hashNoNonce),
 		difficulty:  big.NewInt(shareDiff),
 		nonce:       nonce,
 		mixDigest:   common.HexToHash(mixDigest),
 	}
 
-	block := Block{
-		number:      t.Height,
-		hashNoNonce: common.HexToHash(hashNoNonce),
-		difficulty:  t.Difficulty,
-		nonce:       nonce,
-		mixDigest:   common.HexToHash(mixDigest),
+	// Job from backlog was superseded, share is credited to the round and paid per share by its own template but can't be a block
+	current := strings.EqualFold(t.Header, hashNoNonce)
+	var netDiff *big.Int
+	if current {
+		netDiff = t.Difficulty
+	}
+	result, err := s.verifier.verify(share, netDiff)
+	if err != nil {
+		return false, false, err
+	}
+	if !result.share {
+		return false, false, nil
+	}
+	// Share stored and submitted as a block carries the recovered mix digest
+	if share.mixDigest != result.mixDigest {
+		params = []string{nonceHex, hashNoNonce, result.mixDigest.Hex()}
 	}
 
-	if !hasher.Verify(share) {
-		return false, false
+	if !current {
+		if s.shares.Add(login, id, params, shareDiff, h.height, true, s.shareReward(h.diff, h.height, shareDiff, solo), solo) {
+			return true, false, nil
+		}
+		log.Printf("Stale share accepted from %v@%v at height %v", login, ip, h.height)
+		return false, true, nil
 	}
 
-	if hasher.Verify(block) {
+	if result.block {
 		n := nonce ^ 0x6675636b6d657461
 		nn := strconv.FormatUint(n, 16)
 		params_ := []string{nn, params[1], params[2]}
 
-		ok, err := s.rpc().SubmitBlock(params_)
+		accepted, rejected, err := s.submitBlock(t.Height, params_)
 		if err != nil {
 			log.Printf("Block submission failure at height %v for %v: %v", t.Height, t.Header, err)
-		} else if !ok {
+		} else if len(accepted) == 0 {
 			log.Printf("Block rejected at height %v for %v", t.Height, t.Header)
 
 			//record this unexpect reject to the backend
 			s.backend.WriteReject(t.Height)
 
-			return false, false
+			return false, false, nil
 		} else {
 			s.fetchBlockTemplate()
-			exist, err := s.backend.WriteBlock(login, id, params, shareDiff, t.Difficulty.Int64(), t.Height, s.hashrateExpiration)
+			// Buffered shares belong to the round being closed
+			s.shares.Flush()
+			exist, err := s.backend.WriteBlock(login, id, params, shareDiff, t.Difficulty.Int64(), s.shareReward(t.Difficulty, t.Height, shareDiff, solo), solo, t.Height, s.hashrateExpiration, accepted, rejected)
 			if exist {
-				return true, false
+				return true, false, nil
 			}
 			if err != nil {
 				log.Println("Failed to insert block candidate into backend:", err)
 			} else {
 				log.Printf("Inserted block %v to backend", t.Height)
 			}
-			log.Printf("Block found by miner %v@%v at height %d", login, ip, t.Height)
-		}
-	} else {
-		exist, err := s.backend.WriteShare(login, id, params, shareDiff, t.Height, s.hashrateExpiration)
-		if exist {
-			return true, false
-		}
-		if err != nil {
-			log.Println("Failed to insert share data into backend:", err)
+			if solo {
+				log.Printf("Solo block found by miner %v@%v at height %d", login, ip, t.Height)
+			} else {
+				log.Printf("Block found by miner %v@%v at height %d", login, ip, t.Height)
+			}
 		}
+	} else if s.shares.Add(login, id, params, shareDiff, t.Height, false, s.shareReward(t.Difficulty, t.Height, shareDiff, solo), solo) {
+		return true, false, nil
 	}
-	return false, true
+	return false, true, nil
 }
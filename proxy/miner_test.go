@@ -0,0 +1,25 @@
+package proxy
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/sammy007/open-ethereum-pool/payouts"
+)
+
+func TestShareRewardOfBacklogJob(t *testing.T) {
+	s := &ProxyServer{config: &Config{BlockUnlocker: payouts.UnlockerConfig{Mode: payouts.ModePPS}}}
+	current := heightDiffPair{diff: big.NewInt(3000), height: 1001}
+	superseded := heightDiffPair{diff: big.NewInt(1500), height: 1000}
+
+	// Subsidy is 3e8, share is paid by network difficulty of its own job
+	if reward := s.shareReward(current.diff, current.height, 30, false); reward != 3e6 {
+		t.Errorf("Invalid reward of current job share: %v", reward)
+	}
+	if reward := s.shareReward(superseded.diff, superseded.height, 30, false); reward != 6e6 {
+		t.Errorf("Invalid reward of superseded job share: %v", reward)
+	}
+	if reward := s.shareReward(superseded.diff, superseded.height, 30, true); reward != 0 {
+		t.Errorf("Must not pay solo share: %v", reward)
+	}
+}
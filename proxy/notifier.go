@@ -0,0 +1,227 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/sammy007/open-ethereum-pool/util"
+)
+
+const (
+	NotifyWebsocket = "websocket"
+	NotifyHTTP      = "http"
+	NotifyPoll      = "poll"
+)
+
+const (
+	minNotifyBackoff = time.Second
+	maxNotifyBackoff = time.Minute
+	// Used if source omits timeout or interval
+	defaultNotifyTimeout = 10 * time.Second
+	defaultPollInterval  = time.Second
+)
+
+// Used if no block notifiers configured, node pushes heights on this channel
+var defaultBlockNotify = BlockNotify{Name: "ws", Type: NotifyWebsocket, Url: "ws://127.0.0.1:8821/ws", Timeout: "10s"}
+
+type NotifyState struct {
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	Healthy    bool   `json:"healthy"`
+	Failures   int64  `json:"failures"`
+	Notifies   int64  `json:"notifies"`
+	LastNotify int64  `json:"lastNotify"`
+	LastError  string `json:"lastError,omitempty"`
+}
+
+type notifySource struct {
+	sync.RWMutex
+	config   BlockNotify
+	state    NotifyState
+	backoff  time.Duration
+	timeout  time.Duration
+	interval time.Duration
+}
+
+type BlockNotifier struct {
+	sources []*notifySource
+	// Carries name of the source, buffered so bursts collapse into a single refresh
+	C chan string
+}
+
+func NewBlockNotifier(cfg []BlockNotify) *BlockNotifier {
+	if len(cfg) == 0 {
+		log.Printf("No block notifiers configured, using %v", defaultBlockNotify.Url)
+		cfg = []BlockNotify{defaultBlockNotify}
+	}
+	n := &BlockNotifier{C: make(chan string, 1)}
+	for i, v := range cfg {
+		if len(v.Name) == 0 {
+			v.Name = fmt.Sprintf("%s-%d", v.Type, i)
+		}
+		switch v.Type {
+		case NotifyWebsocket, NotifyHTTP, NotifyPoll:
+		default:
+			log.Fatalf("Unknown block notifier type %v of %v", v.Type, v.Name)
+		}
+		src := &notifySource{config: v, backoff: minNotifyBackoff}
+		src.state = NotifyState{Name: v.Name, Type: v.Type}
+		src.timeout = parseNotifyDuration(v.Name, "timeout", v.Timeout, defaultNotifyTimeout)
+		src.interval = parseNotifyDuration(v.Name, "interval", v.Interval, defaultPollInterval)
+		n.sources = append(n.sources, src)
+	}
+	return n
+}
+
+// Config errors are fatal on start, not in the source goroutine
+func parseNotifyDuration(name, field, value string, def time.Duration) time.Duration {
+	if len(value) == 0 {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		log.Fatalf("Invalid %v `%v` of block notifier %v", field, value, name)
+	}
+	return d
+}
+
+func (n *BlockNotifier) Start() {
+	for _, src := range n.sources {
+		switch src.config.Type {
+		case NotifyWebsocket:
+			go n.runWebsocket(src)
+		case NotifyHTTP:
+			go n.runHTTP(src)
+		case NotifyPoll:
+			go n.runPoll(src)
+		}
+		log.Printf("Started %v block notifier %v", src.config.Type, src.config.Name)
+	}
+}
+
+func (n *BlockNotifier) States() []NotifyState {
+	result := make([]NotifyState, len(n.sources))
+	for i, src := range n.sources {
+		src.RLock()
+		result[i] = src.state
+		src.RUnlock()
+	}
+	return result
+}
+
+func (n *BlockNotifier) notify(src *notifySource) {
+	src.Lock()
+	src.state.Notifies++
+	src.state.LastNotify = util.MakeTimestamp()
+	src.Unlock()
+
+	select {
+	case n.C <- src.config.Name:
+	default:
+		// Refresh is already pending
+	}
+}
+
+func (src *notifySource) markOk() {
+	src.Lock()
+	defer src.Unlock()
+	if !src.state.Healthy {
+		log.Printf("Block notifier %v is healthy", src.config.Name)
+	}
+	src.state.Healthy = true
+	src.state.LastError = ""
+	src.backoff = minNotifyBackoff
+}
+
+// Marks source as failed and waits before reconnect, each failure in a row doubles the delay
+func (src *notifySource) markFailed(err error) {
+	src.Lock()
+	src.state.Healthy = false
+	src.state.Failures++
+	src.state.LastError = err.Error()
+	backoff := src.backoff
+	src.backoff *= 2
+	if src.backoff > maxNotifyBackoff {
+		src.backoff = maxNotifyBackoff
+	}
+	src.Unlock()
+
+	log.Printf("Block notifier %v failed, retry in %v: %v", src.config.Name, backoff, err)
+	time.Sleep(backoff)
+}
+
+// Node speaks channel protocol: two greeting messages, subscription ack and then one message per block
+func (n *BlockNotifier) runWebsocket(src *notifySource) {
+	dialer := &websocket.Dialer{HandshakeTimeout: src.timeout}
+
+	for {
+		conn, _, err := dialer.Dial(src.config.Url, nil)
+		if err != nil {
+			src.markFailed(err)
+			continue
+		}
+		err = n.readWebsocket(src, conn)
+		conn.Close()
+		src.markFailed(err)
+	}
+}
+
+func (n *BlockNotifier) readWebsocket(src *notifySource, conn *websocket.Conn) error {
+	var rpcResp map[string]interface{}
+
+	for i := 0; i < 2; i++ {
+		if err := conn.ReadJSON(&rpcResp); err != nil {
+			return err
+		}
+	}
+	topic := map[string]string{"event": "subscribe", "channel": "height"}
+	if err := conn.WriteJSON(topic); err != nil {
+		return err
+	}
+	if err := conn.ReadJSON(&rpcResp); err != nil {
+		return err
+	}
+	log.Printf("Block notifier %v subscribed: %v", src.config.Name, rpcResp)
+	src.markOk()
+
+	for {
+		if err := conn.ReadJSON(&rpcResp); err != nil {
+			return err
+		}
+		n.notify(src)
+	}
+}
+
+// Node calls this endpoint from blocknotify hook: curl -X POST http://127.0.0.1:8822/notify
+func (n *BlockNotifier) runHTTP(src *notifySource) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/notify", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		n.notify(src)
+		w.WriteHeader(http.StatusOK)
+	})
+
+	for {
+		srv := &http.Server{Addr: src.config.Listen, Handler: mux}
+		src.markOk()
+		err := srv.ListenAndServe()
+		src.markFailed(err)
+	}
+}
+
+func (n *BlockNotifier) runPoll(src *notifySource) {
+	src.markOk()
+
+	for {
+		time.Sleep(src.interval)
+		n.notify(src)
+	}
+}
@@ -0,0 +1,23 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNotifierDefaults(t *testing.T) {
+	n := NewBlockNotifier([]BlockNotify{
+		{Type: NotifyWebsocket, Url: "ws://127.0.0.1:8821/ws"},
+		{Type: NotifyPoll, Interval: "500ms"},
+		{Type: NotifyPoll},
+	})
+	if n.sources[0].timeout != defaultNotifyTimeout {
+		t.Errorf("Must use default timeout: %v", n.sources[0].timeout)
+	}
+	if n.sources[1].interval != 500*time.Millisecond {
+		t.Errorf("Must parse interval: %v", n.sources[1].interval)
+	}
+	if n.sources[2].interval != defaultPollInterval || n.sources[2].config.Name != "poll-2" {
+		t.Errorf("Must use default interval: %v", n.sources[2].interval)
+	}
+}
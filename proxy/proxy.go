@@ -1,33 +1,39 @@
 package proxy
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"log"
+	"math/big"
 	"net"
 	"net/http"
-	//"strings"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
-	//websocket --begin
-    "flag"
-    "net/url"
-	"github.com/gorilla/websocket"
-	//websocket --end
 	"github.com/gorilla/mux"
 
+	"github.com/sammy007/open-ethereum-pool/payouts"
 	"github.com/sammy007/open-ethereum-pool/policy"
 	"github.com/sammy007/open-ethereum-pool/rpc"
 	"github.com/sammy007/open-ethereum-pool/storage"
 	"github.com/sammy007/open-ethereum-pool/util"
 )
 
+// Limits time to finish HTTP requests in flight on shutdown
+const shutdownTimeout = 10 * time.Second
+
 type StratumServer struct {
 	sessionsMu sync.RWMutex
 	sessions   map[*Session]struct{}
 	timeout    time.Duration
-	diff               string
+	difficulty int64
+	vardiff    *varDiffOptions
+	listener   net.Listener
+	// Balancers allowed to send PROXY protocol header
+	trustedProxies []*net.IPNet
 }
 
 type ProxyServer struct {
@@ -35,11 +41,13 @@ type ProxyServer struct {
 	blockTemplate      atomic.Value
 	upstream           int32
 	upstreams          []*rpc.RPCClient
-	backend            *storage.RedisClient
+	backend            storage.Backend
 	//diff               string
 	policy             *policy.PolicyServer
 	hashrateExpiration time.Duration
 	failsCount         int64
+	// Average tx fees per block expected by FPPS, refreshed with node state
+	txFees int64
 
 	/*
 	// Stratum
@@ -49,7 +57,20 @@ type ProxyServer struct {
 	*/
 
 	// Stratums
-	stratums []*StratumServer
+	stratums   []*StratumServer
+	extranonce uint32
+
+	notifier *BlockNotifier
+	verifier *verifyPool
+	epochs   *epochWatcher
+	shares   *storage.ShareWriter
+
+	listenersMu sync.Mutex
+	httpServer  *http.Server
+	stopping    bool
+
+	sharesMu sync.RWMutex
+	stopped  bool
 }
 
 type Session struct {
@@ -59,81 +80,44 @@ type Session struct {
 	ip  string
 	enc *json.Encoder
 
+	// Fixed share difficulty, vardiff overrides it if enabled on stratum
+	diff    int64
+	vardiff *varDiff
+
 	// Stratum
 	sync.Mutex
-	conn  *net.TCPConn
-	login string
+	conn     net.Conn
+	login    string
+	protocol string
+	// Shares go to the round of the login, blocks found are not shared
+	solo bool
+
+	// EthereumStratum
+	extranonce   string
+	worker       string
+	notifiedDiff int64
 }
 
 
-// -- websocket support
-func SubscribeBlockUpdate(websocket_rul string, on_notify func()) error {
-	go func() {
-		var addr = flag.String("addr", websocket_rul, "http service address")
-		u := url.URL{Scheme: "ws", Host: *addr, Path: "/ws"}
-		var dialer *websocket.Dialer
-
-		var rpcResp map[string]interface{}
-		for {
-			conn, _, err := dialer.Dial(u.String(), nil)
-			if err != nil {
-				log.Printf("Websocket Dial failed: %v", err)
-				continue
-			}
-			for i := 0; i < 2; i++ {
-				err := conn.ReadJSON(&rpcResp)
-				if err != nil {
-					log.Printf("Websocket ReadJSON failed: %v", err)
-					continue
-				}
-				
-				log.Printf("Websocket Dial Ack: %v", rpcResp)
-			}
-
-			log.Printf("Websocket Dial OK")
-
-			var topic = map[string] string {"event": "subscribe", "channel": "height"}
-			err = conn.WriteJSON(topic)
-			if err != nil {
-				log.Printf("Websocket WriteJSON failed: %v", err)
-				continue
-			}
-			err = conn.ReadJSON(&rpcResp)
-			if err != nil {
-				log.Printf("Websocket ReadJSON failed: %v", err)
-				continue
-			}
-
-			log.Printf("Websocket subscribe topic OK: %v", rpcResp)
-
-			for {
-				err = conn.ReadJSON(&rpcResp)
-				if err != nil {
-					log.Printf("Websocket ReadJSON failed: %v", err)
-					break
-				}
-				//log.Printf("Websocket ReadJSON : %v", rpcResp)
-				on_notify()
-			}
-			//5 seconds latency for auto recover
-			time.Sleep(5 * time.Second)
-		}
-	}()
-
-	return nil
-}
-
-func NewProxy(cfg *Config, backend *storage.RedisClient) *ProxyServer {
+func NewProxy(cfg *Config, backend storage.Backend) *ProxyServer {
 	if len(cfg.Name) == 0 {
 		log.Fatal("You must set instance name")
 	}
 	policy := policy.Start(&cfg.Proxy.Policy, backend)
 
 	proxy := &ProxyServer{config: cfg, backend: backend, policy: policy}
+	proxy.verifier = newVerifyPool(&cfg.Proxy.Verify)
+	log.Printf("Verifying shares on %v workers, queue size %v", proxy.verifier.workers, cap(proxy.verifier.jobs))
+	proxy.hashrateExpiration = util.MustParseDuration(cfg.Proxy.HashrateExpiration)
+	proxy.shares = storage.NewShareWriter(&cfg.Proxy.ShareWriter, backend, proxy.hashrateExpiration)
+	proxy.shares.Start()
 	//proxy.diff = util.GetTargetHex(cfg.Proxy.Difficulty)
 
 	proxy.upstreams = make([]*rpc.RPCClient, len(cfg.Upstream))
 	for i, v := range cfg.Upstream {
+		if err := checkUpstreamName(v.Name); err != nil {
+			log.Fatal(err)
+		}
 		proxy.upstreams[i] = rpc.NewRPCClient(v.Name, v.Url, cfg.Account, cfg.Password, v.Timeout)
 		log.Printf("Upstream: %s => %s", v.Name, v.Url)
 	}
@@ -141,16 +125,30 @@ func NewProxy(cfg *Config, backend *storage.RedisClient) *ProxyServer {
 	proxy.stratums = make([]*StratumServer, len(cfg.Proxy.Stratums))
 	log.Printf("Total StratumServer count: %d", len(cfg.Proxy.Stratums))
 	for i, st := range cfg.Proxy.Stratums {
-		stratumserver := StratumServer{sessions: make(map[*Session]struct{}), diff: util.GetTargetHex(st.Difficulty)}
+		if !isValidProtocol(st.Protocol) {
+			log.Fatalf("Unknown protocol %v of stratum %v", st.Protocol, st.Listen)
+		}
+		stratumserver := StratumServer{
+			sessions:   make(map[*Session]struct{}),
+			difficulty: st.Difficulty,
+			vardiff:    newVarDiffOptions(&cfg.Proxy.Stratums[i].VarDiff, st.Difficulty),
+		}
+		if st.ProxyProtocol {
+			trusted, err := parseTrustedProxies(st.TrustedProxies)
+			if err != nil || len(trusted) == 0 {
+				log.Fatalf("Invalid trusted proxies %v of stratum %v: %v", st.TrustedProxies, st.Listen, err)
+			}
+			stratumserver.trustedProxies = trusted
+		}
 		proxy.stratums[i] = &stratumserver
 		if st.Enabled {
 			go proxy.ListenTCP(i)
 		}
 	}
 
-	proxy.fetchBlockTemplate()
+	proxy.epochs = newEpochWatcher(&cfg.Proxy.Ethash)
 
-	proxy.hashrateExpiration = util.MustParseDuration(cfg.Proxy.HashrateExpiration)
+	proxy.fetchBlockTemplate()
 
 	refreshIntv := util.MustParseDuration(cfg.Proxy.BlockRefreshInterval)
 	refreshTimer := time.NewTimer(refreshIntv)
@@ -162,27 +160,23 @@ func NewProxy(cfg *Config, backend *storage.RedisClient) *ProxyServer {
 	stateUpdateIntv := util.MustParseDuration(cfg.Proxy.StateUpdateInterval)
 	stateUpdateTimer := time.NewTimer(stateUpdateIntv)
 
+	proxy.notifier = NewBlockNotifier(cfg.Proxy.BlockNotify)
+	proxy.notifier.Start()
+
 	go func() {
 		for {
 			select {
 			case <-refreshTimer.C:
 				proxy.fetchBlockTemplate()
 				refreshTimer.Reset(refreshIntv)
+			case source := <-proxy.notifier.C:
+				log.Printf("New block notification from %v", source)
+				proxy.fetchBlockTemplate()
+				refreshTimer.Reset(refreshIntv)
 			}
 		}
 	}()
 
-	new_block_notify := func() {
-		log.Printf("Websocket notify new block!")
-		proxy.fetchBlockTemplate()
-		refreshTimer.Reset(refreshIntv)
-	}
-	
-	err := SubscribeBlockUpdate("127.0.0.1:8821", new_block_notify)
-	if err != nil {
-		log.Printf("Failed SubscribeBlockUpdate: %v", err)
-	}
-
 	go func() {
 		for {
 			select {
@@ -200,6 +194,21 @@ func NewProxy(cfg *Config, backend *storage.RedisClient) *ProxyServer {
 				t := proxy.currentBlockTemplate()
 				if t != nil {
 					err := backend.WriteNodeState(cfg.Name, t.Height, t.Difficulty)
+					if err == nil {
+						err = backend.WriteNodeDetails(cfg.Name, "notifiers", proxy.notifier.States())
+					}
+					if err == nil {
+						err = backend.WriteNodeDetails(cfg.Name, "upstreams", proxy.upstreamStates())
+					}
+					if err == nil {
+						err = backend.WriteNodeDetails(cfg.Name, "verify", proxy.verifier.state())
+					}
+					if err == nil {
+						err = backend.WriteNodeDetails(cfg.Name, "ethash", proxy.epochs.state())
+					}
+					if err == nil && cfg.BlockUnlocker.Mode == payouts.ModeFPPS {
+						err = proxy.refreshTxFees()
+					}
 					if err != nil {
 						log.Printf("Failed to write node state to backend: %v", err)
 						proxy.markSick()
@@ -215,6 +224,23 @@ func NewProxy(cfg *Config, backend *storage.RedisClient) *ProxyServer {
 	return proxy
 }
 
+func (s *ProxyServer) refreshTxFees() error {
+	fees, err := s.backend.GetAverageTxFees()
+	if err == nil {
+		atomic.StoreInt64(&s.txFees, fees)
+	}
+	return err
+}
+
+// PPS credit of a valid share found on a job of given network difficulty and height,
+// solo miners are paid by their blocks only
+func (s *ProxyServer) shareReward(netDiff *big.Int, height uint64, shareDiff int64, solo bool) int64 {
+	if solo || netDiff == nil {
+		return 0
+	}
+	return s.config.BlockUnlocker.ShareReward(shareDiff, netDiff.Int64(), int64(height), atomic.LoadInt64(&s.txFees))
+}
+
 func (s *ProxyServer) Start() {
 	log.Printf("Starting proxy on %v", s.config.Proxy.Listen)
 	r := mux.NewRouter()
@@ -226,32 +252,175 @@ func (s *ProxyServer) Start() {
 		Handler:        r,
 		MaxHeaderBytes: s.config.Proxy.LimitHeadersSize,
 	}
+	s.listenersMu.Lock()
+	if s.stopping {
+		s.listenersMu.Unlock()
+		return
+	}
+	s.httpServer = srv
+	s.listenersMu.Unlock()
+
 	err := srv.ListenAndServe()
-	if err != nil {
+	if err != nil && err != http.ErrServerClosed {
 		log.Fatalf("Failed to start proxy: %v", err)
 	}
 }
 
+// Stops accepting miners, waits for shares in flight and closes stratum sessions
+func (s *ProxyServer) Stop() {
+	log.Println("Stopping proxy")
+
+	s.listenersMu.Lock()
+	s.stopping = true
+	for _, st := range s.stratums {
+		if st.listener != nil {
+			st.listener.Close()
+		}
+	}
+	srv := s.httpServer
+	s.listenersMu.Unlock()
+
+	if srv != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		err := srv.Shutdown(ctx)
+		cancel()
+		if err != nil {
+			log.Printf("Failed to shutdown HTTP proxy gracefully: %v", err)
+		}
+	}
+
+	s.sharesMu.Lock()
+	s.stopped = true
+	s.sharesMu.Unlock()
+	s.shares.Stop()
+
+	for _, st := range s.stratums {
+		st.sessionsMu.RLock()
+		for cs := range st.sessions {
+			cs.conn.Close()
+		}
+		st.sessionsMu.RUnlock()
+	}
+	log.Println("Proxy stopped")
+}
+
 func (s *ProxyServer) rpc() *rpc.RPCClient {
 	i := atomic.LoadInt32(&s.upstream)
 	return s.upstreams[i]
 }
 
 func (s *ProxyServer) checkUpstreams() {
-	candidate := int32(0)
-	backup := false
+	var wg sync.WaitGroup
+	for _, v := range s.upstreams {
+		wg.Add(1)
+		go func(r *rpc.RPCClient) {
+			defer wg.Done()
+			r.Check()
+		}(v)
+	}
+	wg.Wait()
+
+	states := s.upstreamStates()
+	current := int(atomic.LoadInt32(&s.upstream))
+	candidate := selectUpstream(states, current, &s.config.UpstreamSelection)
 
+	if current != candidate {
+		log.Printf("Switching to %v upstream at height %v, latency %vms", states[candidate].Name, states[candidate].Height, states[candidate].Latency)
+		atomic.StoreInt32(&s.upstream, int32(candidate))
+	}
+}
+
+func (s *ProxyServer) upstreamStates() []rpc.UpstreamState {
+	states := make([]rpc.UpstreamState, len(s.upstreams))
 	for i, v := range s.upstreams {
-		if v.Check() && !backup {
-			candidate = int32(i)
-			backup = true
+		states[i] = v.State()
+	}
+	return states
+}
+
+// Names of upstreams which accepted and rejected a block are stored with its candidate
+// as ","-separated lists inside a ":"-separated member
+func checkUpstreamName(name string) error {
+	if len(name) == 0 || strings.ContainsAny(name, ":,") {
+		return fmt.Errorf("Invalid upstream name %q, it must be set and must not contain ':' or ','", name)
+	}
+	return nil
+}
+
+// Picks healthy upstream close to the best known height with the lowest score.
+// Falls back to the first upstream if none is eligible.
+func selectUpstream(states []rpc.UpstreamState, current int, cfg *UpstreamSelection) int {
+	var bestHeight int64
+	for _, v := range states {
+		if v.Healthy && v.Height > bestHeight {
+			bestHeight = v.Height
+		}
+	}
+	score := func(v rpc.UpstreamState) float64 {
+		return cfg.HeightWeight*float64(bestHeight-v.Height) + cfg.LatencyWeight*float64(v.Latency)
+	}
+	eligible := func(v rpc.UpstreamState) bool {
+		return v.Healthy && bestHeight-v.Height <= cfg.MaxHeightLag
+	}
+
+	candidate := -1
+	for i, v := range states {
+		if eligible(v) && (candidate < 0 || score(v) < score(states[candidate])) {
+			candidate = i
+		}
+	}
+	if candidate < 0 {
+		return 0
+	}
+	if candidate != current && current < len(states) && eligible(states[current]) &&
+		score(states[current])-score(states[candidate]) < cfg.Hysteresis {
+		return current
+	}
+	return candidate
+}
+
+type submitResult struct {
+	name string
+	ok   bool
+	err  error
+}
+
+// Submits block to every healthy upstream concurrently, active one is always tried.
+// Block is accepted if any upstream accepts it, error is returned only if none replied.
+func (s *ProxyServer) submitBlock(height uint64, params []string) ([]string, []string, error) {
+	active := s.rpc()
+	results := make(chan submitResult, len(s.upstreams))
+	n := 0
+	for _, v := range s.upstreams {
+		if v != active && v.Sick() {
+			continue
 		}
+		n++
+		go func(r *rpc.RPCClient) {
+			ok, err := r.SubmitBlock(params)
+			results <- submitResult{name: r.Name, ok: ok, err: err}
+		}(v)
 	}
 
-	if s.upstream != candidate {
-		log.Printf("Switching to %v upstream", s.upstreams[candidate].Name)
-		atomic.StoreInt32(&s.upstream, candidate)
+	var accepted, rejected []string
+	var err error
+	for i := 0; i < n; i++ {
+		res := <-results
+		if res.err != nil {
+			log.Printf("Block submission to %v failed at height %v: %v", res.name, height, res.err)
+			err = res.err
+		} else if res.ok {
+			log.Printf("Block accepted by %v at height %v", res.name, height)
+			accepted = append(accepted, res.name)
+		} else {
+			log.Printf("Block rejected by %v at height %v", res.name, height)
+			rejected = append(rejected, res.name)
+		}
 	}
+	if len(accepted) > 0 || len(rejected) > 0 {
+		return accepted, rejected, nil
+	}
+	return nil, nil, err
 }
 
 func (s *ProxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -287,7 +456,7 @@ func (s *ProxyServer) handleClient(w http.ResponseWriter, r *http.Request, ip st
 	defer r.Body.Close()
 
 	// use the first stratum diffculty as the proxy diffculty
-	cs := &Session{stratum_id: 0, ip: ip, enc: json.NewEncoder(w)}
+	cs := &Session{stratum_id: 0, ip: ip, enc: json.NewEncoder(w), diff: s.stratums[0].difficulty}
 	dec := json.NewDecoder(r.Body)
 	for {
 		var req JSONRpcReq
@@ -352,7 +521,12 @@ func (cs *Session) handleMessage(s *ProxyServer, r *http.Request, req *JSONRpcRe
 		reply := s.handleGetBlockByNumberRPC()
 		cs.sendResult(req.Id, reply)
 	case "eth_submitHashrate":
-		cs.sendResult(req.Id, true)
+		var params []string
+		if req.Params != nil {
+			json.Unmarshal(*req.Params, &params)
+		}
+		reply := s.handleSubmitHashrateRPC(cs, login, vars["id"], params)
+		cs.sendResult(req.Id, reply)
 	default:
 		errReply := s.handleUnknownRPC(cs, req.Method)
 		cs.sendError(req.Id, errReply)
@@ -369,6 +543,31 @@ func (cs *Session) sendError(id *json.RawMessage, reply *ErrorReply) error {
 	return cs.enc.Encode(&message)
 }
 
+// Returns difficulty the next share of the session must meet
+func (cs *Session) shareDiff() int64 {
+	if cs.vardiff != nil {
+		return cs.vardiff.current(time.Now())
+	}
+	return cs.diff
+}
+
+// Returns share difficulty for a job which is about to be sent to the session
+func (cs *Session) jobDiff() int64 {
+	if cs.vardiff == nil {
+		return cs.diff
+	}
+	diff, changed := cs.vardiff.apply(time.Now())
+	if changed {
+		log.Printf("Retargeted difficulty for %v@%v to %v", cs.login, cs.ip, diff)
+	}
+	return diff
+}
+
+// Returns share target for a job which is about to be sent to the session
+func (cs *Session) jobTarget() string {
+	return util.GetTargetHex(cs.jobDiff())
+}
+
 func (s *ProxyServer) writeError(w http.ResponseWriter, status int, msg string) {
 	w.WriteHeader(status)
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
@@ -0,0 +1,160 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// HAProxy PROXY protocol, see https://www.haproxy.org/download/1.8/doc/proxy-protocol.txt
+const maxProxyV1Length = 107
+
+var proxyV1Prefix = []byte("PROXY ")
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+func parseTrustedProxies(cidrs []string) ([]*net.IPNet, error) {
+	var result []*net.IPNet
+	for _, v := range cidrs {
+		if !strings.Contains(v, "/") {
+			if strings.Contains(v, ":") {
+				v += "/128"
+			} else {
+				v += "/32"
+			}
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, n)
+	}
+	return result, nil
+}
+
+func isTrustedProxy(trusted []*net.IPNet, ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, n := range trusted {
+		if n.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Client address is sent by trusted balancer in PROXY header, other peers and headers
+// without an address are served by connection endpoint. Returns endpoint address on error.
+func clientAddr(conn net.Conn, trusted []*net.IPNet, timeout time.Duration) (string, error) {
+	ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	if trusted == nil || !isTrustedProxy(trusted, ip) {
+		return ip, nil
+	}
+	clientIp, err := readProxyHeader(conn, timeout)
+	if err != nil {
+		return ip, err
+	}
+	if len(clientIp) == 0 {
+		return ip, nil
+	}
+	return clientIp, nil
+}
+
+// Reads PROXY protocol v1 or v2 header which must precede any other data.
+// Returns source address of the client or empty string if header carries none
+// (v1 UNKNOWN, v2 LOCAL, unsupported family), connection endpoints are used then.
+func readProxyHeader(conn net.Conn, timeout time.Duration) (string, error) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+
+	prefix := make([]byte, len(proxyV1Prefix))
+	if _, err := io.ReadFull(conn, prefix); err != nil {
+		return "", err
+	}
+	if bytes.Equal(prefix, proxyV1Prefix) {
+		return readProxyV1(conn)
+	}
+	if bytes.Equal(prefix, proxyV2Signature[:len(prefix)]) {
+		return readProxyV2(conn)
+	}
+	return "", errors.New("Missing PROXY protocol header")
+}
+
+// "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n", prefix is consumed already
+func readProxyV1(conn net.Conn) (string, error) {
+	line := make([]byte, 0, maxProxyV1Length)
+	b := make([]byte, 1)
+	for {
+		if _, err := conn.Read(b); err != nil {
+			return "", err
+		}
+		line = append(line, b[0])
+		if b[0] == '\n' {
+			break
+		}
+		if len(line)+len(proxyV1Prefix) >= maxProxyV1Length {
+			return "", errors.New("PROXY v1 header is too long")
+		}
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) == 0 {
+		return "", errors.New("Malformed PROXY v1 header")
+	}
+	switch fields[0] {
+	case "UNKNOWN":
+		return "", nil
+	case "TCP4", "TCP6":
+		if len(fields) != 5 || net.ParseIP(fields[1]) == nil {
+			return "", fmt.Errorf("Malformed PROXY v1 header: %q", line)
+		}
+		return net.ParseIP(fields[1]).String(), nil
+	}
+	return "", fmt.Errorf("Unsupported PROXY v1 protocol %v", fields[0])
+}
+
+func readProxyV2(conn net.Conn) (string, error) {
+	// Rest of the signature, version and command, family, length of addresses
+	header := make([]byte, len(proxyV2Signature)-len(proxyV1Prefix)+4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	sigRest := len(proxyV2Signature) - len(proxyV1Prefix)
+	if !bytes.Equal(header[:sigRest], proxyV2Signature[len(proxyV1Prefix):]) {
+		return "", errors.New("Malformed PROXY v2 signature")
+	}
+	verCmd, family := header[sigRest], header[sigRest+1]
+	length := binary.BigEndian.Uint16(header[sigRest+2:])
+	if verCmd>>4 != 2 {
+		return "", fmt.Errorf("Unsupported PROXY protocol version %v", verCmd>>4)
+	}
+	addrs := make([]byte, length)
+	if _, err := io.ReadFull(conn, addrs); err != nil {
+		return "", err
+	}
+	// LOCAL command is used by balancer itself
+	if verCmd&0xf == 0 {
+		return "", nil
+	}
+	if verCmd&0xf != 1 {
+		return "", fmt.Errorf("Unsupported PROXY v2 command %v", verCmd&0xf)
+	}
+	switch family >> 4 {
+	case 1:
+		if len(addrs) < 12 {
+			return "", errors.New("Malformed PROXY v2 IPv4 addresses")
+		}
+		return net.IP(addrs[:4]).String(), nil
+	case 2:
+		if len(addrs) < 36 {
+			return "", errors.New("Malformed PROXY v2 IPv6 addresses")
+		}
+		return net.IP(addrs[:16]).String(), nil
+	}
+	// Unix sockets and unspecified family carry no usable address
+	return "", nil
+}
@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func readHeaderFrom(data []byte, tail string) (string, string, error) {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		client.Write(data)
+		client.Write([]byte(tail))
+		client.Close()
+	}()
+	ip, err := readProxyHeader(server, time.Second)
+	rest := make([]byte, len(tail))
+	n, _ := server.Read(rest)
+	return ip, string(rest[:n]), err
+}
+
+func TestProxyV1(t *testing.T) {
+	ip, rest, err := readHeaderFrom([]byte("PROXY TCP4 192.168.0.1 10.0.0.1 56324 8008\r\n"), "{")
+	if err != nil || ip != "192.168.0.1" {
+		t.Errorf("Must parse v1 source address, got %v: %v", ip, err)
+	}
+	if rest != "{" {
+		t.Errorf("Must not consume data after header, got %q", rest)
+	}
+	ip, _, err = readHeaderFrom([]byte("PROXY UNKNOWN\r\n"), "{")
+	if err != nil || ip != "" {
+		t.Errorf("Must accept v1 UNKNOWN header, got %v: %v", ip, err)
+	}
+}
+
+func TestProxyV2(t *testing.T) {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x21, 0x11, 0, 12)
+	header = append(header, 203, 0, 113, 7, 10, 0, 0, 1)
+	ports := make([]byte, 4)
+	binary.BigEndian.PutUint16(ports, 56324)
+	binary.BigEndian.PutUint16(ports[2:], 8008)
+	header = append(header, ports...)
+
+	ip, rest, err := readHeaderFrom(header, "{")
+	if err != nil || ip != "203.0.113.7" {
+		t.Errorf("Must parse v2 source address, got %v: %v", ip, err)
+	}
+	if rest != "{" {
+		t.Errorf("Must not consume data after header, got %q", rest)
+	}
+}
+
+func TestProxyV2Local(t *testing.T) {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x20, 0x00, 0, 0)
+	ip, rest, err := readHeaderFrom(header, "{")
+	if err != nil || ip != "" || rest != "{" {
+		t.Errorf("Must accept v2 LOCAL header without address, got %v %q: %v", ip, rest, err)
+	}
+
+	// Unix socket addresses
+	header = append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x21, 0x31, 0, 216)
+	header = append(header, make([]byte, 216)...)
+	ip, rest, err = readHeaderFrom(header, "{")
+	if err != nil || ip != "" || rest != "{" {
+		t.Errorf("Must accept unsupported family without address, got %v %q: %v", ip, rest, err)
+	}
+}
+
+func TestClientAddrFallback(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	trusted, _ := parseTrustedProxies([]string{"127.0.0.1"})
+
+	headers := []string{"PROXY TCP4 192.168.0.1 10.0.0.1 56324 8008\r\n", "PROXY UNKNOWN\r\n"}
+	expected := []string{"192.168.0.1", "127.0.0.1"}
+	for i, header := range headers {
+		go func(header string) {
+			client, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				return
+			}
+			defer client.Close()
+			client.Write([]byte(header + "{"))
+			client.Read(make([]byte, 1))
+		}(header)
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ip, err := clientAddr(conn, trusted, time.Second)
+		if err != nil || ip != expected[i] {
+			t.Errorf("Must serve %q from %v, got %v: %v", header, expected[i], ip, err)
+		}
+		rest := make([]byte, 1)
+		if _, err := io.ReadFull(conn, rest); err != nil || string(rest) != "{" {
+			t.Errorf("Must keep serving connection after %q, got %q: %v", header, rest, err)
+		}
+		conn.Close()
+	}
+}
+
+func TestProxyHeaderMissing(t *testing.T) {
+	_, _, err := readHeaderFrom([]byte(`{"id":1,"method":"eth_submitLogin"}`), "")
+	if err == nil {
+		t.Error("Must reject connection without PROXY header")
+	}
+}
+
+func TestTrustedProxies(t *testing.T) {
+	trusted, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isTrustedProxy(trusted, "10.1.2.3") || !isTrustedProxy(trusted, "192.168.1.5") {
+		t.Error("Must trust configured sources")
+	}
+	if isTrustedProxy(trusted, "192.168.1.6") {
+		t.Error("Must not trust other sources")
+	}
+}
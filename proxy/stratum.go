@@ -2,9 +2,13 @@ package proxy
 
 import (
 	"bufio"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"time"
@@ -20,6 +24,11 @@ func (s *ProxyServer) ListenTCP(stratum_id int) {
 	timeout := util.MustParseDuration(s.config.Proxy.Stratums[stratum_id].Timeout)
 	s.stratums[stratum_id].timeout = timeout
 
+	tlsConfig, err := loadTLSConfig(&s.config.Proxy.Stratums[stratum_id])
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+
 	addr, err := net.ResolveTCPAddr("tcp", s.config.Proxy.Stratums[stratum_id].Listen)
 	if err != nil {
 		log.Fatalf("Error: %v", err)
@@ -30,38 +39,82 @@ func (s *ProxyServer) ListenTCP(stratum_id int) {
 	}
 	defer server.Close()
 
+	s.listenersMu.Lock()
+	if s.stopping {
+		s.listenersMu.Unlock()
+		return
+	}
+	s.stratums[stratum_id].listener = server
+	s.listenersMu.Unlock()
+
 	log.Printf("Stratum[%d] of Difficulty[%d] listening on %s", stratum_id, s.config.Proxy.Stratums[stratum_id].Difficulty, s.config.Proxy.Stratums[stratum_id].Listen)
+	if tlsConfig != nil {
+		log.Printf("Stratum[%d] serves TLS, client certificates required: %v", stratum_id, tlsConfig.ClientCAs != nil)
+	}
+	if trusted := s.stratums[stratum_id].trustedProxies; trusted != nil {
+		log.Printf("Stratum[%d] accepts PROXY protocol from %v", stratum_id, s.config.Proxy.Stratums[stratum_id].TrustedProxies)
+	}
+	if opts := s.stratums[stratum_id].vardiff; opts != nil {
+		log.Printf("Stratum[%d] vardiff enabled: %v..%v, target %v per share", stratum_id, opts.minDiff, opts.maxDiff, opts.targetTime)
+	}
 	var accept = make(chan int, s.config.Proxy.Stratums[stratum_id].MaxConn)
 	n := 0
 
 	for {
-		conn, err := server.AcceptTCP()
+		tcpConn, err := server.AcceptTCP()
 		if err != nil {
+			if s.isStopping() {
+				log.Printf("Stratum[%d] stopped accepting connections", stratum_id)
+				return
+			}
 			continue
 		}
-		conn.SetKeepAlive(true)
-
-		ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
-
-		if s.policy.IsBanned(ip) || !s.policy.ApplyLimitPolicy(ip) {
-			conn.Close()
-			continue
-		}
+		tcpConn.SetKeepAlive(true)
 		n += 1
-		cs := &Session{stratum_id: stratum_id, conn: conn, ip: ip}
 
 		accept <- n
-		go func(cs *Session) {
-			err = s.handleTCPClient(cs)
-			if err != nil {
-				s.removeSession(cs)
-				conn.Close()
-			}
+		go func(tcpConn *net.TCPConn) {
+			s.serveTCP(stratum_id, tcpConn, tlsConfig)
 			<-accept
-		}(cs)
+		}(tcpConn)
+	}
+}
+
+func (s *ProxyServer) serveTCP(stratum_id int, tcpConn *net.TCPConn, tlsConfig *tls.Config) {
+	ip, err := clientAddr(tcpConn, s.stratums[stratum_id].trustedProxies, s.stratums[stratum_id].timeout)
+	if err != nil {
+		log.Printf("Failed to read PROXY header from %v: %v", ip, err)
+		tcpConn.Close()
+		return
+	}
+
+	if s.policy.IsBanned(ip) || !s.policy.ApplyLimitPolicy(ip) {
+		tcpConn.Close()
+		return
+	}
+	// Handshake is performed on first read, so it is limited by session deadline
+	var conn net.Conn = tcpConn
+	if tlsConfig != nil {
+		conn = tls.Server(tcpConn, tlsConfig)
+	}
+	cs := &Session{stratum_id: stratum_id, conn: conn, ip: ip, diff: s.stratums[stratum_id].difficulty}
+	if opts := s.stratums[stratum_id].vardiff; opts != nil {
+		cs.vardiff = newVarDiff(opts, cs.diff)
+	}
+
+	err = s.handleTCPClient(cs)
+	if err != nil {
+		s.removeSession(cs)
+		cs.conn.Close()
 	}
 }
 
+func (s *ProxyServer) isStopping() bool {
+	s.listenersMu.Lock()
+	defer s.listenersMu.Unlock()
+	return s.stopping
+}
+
 func (s *ProxyServer) handleTCPClient(cs *Session) error {
 	cs.enc = json.NewEncoder(cs.conn)
 	connbuff := bufio.NewReaderSize(cs.conn, MaxReqSize)
@@ -91,7 +144,14 @@ func (s *ProxyServer) handleTCPClient(cs *Session) error {
 				return err
 			}
 			s.setDeadline(cs.conn, cs.stratum_id)
-			err = cs.handleTCPMessage(s, &req)
+			if len(cs.protocol) == 0 {
+				cs.protocol = s.detectProtocol(cs.stratum_id, req.Method)
+			}
+			if cs.protocol == ProtocolEthereumStratum {
+				err = cs.handleEthereumStratumMessage(s, &req)
+			} else {
+				err = cs.handleTCPMessage(s, &req)
+			}
 			if err != nil {
 				return err
 			}
@@ -129,12 +189,20 @@ func (cs *Session) handleTCPMessage(s *ProxyServer, req *StratumReq) error {
 			return err
 		}
 		reply, errReply := s.handleTCPSubmitRPC(cs, req.Worker, params)
+		if errReply == errReplyBusy {
+			return cs.sendTCPReply(req.Id, errReply)
+		}
 		if errReply != nil {
 			return cs.sendTCPError(req.Id, errReply)
 		}
 		return cs.sendTCPResult(req.Id, &reply)
 	case "eth_submitHashrate":
-		return cs.sendTCPResult(req.Id, true)
+		var params []string
+		if req.Params != nil {
+			json.Unmarshal(*req.Params, &params)
+		}
+		reply := s.handleSubmitHashrateRPC(cs, cs.login, req.Worker, params)
+		return cs.sendTCPResult(req.Id, reply)
 	default:
 		errReply := s.handleUnknownRPC(cs, req.Method)
 		return cs.sendTCPError(req.Id, errReply)
@@ -149,6 +217,14 @@ func (cs *Session) sendTCPResult(id *json.RawMessage, result interface{}) error
 	return cs.enc.Encode(&message)
 }
 
+func (cs *Session) pushJob(t *BlockTemplate) error {
+	if cs.protocol == ProtocolEthereumStratum {
+		return cs.pushEthereumStratumJob(t)
+	}
+	reply := []string{t.Header, t.Seed, cs.jobTarget()}
+	return cs.pushNewJob(&reply)
+}
+
 func (cs *Session) pushNewJob(result interface{}) error {
 	cs.Lock()
 	defer cs.Unlock()
@@ -157,19 +233,52 @@ func (cs *Session) pushNewJob(result interface{}) error {
 	return cs.enc.Encode(&message)
 }
 
+// Replies with error and closes the session
 func (cs *Session) sendTCPError(id *json.RawMessage, reply *ErrorReply) error {
+	err := cs.sendTCPReply(id, reply)
+	if err != nil {
+		return err
+	}
+	return errors.New(reply.Message)
+}
+
+// Replies with error and keeps the session
+func (cs *Session) sendTCPReply(id *json.RawMessage, reply *ErrorReply) error {
 	cs.Lock()
 	defer cs.Unlock()
 
 	message := JSONRpcResp{Id: id, Version: "2.0", Error: reply}
-	err := cs.enc.Encode(&message)
+	return cs.enc.Encode(&message)
+}
+
+func loadTLSConfig(cfg *Stratum) (*tls.Config, error) {
+	if len(cfg.TLSCert) == 0 && len(cfg.TLSKey) == 0 {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("Failed to load TLS certificate for %v: %v", cfg.Listen, err)
 	}
-	return errors.New(reply.Message)
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if len(cfg.TLSClientCA) > 0 {
+		data, err := ioutil.ReadFile(cfg.TLSClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read TLS client CA for %v: %v", cfg.Listen, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("No certificates found in TLS client CA %v", cfg.TLSClientCA)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
 }
 
-func (self *ProxyServer) setDeadline(conn *net.TCPConn, stratum_id int) {
+func (self *ProxyServer) setDeadline(conn net.Conn, stratum_id int) {
 	conn.SetDeadline(time.Now().Add(self.stratums[stratum_id].timeout))
 }
 
@@ -193,8 +302,6 @@ func (s *ProxyServer) broadcastNewJobs(stratum_id int) {
 
 	stratum := s.stratums[stratum_id]
 
-	reply := []string{t.Header, t.Seed, stratum.diff}
-
 	stratum.sessionsMu.RLock()
 	defer stratum.sessionsMu.RUnlock()
 
@@ -210,7 +317,7 @@ func (s *ProxyServer) broadcastNewJobs(stratum_id int) {
 		bcast <- n
 
 		go func(cs *Session) {
-			err := cs.pushNewJob(&reply)
+			err := cs.pushJob(t)
 			<-bcast
 			if err != nil {
 				log.Printf("Job transmit error to %v@%v: %v", cs.login, cs.ip, err)
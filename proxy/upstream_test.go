@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/sammy007/open-ethereum-pool/rpc"
+)
+
+func TestSelectUpstreamSkipsLagging(t *testing.T) {
+	cfg := &UpstreamSelection{MaxHeightLag: 1, HeightWeight: 100, LatencyWeight: 1}
+	states := []rpc.UpstreamState{
+		{Name: "main", Healthy: true, Height: 1000, Latency: 10},
+		{Name: "backup", Healthy: true, Height: 1003, Latency: 50},
+	}
+	if i := selectUpstream(states, 0, cfg); i != 1 {
+		t.Errorf("Must switch away from lagging upstream, got %v", i)
+	}
+}
+
+func TestSelectUpstreamPrefersLowLatency(t *testing.T) {
+	cfg := &UpstreamSelection{MaxHeightLag: 2, HeightWeight: 100, LatencyWeight: 1, Hysteresis: 20}
+	states := []rpc.UpstreamState{
+		{Name: "main", Healthy: true, Height: 1000, Latency: 90},
+		{Name: "backup", Healthy: true, Height: 1000, Latency: 80},
+		{Name: "fast", Healthy: true, Height: 1000, Latency: 10},
+	}
+	if i := selectUpstream(states, 1, cfg); i != 2 {
+		t.Errorf("Must select upstream with the lowest latency, got %v", i)
+	}
+	states[2].Latency = 70
+	if i := selectUpstream(states, 1, cfg); i != 1 {
+		t.Errorf("Must keep current upstream within hysteresis, got %v", i)
+	}
+}
+
+func TestSelectUpstreamConfigOrder(t *testing.T) {
+	cfg := &UpstreamSelection{}
+	states := []rpc.UpstreamState{
+		{Name: "main", Healthy: true, Height: 1000},
+		{Name: "backup", Healthy: true, Height: 1000},
+	}
+	if i := selectUpstream(states, 1, cfg); i != 0 {
+		t.Errorf("Must return to the first alive upstream, got %v", i)
+	}
+	states[0].Healthy = false
+	states[1].Healthy = false
+	if i := selectUpstream(states, 1, cfg); i != 0 {
+		t.Errorf("Must fall back to the first upstream, got %v", i)
+	}
+}
+
+func TestCheckUpstreamName(t *testing.T) {
+	for name, valid := range map[string]bool{"main": true, "backup-1": true, "": false, "a:b": false, "a,b": false} {
+		if err := checkUpstreamName(name); (err == nil) != valid {
+			t.Errorf("Invalid check of upstream name %q: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sammy007/open-ethereum-pool/util"
+)
+
+// Never move difficulty by more than this factor in a single retarget
+const maxRetargetFactor = 4.0
+
+type varDiffOptions struct {
+	minDiff      int64
+	maxDiff      int64
+	targetTime   time.Duration
+	retargetTime time.Duration
+	variance     float64
+}
+
+func newVarDiffOptions(cfg *VarDiff, diff int64) *varDiffOptions {
+	if !cfg.Enabled {
+		return nil
+	}
+	o := &varDiffOptions{
+		minDiff:      cfg.MinDiff,
+		maxDiff:      cfg.MaxDiff,
+		targetTime:   util.MustParseDuration(cfg.TargetTime),
+		retargetTime: util.MustParseDuration(cfg.RetargetTime),
+		variance:     cfg.VariancePercent / 100.0,
+	}
+	if o.minDiff <= 0 {
+		o.minDiff = diff
+	}
+	if o.maxDiff < o.minDiff {
+		o.maxDiff = o.minDiff
+	}
+	return o
+}
+
+type varDiff struct {
+	sync.Mutex
+	opts *varDiffOptions
+
+	// Difficulty miner currently works on and difficulty it had before the last job
+	difficulty int64
+	previous   int64
+	// Scheduled difficulty, miner receives it with the next job
+	pending int64
+
+	appliedAt    time.Time
+	lastRetarget time.Time
+	shares       int64
+}
+
+func newVarDiff(opts *varDiffOptions, diff int64) *varDiff {
+	if diff < opts.minDiff {
+		diff = opts.minDiff
+	} else if diff > opts.maxDiff {
+		diff = opts.maxDiff
+	}
+	now := time.Now()
+	return &varDiff{opts: opts, difficulty: diff, previous: diff, pending: diff, appliedAt: now, lastRetarget: now}
+}
+
+// Returns difficulty shares must be checked against.
+// Shares of the job sent before the last difficulty change are still in flight
+// for a single target interval, so the lower of both difficulties is used meanwhile.
+func (v *varDiff) current(now time.Time) int64 {
+	v.Lock()
+	defer v.Unlock()
+
+	if v.previous < v.difficulty && now.Sub(v.appliedAt) < v.opts.targetTime {
+		return v.previous
+	}
+	return v.difficulty
+}
+
+// Registers valid share and reschedules difficulty if retarget window elapsed
+func (v *varDiff) submitShare(now time.Time) {
+	v.Lock()
+	defer v.Unlock()
+
+	v.shares++
+	v.retarget(now)
+}
+
+// Promotes scheduled difficulty, must be called right before sending a job to the miner.
+// Returns difficulty of the job and whether it was changed.
+func (v *varDiff) apply(now time.Time) (int64, bool) {
+	v.Lock()
+	defer v.Unlock()
+
+	// Miner which doesn't submit anything is likely stuck on too high difficulty
+	v.retarget(now)
+
+	if v.pending == v.difficulty {
+		return v.difficulty, false
+	}
+	v.previous = v.difficulty
+	v.difficulty = v.pending
+	v.appliedAt = now
+	return v.difficulty, true
+}
+
+func (v *varDiff) retarget(now time.Time) {
+	elapsed := now.Sub(v.lastRetarget)
+	if elapsed < v.opts.retargetTime {
+		return
+	}
+	target := v.opts.targetTime.Seconds()
+	var interval float64
+	if v.shares > 0 {
+		interval = elapsed.Seconds() / float64(v.shares)
+	} else {
+		interval = elapsed.Seconds()
+	}
+	v.lastRetarget = now
+	v.shares = 0
+
+	if interval >= target*(1-v.opts.variance) && interval <= target*(1+v.opts.variance) {
+		return
+	}
+	factor := target / interval
+	if factor > maxRetargetFactor {
+		factor = maxRetargetFactor
+	} else if factor < 1/maxRetargetFactor {
+		factor = 1 / maxRetargetFactor
+	}
+	diff := int64(float64(v.difficulty) * factor)
+	if diff < v.opts.minDiff {
+		diff = v.opts.minDiff
+	} else if diff > v.opts.maxDiff {
+		diff = v.opts.maxDiff
+	}
+	v.pending = diff
+}
@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func testVarDiffOptions() *varDiffOptions {
+	return &varDiffOptions{
+		minDiff:      1000,
+		maxDiff:      100000,
+		targetTime:   10 * time.Second,
+		retargetTime: 60 * time.Second,
+		variance:     0.3,
+	}
+}
+
+func TestVarDiffRaisesOnFastShares(t *testing.T) {
+	v := newVarDiff(testVarDiffOptions(), 4000)
+	start := v.lastRetarget
+
+	// 60 shares in 60 seconds, 10x faster than target
+	for i := 1; i <= 60; i++ {
+		v.submitShare(start.Add(time.Duration(i) * time.Second))
+	}
+	if v.difficulty != 4000 {
+		t.Error("Must not change difficulty before next job")
+	}
+	diff, changed := v.apply(start.Add(61 * time.Second))
+	if !changed || diff != 16000 {
+		t.Errorf("Must raise difficulty limited by max factor, got %v", diff)
+	}
+	if v.current(start.Add(62*time.Second)) != 4000 {
+		t.Error("Must accept previous difficulty for in-flight shares")
+	}
+	if v.current(start.Add(80*time.Second)) != 16000 {
+		t.Error("Must require new difficulty after grace interval")
+	}
+}
+
+func TestVarDiffLowersWithoutShares(t *testing.T) {
+	v := newVarDiff(testVarDiffOptions(), 4000)
+	start := v.lastRetarget
+
+	diff, changed := v.apply(start.Add(30 * time.Second))
+	if changed || diff != 4000 {
+		t.Error("Must not retarget before retarget window")
+	}
+	diff, changed = v.apply(start.Add(120 * time.Second))
+	if !changed || diff != 1000 {
+		t.Errorf("Must lower difficulty down to min, got %v", diff)
+	}
+}
+
+func TestVarDiffKeepsWithinVariance(t *testing.T) {
+	v := newVarDiff(testVarDiffOptions(), 4000)
+	start := v.lastRetarget
+
+	for i := 1; i <= 6; i++ {
+		v.submitShare(start.Add(time.Duration(i*11) * time.Second))
+	}
+	if _, changed := v.apply(start.Add(67 * time.Second)); changed {
+		t.Error("Must keep difficulty within allowed variance")
+	}
+}
@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"errors"
+	"math/big"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+var errVerifyQueueFull = errors.New("Verification queue is full")
+
+// Smoothing factor of queue wait and verify latency moving averages
+const verifyLatencyAlpha = 0.05
+
+type VerifyState struct {
+	Workers   int     `json:"workers"`
+	QueueSize int     `json:"queueSize"`
+	Queued    int     `json:"queued"`
+	Verified  int64   `json:"verified"`
+	Shed      int64   `json:"shed"`
+	QueueWait float64 `json:"queueWait"`
+	Latency   float64 `json:"latency"`
+}
+
+type verifyResult struct {
+	share bool
+	// PoW meets network difficulty too
+	block     bool
+	mixDigest common.Hash
+}
+
+type verifyJob struct {
+	block    Block
+	netDiff  *big.Int
+	queuedAt time.Time
+	result   chan verifyResult
+}
+
+// Verifies shares on a fixed number of workers, hashimoto is evaluated once per share
+// for both share and block target. Shares are rejected once the queue is full.
+// Shares claiming to be a block skip the queue, workers take them first.
+type verifyPool struct {
+	sync.Mutex
+	jobs       chan *verifyJob
+	candidates chan *verifyJob
+	workers    int
+
+	verified  int64
+	shed      int64
+	queueWait time.Duration
+	latency   time.Duration
+}
+
+func newVerifyPool(cfg *Verify) *verifyPool {
+	workers := cfg.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	queueSize := cfg.QueueSize
+	if queueSize <= 0 {
+		queueSize = workers * 16
+	}
+	p := &verifyPool{jobs: make(chan *verifyJob, queueSize), candidates: make(chan *verifyJob, workers), workers: workers}
+	for i := 0; i < workers; i++ {
+		go p.run()
+	}
+	return p
+}
+
+func (p *verifyPool) run() {
+	for {
+		job := p.next()
+		start := time.Now()
+		result := lightHash.verify(job.block, job.netDiff)
+		p.observe(start.Sub(job.queuedAt), time.Since(start))
+		job.result <- result
+	}
+}
+
+// Block candidates go first
+func (p *verifyPool) next() *verifyJob {
+	select {
+	case job := <-p.candidates:
+		return job
+	default:
+	}
+	select {
+	case job := <-p.candidates:
+		return job
+	case job := <-p.jobs:
+		return job
+	}
+}
+
+// netDiff is nil for superseded jobs, their shares can't be a block.
+func (p *verifyPool) verify(block Block, netDiff *big.Int) (verifyResult, error) {
+	job := &verifyJob{block: block, netDiff: netDiff, queuedAt: time.Now(), result: make(chan verifyResult, 1)}
+	queue := p.jobs
+	if claimsBlock(block, netDiff) {
+		queue = p.candidates
+	}
+	select {
+	case queue <- job:
+	default:
+		p.Lock()
+		p.shed++
+		p.Unlock()
+		return verifyResult{}, errVerifyQueueFull
+	}
+	return <-job.result, nil
+}
+
+func (p *verifyPool) observe(wait, latency time.Duration) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.verified++
+	if p.verified == 1 {
+		p.queueWait = wait
+		p.latency = latency
+		return
+	}
+	p.queueWait = time.Duration(verifyLatencyAlpha*float64(wait) + (1-verifyLatencyAlpha)*float64(p.queueWait))
+	p.latency = time.Duration(verifyLatencyAlpha*float64(latency) + (1-verifyLatencyAlpha)*float64(p.latency))
+}
+
+// Average queue wait and verify latency are in milliseconds
+func (p *verifyPool) state() VerifyState {
+	p.Lock()
+	defer p.Unlock()
+	return VerifyState{
+		Workers:   p.workers,
+		QueueSize: cap(p.jobs),
+		Queued:    len(p.jobs) + len(p.candidates),
+		Verified:  p.verified,
+		Shed:      p.shed,
+		QueueWait: p.queueWait.Seconds() * 1000,
+		Latency:   p.latency.Seconds() * 1000,
+	}
+}
@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"encoding/hex"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestVerifyPoolShedsLoad(t *testing.T) {
+	// No workers, so the first share occupies the whole queue
+	p := &verifyPool{jobs: make(chan *verifyJob, 1), candidates: make(chan *verifyJob, 1)}
+	go p.verify(Block{}, nil)
+	for len(p.jobs) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	_, err := p.verify(Block{}, nil)
+	if err != errVerifyQueueFull {
+		t.Errorf("Must reject share if queue is full, got %v", err)
+	}
+	// Share of the current job is shed too unless it claims to be a block
+	_, err = p.verify(Block{}, big.NewInt(2))
+	if err != errVerifyQueueFull {
+		t.Errorf("Must reject share of the current job if queue is full, got %v", err)
+	}
+	if state := p.state(); state.Shed != 2 || state.Queued != 1 {
+		t.Errorf("Must count shed shares, got %+v", state)
+	}
+}
+
+func TestVerifyPoolPrioritizesCandidates(t *testing.T) {
+	p := &verifyPool{jobs: make(chan *verifyJob, 1), candidates: make(chan *verifyJob, 1)}
+	go p.verify(Block{}, big.NewInt(1))
+	for len(p.jobs) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	hash, _ := hex.DecodeString("c9149cc0386e689d789a1c2f3d5d169a61a6218ed30e74414dc736e442ef3d1f")
+	digest, _ := hex.DecodeString("e4073cffaef931d37117cefd9afd27ea0f1cad6a981dd2605c4a1ac97c519800")
+	candidate := Block{hashNoNonce: common.BytesToHash(hash), mixDigest: common.BytesToHash(digest)}
+	go p.verify(candidate, big.NewInt(1))
+	for len(p.candidates) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if job := p.next(); job.block != candidate {
+		t.Errorf("Must verify block candidate first, got %+v", job.block)
+	}
+	if job := p.next(); job.block == candidate {
+		t.Error("Must verify queued share after candidate")
+	}
+	if state := p.state(); state.Shed != 0 {
+		t.Errorf("Must not shed shares, got %+v", state)
+	}
+}
+
+func TestVerifyPoolLatency(t *testing.T) {
+	p := &verifyPool{jobs: make(chan *verifyJob, 1), candidates: make(chan *verifyJob, 1)}
+	p.observe(10*time.Millisecond, 4*time.Millisecond)
+	p.observe(10*time.Millisecond, 4*time.Millisecond)
+
+	state := p.state()
+	if state.Verified != 2 || state.QueueWait != 10 || state.Latency != 4 {
+		t.Errorf("Invalid verification stats %+v", state)
+	}
+}
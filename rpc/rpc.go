@@ -9,9 +9,9 @@ import (
 	"math/big"
 	"net/http"
 	"strconv"
-
-	//"strings"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/ethereum/go-ethereum/common"
 
@@ -28,6 +28,25 @@ type RPCClient struct {
 	sickRate    int
 	successRate int
 	client      *http.Client
+
+	// Filled by Check
+	height     int64
+	latency    time.Duration
+	checkedAt  int64
+	sickCount  int64
+	aliveCount int64
+}
+
+type UpstreamState struct {
+	Name        string `json:"name"`
+	Healthy     bool   `json:"healthy"`
+	Height      int64  `json:"height"`
+	Latency     int64  `json:"latency"`
+	SickRate    int    `json:"sickRate"`
+	SuccessRate int    `json:"successRate"`
+	SickCount   int64  `json:"sickCount"`
+	AliveCount  int64  `json:"aliveCount"`
+	CheckedAt   int64  `json:"checkedAt"`
 }
 
 type GetBalanceReply struct {
@@ -338,7 +357,7 @@ func (r *RPCClient) createRawTX(type_ uint16, senders []string, receivers []stri
    :param: ACCOUNTAUTH(std::string): Account password(authorization) required.
    :param: TRANSACTION(string of hexcode): "The input Base16 transaction to sign."
 */
-func (r *RPCClient) signRawTX(TRANSACTION string) (string, error) {
+func (r *RPCClient) signRawTX(TRANSACTION string) (*MVSSignRawTxReply, error) {
 	cmd := "signrawtx"
 	positional := []interface{}{r.Account, r.Password, TRANSACTION}
 
@@ -347,16 +366,12 @@ func (r *RPCClient) signRawTX(TRANSACTION string) (string, error) {
 	args := append(positional, optional)
 	rpcResp, err := r.doPost(r.Url, cmd, args)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	var rawtx MVSSignRawTxReply
+	var rawtx *MVSSignRawTxReply
 	err = json.Unmarshal(*rpcResp.Result, &rawtx)
-	if err != nil {
-		return "", err
-	}
-
-	return rawtx.RawTx, err
+	return rawtx, err
 }
 
 /*
@@ -387,24 +402,69 @@ func (r *RPCClient) sendRawTX(TRANSACTION string, fee uint64) (string, error) {
 	return txhash, err
 }
 
+// Transaction failed before broadcast, nothing was sent
+type TxBuildError struct {
+	Err error
+}
+
+func (e *TxBuildError) Error() string {
+	return e.Err.Error()
+}
+
 func (r *RPCClient) SendMore(from string, receivers map[string]int64) (string, error) {
+	rawtx, err := r.CreateSendMore(from, receivers)
+	if err != nil {
+		return "createRawTX Failed", &TxBuildError{err}
+	}
+
+	_, signed, err := r.SignTx(rawtx)
+	if err != nil {
+		return "signRawTX Failed", &TxBuildError{err}
+	}
+
+	return r.BroadcastTx(signed)
+}
+
+// Unsigned tx paying receivers, change goes back to sender
+func (r *RPCClient) CreateSendMore(from string, receivers map[string]int64) (string, error) {
 	var receivers_ []string
-	var senders []string
 	for login, amount := range receivers {
 		receivers_ = append(receivers_, login+":"+strconv.FormatInt(amount, 10))
 	}
-	senders = append(senders, from)
-	rawtx1, err1 := r.createRawTX(0, senders, receivers_, "", 0, from, "", 10000)
-	if err1 != nil {
-		return "createRawTX Failed", err1
-	}
+	return r.createRawTX(0, []string{from}, receivers_, "", 0, from, "", 10000)
+}
 
-	rawtx2, err2 := r.signRawTX(rawtx1)
-	if err2 != nil {
-		return "signRawTX Failed", err2
+// Returns hash and signed tx, hash is known before broadcast
+func (r *RPCClient) SignTx(rawtx string) (string, string, error) {
+	reply, err := r.signRawTX(rawtx)
+	if err != nil {
+		return "", "", err
+	}
+	if reply == nil || len(reply.RawTx) == 0 {
+		return "", "", errors.New("Empty signed tx")
 	}
+	return reply.Hash, reply.RawTx, nil
+}
+
+func (r *RPCClient) BroadcastTx(signed string) (string, error) {
+	return r.sendRawTX(signed, 10000)
+}
 
-	return r.sendRawTX(rawtx2, 10000)
+// Replies of a node refusing tx it already holds in mempool or chain
+var txKnownReplies = []string{"already known", "already in mempool", "already in pool", "already exists", "already in block chain", "duplicate"}
+
+// Broadcast error means the same tx was sent before, it must not be signed again
+func IsTxKnown(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := strings.ToLower(err.Error())
+	for _, reply := range txKnownReplies {
+		if strings.Contains(msg, reply) {
+			return true
+		}
+	}
+	return false
 }
 
 func (r *RPCClient) doPost(url string, method string, params interface{}) (*JSONRpcResp, error) {
@@ -436,15 +496,50 @@ func (r *RPCClient) doPost(url string, method string, params interface{}) (*JSON
 	return rpcResp, err
 }
 
+// Smoothing factor of RPC latency moving average
+const latencyAlpha = 0.3
+
 func (r *RPCClient) Check() bool {
+	start := time.Now()
 	_, err := r.GetWork()
 	if err != nil {
 		return false
 	}
+	latency := time.Since(start)
+	height, err := r.GetHeight()
+	if err != nil {
+		return false
+	}
 	r.markAlive()
+
+	r.Lock()
+	r.height = height
+	if r.latency == 0 {
+		r.latency = latency
+	} else {
+		r.latency = time.Duration(latencyAlpha*float64(latency) + (1-latencyAlpha)*float64(r.latency))
+	}
+	r.checkedAt = util.MakeTimestamp()
+	r.Unlock()
 	return !r.Sick()
 }
 
+func (r *RPCClient) State() UpstreamState {
+	r.RLock()
+	defer r.RUnlock()
+	return UpstreamState{
+		Name:        r.Name,
+		Healthy:     !r.sick,
+		Height:      r.height,
+		Latency:     int64(r.latency / time.Millisecond),
+		SickRate:    r.sickRate,
+		SuccessRate: r.successRate,
+		SickCount:   r.sickCount,
+		AliveCount:  r.aliveCount,
+		CheckedAt:   r.checkedAt,
+	}
+}
+
 func (r *RPCClient) Sick() bool {
 	r.RLock()
 	defer r.RUnlock()
@@ -456,6 +551,9 @@ func (r *RPCClient) markSick() {
 	r.sickRate++
 	r.successRate = 0
 	if r.sickRate >= 5 {
+		if !r.sick {
+			r.sickCount++
+		}
 		r.sick = true
 	}
 	r.Unlock()
@@ -465,6 +563,9 @@ func (r *RPCClient) markAlive() {
 	r.Lock()
 	r.successRate++
 	if r.successRate >= 5 {
+		if r.sick {
+			r.aliveCount++
+		}
 		r.sick = false
 		r.sickRate = 0
 		r.successRate = 0
@@ -0,0 +1,130 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Balance fields tracked both per miner and in finances
+var accountFields = []string{"balance", "immature", "pending", "paid"}
+
+// Accounting state read at a single point in time
+type AccountingSnapshot struct {
+	Finances map[string]int64
+	// Balance fields of every miner
+	Miners map[string]map[string]int64
+	// Sums of matured credit logs "credits:{height}:{hash}" per login
+	Credits map[string]int64
+	// Sums of immature credit logs "credits:immature:{height}:{hash}" per login
+	ImmatureCredits map[string]int64
+	// Sums of "payments:pending" and "payments:all" per login
+	Pending map[string]int64
+	Paid    map[string]int64
+	// Sorted set mirroring miner balances for payee selection
+	Balances map[string]int64
+}
+
+type AuditMismatch struct {
+	Check    string `json:"check"`
+	Login    string `json:"login,omitempty"`
+	Expected int64  `json:"expected"`
+	Actual   int64  `json:"actual"`
+}
+
+func (m *AuditMismatch) String() string {
+	if len(m.Login) > 0 {
+		return fmt.Sprintf("%v of %v is %v, expected %v", m.Check, m.Login, m.Actual, m.Expected)
+	}
+	return fmt.Sprintf("%v is %v, expected %v", m.Check, m.Actual, m.Expected)
+}
+
+func newAccountingSnapshot() *AccountingSnapshot {
+	return &AccountingSnapshot{
+		Finances:        make(map[string]int64),
+		Miners:          make(map[string]map[string]int64),
+		Credits:         make(map[string]int64),
+		ImmatureCredits: make(map[string]int64),
+		Pending:         make(map[string]int64),
+		Paid:            make(map[string]int64),
+		Balances:        make(map[string]int64),
+	}
+}
+
+// Finances must equal sums over miners, every miner must hold what credit logs and payments say
+func (s *AccountingSnapshot) Audit() []*AuditMismatch {
+	var result []*AuditMismatch
+
+	totals := make(map[string]int64)
+	for _, miner := range s.Miners {
+		for _, f := range accountFields {
+			totals[f] += miner[f]
+		}
+	}
+	for _, f := range accountFields {
+		if totals[f] != s.Finances[f] {
+			result = append(result, &AuditMismatch{Check: "finances." + f, Expected: totals[f], Actual: s.Finances[f]})
+		}
+	}
+
+	logins := make(map[string]struct{})
+	for _, m := range []map[string]int64{s.Credits, s.ImmatureCredits, s.Pending, s.Paid, s.Balances} {
+		for login := range m {
+			logins[login] = struct{}{}
+		}
+	}
+	for login := range s.Miners {
+		logins[login] = struct{}{}
+	}
+	sorted := make([]string, 0, len(logins))
+	for login := range logins {
+		sorted = append(sorted, login)
+	}
+	sort.Strings(sorted)
+
+	for _, login := range sorted {
+		miner := s.Miners[login]
+		check := func(name string, expected, actual int64) {
+			if expected != actual {
+				result = append(result, &AuditMismatch{Check: name, Login: login, Expected: expected, Actual: actual})
+			}
+		}
+		check("immature", s.ImmatureCredits[login], miner["immature"])
+		check("credited", s.Credits[login], miner["balance"]+miner["pending"]+miner["paid"])
+		check("pending", s.Pending[login], miner["pending"])
+		check("paid", s.Paid[login], miner["paid"])
+		check("balanceIndex", miner["balance"], s.Balances[login])
+	}
+	return result
+}
+
+func (s *AccountingSnapshot) addMiner(login string, raw map[string]string) {
+	miner := make(map[string]int64)
+	for _, f := range accountFields {
+		miner[f], _ = strconv.ParseInt(raw[f], 10, 64)
+	}
+	s.Miners[login] = miner
+}
+
+func (s *AccountingSnapshot) addCredits(immature bool, raw map[string]string) {
+	for login, v := range raw {
+		amount, _ := strconv.ParseInt(v, 10, 64)
+		if immature {
+			s.ImmatureCredits[login] += amount
+		} else {
+			s.Credits[login] += amount
+		}
+	}
+}
+
+// Pending members are "login:amount", all payments are "txHash:login:amount"
+func (s *AccountingSnapshot) addPayment(pending bool, member string) {
+	fields := strings.Split(member, ":")
+	amount, _ := strconv.ParseInt(fields[len(fields)-1], 10, 64)
+	if pending {
+		s.Pending[fields[0]] += amount
+	} else {
+		s.Paid[fields[1]] += amount
+	}
+}
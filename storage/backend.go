@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"math/big"
+	"time"
+)
+
+// Operations used by pool modules, implemented by redis and in-memory backends.
+// Multi-key writes must be applied atomically, as MULTI does for redis.
+type Backend interface {
+	Check() (string, error)
+	BgSave() (string, error)
+	CheckSchema() error
+	// Keeps rolling window of shares and snapshots it with every candidate, 0 disables it
+	SetPPLNS(n float64)
+
+	GetBlacklist() ([]string, error)
+	GetWhitelist() ([]string, error)
+
+	WriteNodeState(id string, height uint64, diff *big.Int) error
+	WriteNodeDetails(id, section string, details interface{}) error
+	GetNodeStates() ([]map[string]interface{}, error)
+
+	// Replay of a batch id which was written already is a no-op
+	WriteShares(batch string, shares []*Share, window time.Duration) error
+	WriteReject(height uint64) (bool, error)
+	WriteBlock(login, id string, params []string, diff, roundDiff, reward int64, solo bool, height uint64, window time.Duration, accepted, rejected []string) (bool, error)
+	WriteReportedHashrate(login, id string, hashrate int64, clientId string, expire time.Duration) error
+
+	GetCandidates(maxHeight int64) ([]*BlockData, error)
+	GetImmatureBlocks(maxHeight int64) ([]*BlockData, error)
+	GetRoundShares(height int64, nonce string) (map[string]int64, error)
+	GetWindowShares(nonce string) (map[string]int64, error)
+	WriteImmatureBlock(block *BlockData, roundRewards map[string]int64) error
+	WriteMaturedBlock(block *BlockData, roundRewards map[string]int64) error
+	WriteOrphan(block *BlockData) error
+	// PPS: block revenue goes to the reserve which shares were credited from
+	WriteReserveBlock(block *BlockData, txFees int64) error
+	GetAverageTxFees() (int64, error)
+	WritePendingOrphans(blocks []*BlockData) error
+	GetMaturedBlocks(fromHeight int64) ([]*BlockData, error)
+	GetBlockCredits(height int64, hash string) (map[string]int64, error)
+
+	GetPayeesAbove(threshold int64) (map[string]int64, error)
+	UnlockPayouts() error
+	IsPayoutsLocked() (bool, error)
+	GetPendingPayments() []*PendingPayment
+	UpdateBalance(login string, amount int64) error
+	RollbackBalance(login string, amount int64) error
+	WritePayment(login, txHash string, amount int64) error
+	// Journaled payout batch holds the lock from planning until it is confirmed or failed
+	PlanPayoutBatch(batch *PayoutBatch) error
+	AdvancePayoutBatch(batch *PayoutBatch, state string) error
+	GetOpenPayoutBatch() (*PayoutBatch, error)
+	GetPayments(since int64) ([]*Payment, error)
+	GetAccountingSnapshot() (*AccountingSnapshot, error)
+	WriteAuditResult(mismatches []*AuditMismatch, blockPayouts bool) error
+	IsPayoutsBlocked() (bool, error)
+
+	IsMinerExists(login string) (bool, error)
+	GetMinerStats(login string, maxPayments int64) (map[string]interface{}, error)
+	FlushStaleStats(window, largeWindow time.Duration) (int64, error)
+	CollectStats(smallWindow time.Duration, maxBlocks, maxPayments int64) (map[string]interface{}, error)
+	CollectWorkersStats(sWindow, lWindow time.Duration, login string) (map[string]interface{}, error)
+	CollectLuckStats(windows []int) (map[string]interface{}, error)
+
+	CollectShares(from, to int64) (map[string]map[string]*ShareTotal, error)
+	WriteHistory(tier string, retention time.Duration, bucket *HistoryBucket) error
+	GetHistory(tier string, from, to int64) (*HistorySeries, error)
+	GetPoolHistory(tier string, from int64) ([]*HistoryPoint, error)
+	GetMinerHistory(tier, login string, from int64) ([]*HistoryPoint, map[string][]*HistoryPoint, error)
+}
+
+var _ Backend = (*RedisClient)(nil)
+var _ Backend = (*MemoryBackend)(nil)
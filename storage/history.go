@@ -0,0 +1,105 @@
+package storage
+
+import (
+	"strconv"
+	"strings"
+
+	"gopkg.in/redis.v3"
+)
+
+// Difficulty sum and number of shares submitted by a worker
+type ShareTotal struct {
+	Difficulty int64
+	Count      int64
+}
+
+// Activity over a time bucket starting at Timestamp, miners and workers are counted only for pool and miners
+type HistoryPoint struct {
+	Timestamp int64 `json:"timestamp"`
+	Hashrate  int64 `json:"hashrate"`
+	Shares    int64 `json:"shares"`
+	Miners    int64 `json:"miners,omitempty"`
+	Workers   int64 `json:"workers,omitempty"`
+}
+
+// Points of every series over a single bucket, workers are keyed by login then by worker id
+type HistoryBucket struct {
+	Timestamp int64
+	Pool      *HistoryPoint
+	Miners    map[string]*HistoryPoint
+	Workers   map[string]map[string]*HistoryPoint
+}
+
+// Points of every series of a tier within a time range
+type HistorySeries struct {
+	Pool    []*HistoryPoint
+	Miners  map[string][]*HistoryPoint
+	Workers map[string]map[string][]*HistoryPoint
+}
+
+func NewHistorySeries() *HistorySeries {
+	return &HistorySeries{
+		Miners:  make(map[string][]*HistoryPoint),
+		Workers: make(map[string]map[string][]*HistoryPoint),
+	}
+}
+
+func (s *HistorySeries) addWorkers(login string, raw []redis.Z) {
+	for id, points := range convertWorkerHistory(raw) {
+		if _, ok := s.Workers[login]; !ok {
+			s.Workers[login] = make(map[string][]*HistoryPoint)
+		}
+		s.Workers[login][id] = points
+	}
+}
+
+// Points are stored as "timestamp:hashrate:shares:miners:workers" scored by timestamp
+func encodeHistoryPoint(ts int64, p *HistoryPoint) string {
+	return join(ts, p.Hashrate, p.Shares, p.Miners, p.Workers)
+}
+
+func parseHistoryPoint(fields []string) *HistoryPoint {
+	p := &HistoryPoint{}
+	p.Timestamp, _ = strconv.ParseInt(fields[0], 10, 64)
+	p.Hashrate, _ = strconv.ParseInt(fields[1], 10, 64)
+	p.Shares, _ = strconv.ParseInt(fields[2], 10, 64)
+	p.Miners, _ = strconv.ParseInt(fields[3], 10, 64)
+	p.Workers, _ = strconv.ParseInt(fields[4], 10, 64)
+	return p
+}
+
+func convertHistoryPoints(raw []redis.Z) []*HistoryPoint {
+	result := make([]*HistoryPoint, 0, len(raw))
+	for _, v := range raw {
+		result = append(result, parseHistoryPoint(strings.Split(v.Member.(string), ":")))
+	}
+	return result
+}
+
+// All workers of a miner share one key, members are prefixed with worker id
+func convertWorkerHistory(raw []redis.Z) map[string][]*HistoryPoint {
+	result := make(map[string][]*HistoryPoint)
+	for _, v := range raw {
+		fields := strings.Split(v.Member.(string), ":")
+		result[fields[0]] = append(result[fields[0]], parseHistoryPoint(fields[1:]))
+	}
+	return result
+}
+
+// Per login raw shares "diff:id:ms" => id => totals
+func convertShareTotals(login string, raw []redis.Z, result map[string]map[string]*ShareTotal) {
+	for _, v := range raw {
+		parts := strings.Split(v.Member.(string), ":")
+		diff, _ := strconv.ParseInt(parts[0], 10, 64)
+		if _, ok := result[login]; !ok {
+			result[login] = make(map[string]*ShareTotal)
+		}
+		total, ok := result[login][parts[1]]
+		if !ok {
+			total = &ShareTotal{}
+			result[login][parts[1]] = total
+		}
+		total.Difficulty += diff
+		total.Count++
+	}
+}
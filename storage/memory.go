@@ -0,0 +1,1146 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/redis.v3"
+
+	"github.com/sammy007/open-ethereum-pool/util"
+)
+
+// In-memory backend which keeps the same keys and values as redis.
+// Every operation holds a single lock, so multi-key writes are atomic like MULTI.
+// Nothing is persisted and state is not shared between processes.
+type MemoryBackend struct {
+	sync.Mutex
+	prefix  string
+	strings map[string]string
+	hashes  map[string]map[string]string
+	zsets   map[string]map[string]float64
+	sets    map[string]map[string]struct{}
+	expires map[string]time.Time
+	pplns   float64
+}
+
+func NewMemoryBackend(prefix string) *MemoryBackend {
+	return &MemoryBackend{
+		prefix:  prefix,
+		strings: make(map[string]string),
+		hashes:  make(map[string]map[string]string),
+		zsets:   make(map[string]map[string]float64),
+		sets:    make(map[string]map[string]struct{}),
+		expires: make(map[string]time.Time),
+	}
+}
+
+func (m *MemoryBackend) SetPPLNS(n float64) {
+	m.pplns = n
+}
+
+func (m *MemoryBackend) Check() (string, error) {
+	return "PONG", nil
+}
+
+// Memory always starts empty with current schema
+func (m *MemoryBackend) CheckSchema() error {
+	return nil
+}
+
+func (m *MemoryBackend) BgSave() (string, error) {
+	return "Memory backend is not persisted", nil
+}
+
+// Adds login to blacklist, there is no other way to populate it in memory
+func (m *MemoryBackend) AddBlacklist(login string) {
+	m.Lock()
+	defer m.Unlock()
+	m.sadd(m.formatKey("blacklist"), login)
+}
+
+// Adds IP to whitelist, there is no other way to populate it in memory
+func (m *MemoryBackend) AddWhitelist(ip string) {
+	m.Lock()
+	defer m.Unlock()
+	m.sadd(m.formatKey("whitelist"), ip)
+}
+
+func (m *MemoryBackend) GetBlacklist() ([]string, error) {
+	m.Lock()
+	defer m.Unlock()
+	return m.smembers(m.formatKey("blacklist")), nil
+}
+
+func (m *MemoryBackend) GetWhitelist() ([]string, error) {
+	m.Lock()
+	defer m.Unlock()
+	return m.smembers(m.formatKey("whitelist")), nil
+}
+
+func (m *MemoryBackend) WriteNodeState(id string, height uint64, diff *big.Int) error {
+	m.Lock()
+	defer m.Unlock()
+
+	now := util.MakeTimestamp() / 1000
+
+	m.hset(m.formatKey("nodes"), join(id, "name"), id)
+	m.hset(m.formatKey("nodes"), join(id, "height"), strconv.FormatUint(height, 10))
+	m.hset(m.formatKey("nodes"), join(id, "difficulty"), diff.String())
+	m.hset(m.formatKey("nodes"), join(id, "lastBeat"), strconv.FormatInt(now, 10))
+	return nil
+}
+
+func (m *MemoryBackend) WriteNodeDetails(id, section string, details interface{}) error {
+	data, err := json.Marshal(details)
+	if err != nil {
+		return err
+	}
+	m.Lock()
+	defer m.Unlock()
+	m.hset(m.formatKey("nodes"), join(id, section), string(data))
+	return nil
+}
+
+func (m *MemoryBackend) GetNodeStates() ([]map[string]interface{}, error) {
+	m.Lock()
+	defer m.Unlock()
+	return convertNodeStates(m.hgetall(m.formatKey("nodes"))), nil
+}
+
+func (m *MemoryBackend) checkPoWExist(height uint64, params []string) bool {
+	m.zremRangeByScore(m.formatKey("pow"), float64(height-8))
+	return !m.zadd(m.formatKey("pow"), float64(height), strings.Join(params, ":"))
+}
+
+// Written batches are kept in a sorted set by time instead of a key per batch as in redis,
+// expired keys are evicted only on access here
+func (m *MemoryBackend) WriteShares(batch string, shares []*Share, window time.Duration) error {
+	m.Lock()
+	defer m.Unlock()
+
+	ms := util.MakeTimestamp()
+	batches := m.formatKey("shares", "batches")
+	m.zremRangeByScore(batches, float64(ms-int64(shareBatchExpiration/time.Millisecond)))
+	if !m.zadd(batches, float64(ms), batch) {
+		return nil
+	}
+	var roundShares, staleShares int64
+	for _, s := range shares {
+		m.writeShare(s.Timestamp, s.Timestamp/1000, s.Login, s.Id, s.Nonce, s.Diff, window, s.Solo)
+		if s.Reward > 0 {
+			m.writeShareCredit(s.Login, s.Reward)
+		}
+		if !s.Solo {
+			roundShares += s.Diff
+		}
+		if s.Stale {
+			staleShares++
+			m.hincrBy(m.formatKey("miners", s.Login), "staleShares", 1)
+		}
+	}
+	m.hincrBy(m.formatKey("stats"), "roundShares", roundShares)
+	if m.pplns > 0 {
+		m.zremRangeByRank(m.formatKey("window"), -maxWindowShares-1)
+	}
+	if staleShares > 0 {
+		m.hincrBy(m.formatKey("stats"), "staleShares", staleShares)
+	}
+	return nil
+}
+
+func (m *MemoryBackend) WriteReject(height uint64) (bool, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	ts := util.MakeTimestamp() / 1000
+	m.zadd(m.formatKey("blocks", "rejects"), float64(height), join(ts))
+	return true, nil
+}
+
+func (m *MemoryBackend) WriteBlock(login, id string, params []string, diff, roundDiff, reward int64, solo bool, height uint64, window time.Duration, accepted, rejected []string) (bool, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	// Duplicate share, (nonce, powHash, mixDigest) pair exist
+	if m.checkPoWExist(height, params) {
+		return true, nil
+	}
+	ms := util.MakeTimestamp()
+	ts := ms / 1000
+
+	m.writeShare(ms, ts, login, id, params[0], diff, window, solo)
+	if reward > 0 {
+		m.writeShareCredit(login, reward)
+	}
+	round := m.formatKey("shares", "roundCurrent")
+	if solo {
+		round = m.formatSoloRound(login)
+	} else {
+		m.hset(m.formatKey("stats"), "lastBlockFound", strconv.FormatInt(ts, 10))
+		m.hdel(m.formatKey("stats"), "roundShares")
+		m.hdel(m.formatKey("finances"), "exposure")
+	}
+	m.zincrBy(m.formatKey("finders"), 1, login)
+	m.hincrBy(m.formatKey("miners", login), "blocksFound", 1)
+	if err := m.rename(round, m.formatRound(int64(height), params[0])); err != nil {
+		return false, err
+	}
+
+	totalShares := int64(0)
+	for _, v := range m.hgetall(m.formatRound(int64(height), params[0])) {
+		n, _ := strconv.ParseInt(v, 10, 64)
+		totalShares += n
+	}
+	hashHex := strings.Join(params, ":")
+	s := join(hashHex, ts, roundDiff, totalShares, strings.Join(accepted, ","), strings.Join(rejected, ","))
+	if solo {
+		s = join(s, "solo")
+	} else if m.pplns > 0 {
+		m.writeCandidateWindow(ms, int64(m.pplns*float64(roundDiff)), params[0])
+	}
+	m.zadd(m.formatKey("blocks", "candidates"), float64(height), s)
+	return false, nil
+}
+
+func (m *MemoryBackend) writeCandidateWindow(ms, size int64, nonce string) {
+	shares := make(map[string]int64)
+	var raw []redis.Z
+	for _, v := range m.zrange(m.formatKey("window"), true, 0, -1) {
+		if v.Score <= float64(ms) {
+			raw = append(raw, v)
+		}
+	}
+	fillWindow(shares, 0, size, raw)
+	for login, n := range formatWindowShares(shares) {
+		m.hset(m.formatKey("window", nonce), login, n)
+	}
+	if _, edge := windowEdge(0, windowRetain*size, raw); edge > 0 {
+		m.zremRangeByScore(m.formatKey("window"), float64(edge))
+	}
+}
+
+func (m *MemoryBackend) writeShare(ms, ts int64, login, id, nonce string, diff int64, expire time.Duration, solo bool) {
+	if solo {
+		m.hincrBy(m.formatSoloRound(login), login, diff)
+	} else {
+		m.hincrBy(m.formatKey("shares", "roundCurrent"), login, diff)
+	}
+	m.zadd(m.formatKey("hashrate"), float64(ts), join(diff, login, id, ms))
+	m.zadd(m.formatKey("hashrate", login), float64(ts), join(diff, id, ms))
+	m.expire(m.formatKey("hashrate", login), expire)
+	m.hset(m.formatKey("miners", login), "lastShare", strconv.FormatInt(ts, 10))
+	if m.pplns > 0 && !solo {
+		m.zadd(m.formatKey("window"), float64(ms), join(diff, login, id, ms, nonce))
+	}
+}
+
+func (m *MemoryBackend) writeShareCredit(login string, amount int64) {
+	m.hincrBy(m.formatKey("miners", login), "balance", amount)
+	m.zincrBy(m.formatKey("balances"), float64(amount), login)
+	m.hincrBy(m.formatKey("credits", "pps"), login, amount)
+	m.hincrBy(m.formatKey("finances"), "balance", amount)
+	m.hincrBy(m.formatKey("finances"), "reserve", (amount * -1))
+	m.hincrBy(m.formatKey("finances"), "exposure", amount)
+	m.hincrBy(m.formatKey("finances"), "ppsCredited", amount)
+}
+
+func (m *MemoryBackend) WriteReportedHashrate(login, id string, hashrate int64, clientId string, expire time.Duration) error {
+	m.Lock()
+	defer m.Unlock()
+
+	ts := util.MakeTimestamp() / 1000
+	m.hset(m.formatKey("report", login), id, join(hashrate, clientId, ts))
+	m.expire(m.formatKey("report", login), expire)
+	return nil
+}
+
+func (m *MemoryBackend) formatKey(args ...interface{}) string {
+	return join(m.prefix, join(args...))
+}
+
+func (m *MemoryBackend) formatRound(height int64, nonce string) string {
+	return m.formatKey("shares", "round"+strconv.FormatInt(height, 10), nonce)
+}
+
+func (m *MemoryBackend) formatSoloRound(login string) string {
+	return m.formatKey("shares", "solo", login)
+}
+
+func (m *MemoryBackend) GetCandidates(maxHeight int64) ([]*BlockData, error) {
+	m.Lock()
+	defer m.Unlock()
+	return convertCandidateResults(m.zrangeByScore(m.formatKey("blocks", "candidates"), 0, float64(maxHeight))), nil
+}
+
+func (m *MemoryBackend) GetImmatureBlocks(maxHeight int64) ([]*BlockData, error) {
+	m.Lock()
+	defer m.Unlock()
+	return convertBlockResults(m.zrangeByScore(m.formatKey("blocks", "immature"), 0, float64(maxHeight))), nil
+}
+
+func (m *MemoryBackend) GetRoundShares(height int64, nonce string) (map[string]int64, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	result := make(map[string]int64)
+	for login, v := range m.hgetall(m.formatRound(height, nonce)) {
+		n, _ := strconv.ParseInt(v, 10, 64)
+		result[login] = n
+	}
+	return result, nil
+}
+
+func (m *MemoryBackend) GetWindowShares(nonce string) (map[string]int64, error) {
+	m.Lock()
+	defer m.Unlock()
+	return convertCredits(m.hgetall(m.formatKey("window", nonce))), nil
+}
+
+func (m *MemoryBackend) GetPayeesAbove(threshold int64) (map[string]int64, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	var result []redis.Z
+	for _, v := range m.zrangeByScore(m.formatKey("balances"), float64(threshold), math.Inf(1)) {
+		if v.Score > float64(threshold) {
+			result = append(result, v)
+		}
+	}
+	return convertBalances(result), nil
+}
+
+func (m *MemoryBackend) GetBalance(login string) (int64, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	v, ok := m.hget(m.formatKey("miners", login), "balance")
+	if !ok {
+		return 0, nil
+	}
+	return strconv.ParseInt(v, 10, 64)
+}
+
+func (m *MemoryBackend) UnlockPayouts() error {
+	m.Lock()
+	defer m.Unlock()
+	m.del(m.formatKey("payments", "lock"))
+	return nil
+}
+
+func (m *MemoryBackend) IsPayoutsLocked() (bool, error) {
+	m.Lock()
+	defer m.Unlock()
+	_, ok := m.get(m.formatKey("payments", "lock"))
+	return ok, nil
+}
+
+func (m *MemoryBackend) GetPendingPayments() []*PendingPayment {
+	m.Lock()
+	defer m.Unlock()
+	return convertPendingPayments(m.zrange(m.formatKey("payments", "pending"), true, 0, -1))
+}
+
+func (m *MemoryBackend) UpdateBalance(login string, amount int64) error {
+	m.Lock()
+	defer m.Unlock()
+
+	m.debitBalance(util.MakeTimestamp()/1000, login, amount)
+	return nil
+}
+
+func (m *MemoryBackend) debitBalance(ts int64, login string, amount int64) {
+	m.hincrBy(m.formatKey("miners", login), "balance", (amount * -1))
+	m.hincrBy(m.formatKey("miners", login), "pending", amount)
+	m.zincrBy(m.formatKey("balances"), float64(amount*-1), login)
+	if m.zset(m.formatKey("balances"), false)[login] == 0 {
+		m.zrem(m.formatKey("balances"), login)
+	}
+	m.hincrBy(m.formatKey("finances"), "balance", (amount * -1))
+	m.hincrBy(m.formatKey("finances"), "pending", amount)
+	m.zadd(m.formatKey("payments", "pending"), float64(ts), join(login, amount))
+}
+
+func (m *MemoryBackend) RollbackBalance(login string, amount int64) error {
+	m.Lock()
+	defer m.Unlock()
+	m.rollbackBalance(login, amount)
+	return nil
+}
+
+func (m *MemoryBackend) rollbackBalance(login string, amount int64) {
+	m.hincrBy(m.formatKey("miners", login), "balance", amount)
+	m.hincrBy(m.formatKey("miners", login), "pending", (amount * -1))
+	m.zincrBy(m.formatKey("balances"), float64(amount), login)
+	m.hincrBy(m.formatKey("finances"), "balance", amount)
+	m.hincrBy(m.formatKey("finances"), "pending", (amount * -1))
+	m.zrem(m.formatKey("payments", "pending"), join(login, amount))
+}
+
+func (m *MemoryBackend) WritePayment(login, txHash string, amount int64) error {
+	m.Lock()
+	defer m.Unlock()
+
+	m.writePayment(util.MakeTimestamp()/1000, login, txHash, amount)
+	m.del(m.formatKey("payments", "lock"))
+	return nil
+}
+
+func (m *MemoryBackend) writePayment(ts int64, login, txHash string, amount int64) {
+	m.hincrBy(m.formatKey("miners", login), "pending", (amount * -1))
+	m.hincrBy(m.formatKey("miners", login), "paid", amount)
+	m.hincrBy(m.formatKey("finances"), "pending", (amount * -1))
+	m.hincrBy(m.formatKey("finances"), "paid", amount)
+	m.zadd(m.formatKey("payments", "all"), float64(ts), join(txHash, login, amount))
+	m.zadd(m.formatKey("payments", login), float64(ts), join(txHash, amount))
+	m.zrem(m.formatKey("payments", "pending"), join(login, amount))
+}
+
+func (m *MemoryBackend) checkPayoutBatch(id string) error {
+	if lock, _ := m.get(m.formatKey("payments", "lock")); lock != id {
+		return fmt.Errorf("Payouts lock is held by '%s', not by batch %s", lock, id)
+	}
+	return nil
+}
+
+func (m *MemoryBackend) PlanPayoutBatch(batch *PayoutBatch) error {
+	m.Lock()
+	defer m.Unlock()
+
+	key := m.formatKey("payments", "lock")
+	if lock, ok := m.get(key); ok {
+		return fmt.Errorf("Unable to acquire lock '%s', held by '%s'", key, lock)
+	}
+	ts := util.MakeTimestamp() / 1000
+	batch.State = PayoutPlanned
+	batch.Timestamp = ts
+	batch.Updated = ts
+	m.strings[key] = batch.Id
+	m.hashes[m.formatKey("payouts", batch.Id)] = formatPayoutBatch(batch)
+	return nil
+}
+
+func (m *MemoryBackend) AdvancePayoutBatch(batch *PayoutBatch, state string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	if err := m.checkPayoutBatch(batch.Id); err != nil {
+		return err
+	}
+	key := m.formatKey("payouts", batch.Id)
+	from, _ := m.hget(key, "state")
+	if err := checkPayoutTransition(batch.Id, from, state); err != nil {
+		return err
+	}
+	ts := util.MakeTimestamp() / 1000
+	batch.State = state
+	batch.Updated = ts
+	m.hashes[key] = formatPayoutBatch(batch)
+
+	switch state {
+	case PayoutDebited:
+		for login, amount := range batch.Payees {
+			m.debitBalance(ts, login, amount)
+		}
+	case PayoutConfirmed:
+		for login, amount := range batch.Payees {
+			m.writePayment(ts, login, batch.TxHash, amount)
+		}
+		m.del(m.formatKey("payments", "lock"))
+	case PayoutFailed:
+		if from != PayoutPlanned {
+			for login, amount := range batch.Payees {
+				m.rollbackBalance(login, amount)
+			}
+		}
+		m.del(m.formatKey("payments", "lock"))
+	}
+	return nil
+}
+
+func (m *MemoryBackend) GetOpenPayoutBatch() (*PayoutBatch, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	id, ok := m.get(m.formatKey("payments", "lock"))
+	if !ok {
+		return nil, nil
+	}
+	fields := m.hgetall(m.formatKey("payouts", id))
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("Payouts are locked by '%s' which has no payout journal", id)
+	}
+	return convertPayoutBatch(id, fields), nil
+}
+
+func (m *MemoryBackend) WriteImmatureBlock(block *BlockData, roundRewards map[string]int64) error {
+	m.Lock()
+	defer m.Unlock()
+
+	err := m.writeImmatureBlock(block)
+	total := int64(0)
+	for login, amount := range roundRewards {
+		total += amount
+		m.hincrBy(m.formatKey("miners", login), "immature", amount)
+		m.hsetnx(m.formatKey("credits", "immature", block.Height, block.Hash), login, strconv.FormatInt(amount, 10))
+	}
+	m.hincrBy(m.formatKey("finances"), "immature", total)
+	return err
+}
+
+func (m *MemoryBackend) WriteMaturedBlock(block *BlockData, roundRewards map[string]int64) error {
+	m.Lock()
+	defer m.Unlock()
+
+	creditKey := m.formatKey("credits", "immature", block.RoundHeight, block.Hash)
+	immatureCredits := m.hgetall(creditKey)
+
+	ts := util.MakeTimestamp() / 1000
+	value := join(block.Hash, ts, block.Reward)
+
+	m.writeMaturedBlock(block)
+	m.zadd(m.formatKey("credits", "all"), float64(block.Height), value)
+
+	// Decrement immature balances
+	totalImmature := int64(0)
+	for login, amountString := range immatureCredits {
+		amount, _ := strconv.ParseInt(amountString, 10, 64)
+		totalImmature += amount
+		m.hincrBy(m.formatKey("miners", login), "immature", (amount * -1))
+	}
+
+	// Increment balances
+	total := int64(0)
+	for login, amount := range roundRewards {
+		total += amount
+		m.hincrBy(m.formatKey("miners", login), "balance", amount)
+		m.zincrBy(m.formatKey("balances"), float64(amount), login)
+		m.hsetnx(m.formatKey("credits", block.Height, block.Hash), login, strconv.FormatInt(amount, 10))
+	}
+	m.del(creditKey)
+	m.hincrBy(m.formatKey("finances"), "balance", total)
+	m.hincrBy(m.formatKey("finances"), "immature", (totalImmature * -1))
+	m.hset(m.formatKey("finances"), "lastCreditHeight", strconv.FormatInt(block.Height, 10))
+	m.hset(m.formatKey("finances"), "lastCreditHash", block.Hash)
+	m.hincrBy(m.formatKey("finances"), "totalMined", block.RewardInShannon())
+	return nil
+}
+
+func (m *MemoryBackend) WriteReserveBlock(block *BlockData, txFees int64) error {
+	m.Lock()
+	defer m.Unlock()
+
+	ts := util.MakeTimestamp() / 1000
+	value := join(block.Hash, ts, block.Reward)
+	amount := block.Reward.Int64()
+	if block.ExtraReward != nil {
+		amount += block.ExtraReward.Int64()
+	}
+
+	m.writeMaturedBlock(block)
+	m.zadd(m.formatKey("credits", "all"), float64(block.Height), value)
+	m.hincrBy(m.formatKey("finances"), "reserve", amount)
+	m.hincrBy(m.formatKey("finances"), "reserveBlocks", 1)
+	m.hincrBy(m.formatKey("finances"), "txFees", txFees)
+	m.hset(m.formatKey("finances"), "lastCreditHeight", strconv.FormatInt(block.Height, 10))
+	m.hset(m.formatKey("finances"), "lastCreditHash", block.Hash)
+	m.hincrBy(m.formatKey("finances"), "totalMined", block.RewardInShannon())
+	return nil
+}
+
+func (m *MemoryBackend) GetAverageTxFees() (int64, error) {
+	m.Lock()
+	defer m.Unlock()
+	return averageTxFees(m.hgetall(m.formatKey("finances"))), nil
+}
+
+func (m *MemoryBackend) WriteOrphan(block *BlockData) error {
+	m.Lock()
+	defer m.Unlock()
+
+	creditKey := m.formatKey("credits", "immature", block.RoundHeight, block.Hash)
+	immatureCredits := m.hgetall(creditKey)
+
+	m.writeMaturedBlock(block)
+
+	// Decrement immature balances
+	totalImmature := int64(0)
+	for login, amountString := range immatureCredits {
+		amount, _ := strconv.ParseInt(amountString, 10, 64)
+		totalImmature += amount
+		m.hincrBy(m.formatKey("miners", login), "immature", (amount * -1))
+	}
+	m.del(creditKey)
+	m.hincrBy(m.formatKey("finances"), "immature", (totalImmature * -1))
+	return nil
+}
+
+// Like MULTI, remaining blocks are written even if round of one of them is missing
+func (m *MemoryBackend) WritePendingOrphans(blocks []*BlockData) error {
+	m.Lock()
+	defer m.Unlock()
+
+	var result error
+	for _, block := range blocks {
+		if err := m.writeImmatureBlock(block); err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
+
+func (m *MemoryBackend) writeImmatureBlock(block *BlockData) error {
+	var err error
+	if block.Height != block.RoundHeight {
+		err = m.rename(m.formatRound(block.RoundHeight, block.Nonce), m.formatRound(block.Height, block.Nonce))
+	}
+	m.zrem(m.formatKey("blocks", "candidates"), block.candidateKey)
+	m.zadd(m.formatKey("blocks", "immature"), float64(block.Height), block.key())
+	return err
+}
+
+func (m *MemoryBackend) writeMaturedBlock(block *BlockData) {
+	m.del(m.formatRound(block.RoundHeight, block.Nonce))
+	m.del(m.formatKey("window", block.Nonce))
+	m.zrem(m.formatKey("blocks", "immature"), block.immatureKey)
+	m.zadd(m.formatKey("blocks", "matured"), float64(block.Height), block.key())
+}
+
+func (m *MemoryBackend) GetMaturedBlocks(fromHeight int64) ([]*BlockData, error) {
+	m.Lock()
+	defer m.Unlock()
+	return convertBlockResults(m.zrangeByScore(m.formatKey("blocks", "matured"), float64(fromHeight), math.Inf(1))), nil
+}
+
+func (m *MemoryBackend) GetBlockCredits(height int64, hash string) (map[string]int64, error) {
+	m.Lock()
+	defer m.Unlock()
+	return convertCredits(m.hgetall(m.formatKey("credits", height, hash))), nil
+}
+
+func (m *MemoryBackend) GetPayments(since int64) ([]*Payment, error) {
+	m.Lock()
+	defer m.Unlock()
+	return convertPayments(m.zrangeByScore(m.formatKey("payments", "all"), float64(since), math.Inf(1))), nil
+}
+
+func (m *MemoryBackend) GetAccountingSnapshot() (*AccountingSnapshot, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	s := newAccountingSnapshot()
+	for k, v := range m.hgetall(m.formatKey("finances")) {
+		s.Finances[k], _ = strconv.ParseInt(v, 10, 64)
+	}
+	for _, v := range m.zrange(m.formatKey("payments", "pending"), false, 0, -1) {
+		s.addPayment(true, v.Member.(string))
+	}
+	for _, v := range m.zrange(m.formatKey("payments", "all"), false, 0, -1) {
+		s.addPayment(false, v.Member.(string))
+	}
+	s.Balances = convertBalances(m.zrange(m.formatKey("balances"), false, 0, -1))
+	for _, key := range m.keys(m.formatKey("miners", "")) {
+		s.addMiner(strings.Split(key, ":")[2], m.hgetall(key))
+	}
+	for _, key := range m.keys(m.formatKey("credits", "")) {
+		if key != m.formatKey("credits", "all") {
+			s.addCredits(strings.Split(key, ":")[2] == "immature", m.hgetall(key))
+		}
+	}
+	return s, nil
+}
+
+func (m *MemoryBackend) WriteAuditResult(mismatches []*AuditMismatch, blockPayouts bool) error {
+	report, err := json.Marshal(mismatches)
+	if err != nil {
+		return err
+	}
+	m.Lock()
+	defer m.Unlock()
+
+	ts := util.MakeTimestamp() / 1000
+
+	m.hset(m.formatKey("audit"), "lastRun", strconv.FormatInt(ts, 10))
+	m.hset(m.formatKey("audit"), "mismatches", strconv.Itoa(len(mismatches)))
+	m.hset(m.formatKey("audit"), "report", string(report))
+	m.hset(m.formatKey("audit"), "blocked", join(blockPayouts && len(mismatches) > 0))
+	return nil
+}
+
+func (m *MemoryBackend) IsPayoutsBlocked() (bool, error) {
+	m.Lock()
+	defer m.Unlock()
+	v, _ := m.hget(m.formatKey("audit"), "blocked")
+	return v == "1", nil
+}
+
+func (m *MemoryBackend) IsMinerExists(login string) (bool, error) {
+	m.Lock()
+	defer m.Unlock()
+	return m.exists(m.formatKey("miners", login)), nil
+}
+
+func (m *MemoryBackend) GetMinerStats(login string, maxPayments int64) (map[string]interface{}, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	stats := make(map[string]interface{})
+	stats["stats"] = convertStringMap(m.hgetall(m.formatKey("miners", login)))
+	stats["payments"] = convertPaymentsResults(m.zrange(m.formatKey("payments", login), true, 0, maxPayments-1))
+	stats["paymentsTotal"] = m.zcard(m.formatKey("payments", login))
+	v, _ := m.hget(m.formatKey("shares", "roundCurrent"), login)
+	roundShares, _ := strconv.ParseInt(v, 10, 64)
+	stats["roundShares"] = roundShares
+	v, _ = m.hget(m.formatSoloRound(login), login)
+	soloShares, _ := strconv.ParseInt(v, 10, 64)
+	stats["soloRoundShares"] = soloShares
+	return stats, nil
+}
+
+func (m *MemoryBackend) FlushStaleStats(window, largeWindow time.Duration) (int64, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	now := util.MakeTimestamp() / 1000
+	total := m.zremRangeByScore(m.formatKey("hashrate"), float64(now-int64(window/time.Second)))
+	max := float64(now - int64(largeWindow/time.Second))
+	for _, key := range m.keys(m.formatKey("hashrate", "")) {
+		total += m.zremRangeByScore(key, max)
+	}
+	return total, nil
+}
+
+func (m *MemoryBackend) CollectStats(smallWindow time.Duration, maxBlocks, maxPayments int64) (map[string]interface{}, error) {
+	window := int64(smallWindow / time.Second)
+	stats := make(map[string]interface{})
+
+	m.Lock()
+	defer m.Unlock()
+
+	now := util.MakeTimestamp() / 1000
+	m.zremRangeByScore(m.formatKey("hashrate"), float64(now-window))
+
+	stats["stats"] = convertStringMap(m.hgetall(m.formatKey("stats")))
+
+	stats["rejects"] = convertRejectResults(m.zrange(m.formatKey("blocks", "rejects"), true, 0, -1))
+	stats["rejectsTotal"] = m.zcard(m.formatKey("blocks", "rejects"))
+
+	stats["finances"] = convertStringMap(m.hgetall(m.formatKey("finances")))
+
+	stats["candidates"] = convertCandidateResults(m.zrange(m.formatKey("blocks", "candidates"), true, 0, -1))
+	stats["candidatesTotal"] = m.zcard(m.formatKey("blocks", "candidates"))
+
+	stats["immature"] = convertBlockResults(m.zrange(m.formatKey("blocks", "immature"), true, 0, -1))
+	stats["immatureTotal"] = m.zcard(m.formatKey("blocks", "immature"))
+
+	stats["matured"] = convertBlockResults(m.zrange(m.formatKey("blocks", "matured"), true, 0, maxBlocks-1))
+	stats["maturedTotal"] = m.zcard(m.formatKey("blocks", "matured"))
+
+	stats["payments"] = convertPaymentsResults(m.zrange(m.formatKey("payments", "all"), true, 0, maxPayments-1))
+	stats["paymentsTotal"] = m.zcard(m.formatKey("payments", "all"))
+
+	totalHashrate, miners := convertMinersStats(window, m.zrange(m.formatKey("hashrate"), false, 0, -1))
+	stats["miners"] = miners
+	stats["minersTotal"] = len(miners)
+	stats["hashrate"] = totalHashrate
+	return stats, nil
+}
+
+func (m *MemoryBackend) CollectWorkersStats(sWindow, lWindow time.Duration, login string) (map[string]interface{}, error) {
+	smallWindow := int64(sWindow / time.Second)
+	largeWindow := int64(lWindow / time.Second)
+
+	m.Lock()
+	defer m.Unlock()
+
+	now := util.MakeTimestamp() / 1000
+	m.zremRangeByScore(m.formatKey("hashrate", login), float64(now-largeWindow))
+	shares := m.zrange(m.formatKey("hashrate", login), false, 0, -1)
+	reports := m.hgetall(m.formatKey("report", login))
+	return buildWorkersStats(now, smallWindow, largeWindow, shares, reports), nil
+}
+
+func (m *MemoryBackend) CollectLuckStats(windows []int) (map[string]interface{}, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	max := int64(windows[len(windows)-1])
+	blocks := convertBlockResults(
+		m.zrange(m.formatKey("blocks", "immature"), true, 0, -1),
+		m.zrange(m.formatKey("blocks", "matured"), true, 0, max-1),
+	)
+	return buildLuckStats(windows, blocks), nil
+}
+
+func (m *MemoryBackend) CollectShares(from, to int64) (map[string]map[string]*ShareTotal, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	result := make(map[string]map[string]*ShareTotal)
+	for _, key := range m.keys(m.formatKey("hashrate", "")) {
+		// Score range is inclusive, share timestamps are whole seconds
+		shares := m.zrangeByScore(key, float64(from), float64(to-1))
+		convertShareTotals(strings.Split(key, ":")[2], shares, result)
+	}
+	return result, nil
+}
+
+func (m *MemoryBackend) WriteHistory(tier string, retention time.Duration, bucket *HistoryBucket) error {
+	m.Lock()
+	defer m.Unlock()
+
+	ts := bucket.Timestamp
+	cutoff := float64(ts - int64(retention/time.Second))
+
+	write := func(key string, members ...string) {
+		for member, score := range m.zset(key, false) {
+			if score == float64(ts) {
+				m.zrem(key, member)
+			}
+		}
+		for _, member := range members {
+			m.zadd(key, float64(ts), member)
+		}
+		m.zremRangeByScore(key, cutoff)
+		m.expire(key, retention)
+	}
+	write(m.formatKey("history", tier, "pool"), encodeHistoryPoint(ts, bucket.Pool))
+	for login, p := range bucket.Miners {
+		write(m.formatKey("history", tier, "miners", login), encodeHistoryPoint(ts, p))
+	}
+	for login, workers := range bucket.Workers {
+		members := make([]string, 0, len(workers))
+		for id, p := range workers {
+			members = append(members, join(id, encodeHistoryPoint(ts, p)))
+		}
+		write(m.formatKey("history", tier, "workers", login), members...)
+	}
+	return nil
+}
+
+func (m *MemoryBackend) GetHistory(tier string, from, to int64) (*HistorySeries, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	max := float64(to - 1)
+	s := NewHistorySeries()
+	s.Pool = convertHistoryPoints(m.zrangeByScore(m.formatKey("history", tier, "pool"), float64(from), max))
+	for _, key := range m.keys(m.formatKey("history", tier, "miners", "")) {
+		if points := convertHistoryPoints(m.zrangeByScore(key, float64(from), max)); len(points) > 0 {
+			s.Miners[strings.Split(key, ":")[4]] = points
+		}
+	}
+	for _, key := range m.keys(m.formatKey("history", tier, "workers", "")) {
+		s.addWorkers(strings.Split(key, ":")[4], m.zrangeByScore(key, float64(from), max))
+	}
+	return s, nil
+}
+
+func (m *MemoryBackend) GetPoolHistory(tier string, from int64) ([]*HistoryPoint, error) {
+	m.Lock()
+	defer m.Unlock()
+	return convertHistoryPoints(m.zrangeByScore(m.formatKey("history", tier, "pool"), float64(from), math.Inf(1))), nil
+}
+
+func (m *MemoryBackend) GetMinerHistory(tier, login string, from int64) ([]*HistoryPoint, map[string][]*HistoryPoint, error) {
+	m.Lock()
+	defer m.Unlock()
+	miner := convertHistoryPoints(m.zrangeByScore(m.formatKey("history", tier, "miners", login), float64(from), math.Inf(1)))
+	workers := convertWorkerHistory(m.zrangeByScore(m.formatKey("history", tier, "workers", login), float64(from), math.Inf(1)))
+	return miner, workers, nil
+}
+
+// Primitives below expect the lock to be held, keys are expired lazily on access
+
+func (m *MemoryBackend) evict(key string) {
+	if deadline, ok := m.expires[key]; ok && !time.Now().Before(deadline) {
+		m.del(key)
+	}
+}
+
+func (m *MemoryBackend) exists(key string) bool {
+	m.evict(key)
+	if _, ok := m.strings[key]; ok {
+		return true
+	}
+	if _, ok := m.hashes[key]; ok {
+		return true
+	}
+	if _, ok := m.zsets[key]; ok {
+		return true
+	}
+	_, ok := m.sets[key]
+	return ok
+}
+
+func (m *MemoryBackend) del(key string) {
+	delete(m.strings, key)
+	delete(m.hashes, key)
+	delete(m.zsets, key)
+	delete(m.sets, key)
+	delete(m.expires, key)
+}
+
+// Non-positive timeout deletes the key, same as in redis
+func (m *MemoryBackend) expire(key string, timeout time.Duration) {
+	if !m.exists(key) {
+		return
+	}
+	if timeout <= 0 {
+		m.del(key)
+		return
+	}
+	m.expires[key] = time.Now().Add(timeout)
+}
+
+func (m *MemoryBackend) rename(src, dst string) error {
+	if !m.exists(src) {
+		return errors.New("ERR no such key")
+	}
+	if src == dst {
+		return nil
+	}
+	m.del(dst)
+	if v, ok := m.strings[src]; ok {
+		m.strings[dst] = v
+	}
+	if v, ok := m.hashes[src]; ok {
+		m.hashes[dst] = v
+	}
+	if v, ok := m.zsets[src]; ok {
+		m.zsets[dst] = v
+	}
+	if v, ok := m.sets[src]; ok {
+		m.sets[dst] = v
+	}
+	if v, ok := m.expires[src]; ok {
+		m.expires[dst] = v
+	}
+	m.del(src)
+	return nil
+}
+
+// Live keys starting with prefix, like SCAN with "prefix*" pattern
+func (m *MemoryBackend) keys(prefix string) []string {
+	var result []string
+	collect := func(key string) {
+		if strings.HasPrefix(key, prefix) && m.exists(key) {
+			result = append(result, key)
+		}
+	}
+	for key := range m.strings {
+		collect(key)
+	}
+	for key := range m.hashes {
+		collect(key)
+	}
+	for key := range m.zsets {
+		collect(key)
+	}
+	for key := range m.sets {
+		collect(key)
+	}
+	return result
+}
+
+func (m *MemoryBackend) get(key string) (string, bool) {
+	m.evict(key)
+	v, ok := m.strings[key]
+	return v, ok
+}
+
+func (m *MemoryBackend) hash(key string, create bool) map[string]string {
+	m.evict(key)
+	h, ok := m.hashes[key]
+	if !ok && create {
+		h = make(map[string]string)
+		m.hashes[key] = h
+	}
+	return h
+}
+
+func (m *MemoryBackend) hget(key, field string) (string, bool) {
+	v, ok := m.hash(key, false)[field]
+	return v, ok
+}
+
+func (m *MemoryBackend) hgetall(key string) map[string]string {
+	result := make(map[string]string)
+	for k, v := range m.hash(key, false) {
+		result[k] = v
+	}
+	return result
+}
+
+func (m *MemoryBackend) hset(key, field, value string) {
+	m.hash(key, true)[field] = value
+}
+
+func (m *MemoryBackend) hsetnx(key, field, value string) {
+	h := m.hash(key, true)
+	if _, ok := h[field]; !ok {
+		h[field] = value
+	}
+}
+
+func (m *MemoryBackend) hdel(key, field string) {
+	h := m.hash(key, false)
+	delete(h, field)
+	if h != nil && len(h) == 0 {
+		m.del(key)
+	}
+}
+
+func (m *MemoryBackend) hincrBy(key, field string, n int64) int64 {
+	h := m.hash(key, true)
+	v, _ := strconv.ParseInt(h[field], 10, 64)
+	v += n
+	h[field] = strconv.FormatInt(v, 10)
+	return v
+}
+
+func (m *MemoryBackend) zset(key string, create bool) map[string]float64 {
+	m.evict(key)
+	z, ok := m.zsets[key]
+	if !ok && create {
+		z = make(map[string]float64)
+		m.zsets[key] = z
+	}
+	return z
+}
+
+// Returns true if member is new
+func (m *MemoryBackend) zadd(key string, score float64, member string) bool {
+	z := m.zset(key, true)
+	_, ok := z[member]
+	z[member] = score
+	return !ok
+}
+
+func (m *MemoryBackend) zincrBy(key string, n float64, member string) {
+	m.zset(key, true)[member] += n
+}
+
+func (m *MemoryBackend) zrem(key, member string) {
+	z := m.zset(key, false)
+	delete(z, member)
+	if z != nil && len(z) == 0 {
+		m.del(key)
+	}
+}
+
+func (m *MemoryBackend) zcard(key string) int64 {
+	return int64(len(m.zset(key, false)))
+}
+
+// Removes members with score less than max, same as ZREMRANGEBYSCORE key -inf (max
+func (m *MemoryBackend) zremRangeByScore(key string, max float64) int64 {
+	z := m.zset(key, false)
+	n := int64(0)
+	for member, score := range z {
+		if score < max {
+			delete(z, member)
+			n++
+		}
+	}
+	if z != nil && len(z) == 0 {
+		m.del(key)
+	}
+	return n
+}
+
+// Removes lowest ranked members up to stop, same as ZREMRANGEBYRANK key 0 stop for negative stop
+func (m *MemoryBackend) zremRangeByRank(key string, stop int64) int64 {
+	z := m.zset(key, false)
+	n := int64(len(z)) + stop + 1
+	if n <= 0 {
+		return 0
+	}
+	for _, v := range m.sorted(key)[:n] {
+		delete(z, v.Member.(string))
+	}
+	if len(z) == 0 {
+		m.del(key)
+	}
+	return n
+}
+
+// Members ordered by score then by member, like redis does
+func (m *MemoryBackend) sorted(key string) []redis.Z {
+	z := m.zset(key, false)
+	result := make([]redis.Z, 0, len(z))
+	for member, score := range z {
+		result = append(result, redis.Z{Score: score, Member: member})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Score != result[j].Score {
+			return result[i].Score < result[j].Score
+		}
+		return result[i].Member.(string) < result[j].Member.(string)
+	})
+	return result
+}
+
+// Inclusive range by rank, negative indexes count from the end as in ZRANGE and ZREVRANGE
+func (m *MemoryBackend) zrange(key string, rev bool, start, stop int64) []redis.Z {
+	all := m.sorted(key)
+	if rev {
+		for i, j := 0, len(all)-1; i < j; i, j = i+1, j-1 {
+			all[i], all[j] = all[j], all[i]
+		}
+	}
+	n := int64(len(all))
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= n {
+		stop = n - 1
+	}
+	if start > stop {
+		return []redis.Z{}
+	}
+	return all[start : stop+1]
+}
+
+// Inclusive range by score
+func (m *MemoryBackend) zrangeByScore(key string, min, max float64) []redis.Z {
+	var result []redis.Z
+	for _, v := range m.sorted(key) {
+		if v.Score >= min && v.Score <= max {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+func (m *MemoryBackend) sadd(key, member string) {
+	m.evict(key)
+	s, ok := m.sets[key]
+	if !ok {
+		s = make(map[string]struct{})
+		m.sets[key] = s
+	}
+	s[member] = struct{}{}
+}
+
+func (m *MemoryBackend) smembers(key string) []string {
+	m.evict(key)
+	result := []string{}
+	for member := range m.sets[key] {
+		result = append(result, member)
+	}
+	return result
+}
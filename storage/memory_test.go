@@ -0,0 +1,505 @@
+package storage
+
+import (
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sammy007/open-ethereum-pool/util"
+)
+
+func TestMemoryWriteShares(t *testing.T) {
+	m := NewMemoryBackend(prefix)
+
+	shares := []*Share{{Login: "x", Id: "x", Diff: 10, Height: 1008, Timestamp: util.MakeTimestamp()}}
+	m.WriteShares("1", shares, 0)
+	m.WriteShares("1", shares, 0)
+	if v, _ := m.hget(m.formatKey("shares", "roundCurrent"), "x"); v != "10" {
+		t.Errorf("Must credit replayed batch once: %v", v)
+	}
+	// Zero expiration deletes hashrate entries immediately, same as redis
+	if m.exists(m.formatKey("hashrate", "x")) {
+		t.Error("Must expire miner hashrate")
+	}
+}
+
+func writeShare(m *MemoryBackend, login, id string, diff int64) {
+	m.WriteShares(newBatchId(), []*Share{{Login: login, Id: id, Diff: diff, Height: 1000, Timestamp: util.MakeTimestamp()}}, time.Hour)
+}
+
+func TestMemoryBlockLifecycle(t *testing.T) {
+	m := NewMemoryBackend(prefix)
+
+	writeShare(m, "x", "x", 100)
+	m.WriteShares("3", []*Share{{Login: "y", Id: "y", Diff: 300, Height: 1000, Timestamp: time.Now().UnixNano() / 1e6}}, time.Hour)
+	_, err := m.WriteBlock("x", "x", []string{"0x1", "0x2", "0x3"}, 100, 1000, 0, false, 1000, time.Hour, []string{"main"}, nil)
+	if err != nil {
+		t.Fatalf("Failed to write block: %v", err)
+	}
+
+	candidates, _ := m.GetCandidates(1000)
+	if len(candidates) != 1 || candidates[0].TotalShares != 500 {
+		t.Fatalf("Must write candidate with round shares: %+v", candidates)
+	}
+	shares, _ := m.GetRoundShares(1000, "0x1")
+	if !reflect.DeepEqual(shares, map[string]int64{"x": 200, "y": 300}) {
+		t.Errorf("Invalid round shares: %v", shares)
+	}
+	if m.exists(m.formatKey("shares", "roundCurrent")) {
+		t.Error("Must start new round")
+	}
+
+	// Block was included one block later
+	block := candidates[0]
+	block.Height = 1001
+	block.RoundHeight = 1000
+	block.Hash = "0xa"
+	block.Reward = big.NewInt(5e18)
+	rewards := map[string]int64{"x": 2e9, "y": 3e9}
+	if err := m.WriteImmatureBlock(block, rewards); err != nil {
+		t.Fatalf("Failed to write immature block: %v", err)
+	}
+	if candidates, _ := m.GetCandidates(2000); len(candidates) != 0 {
+		t.Error("Must remove candidate")
+	}
+	shares, _ = m.GetRoundShares(1001, "0x1")
+	if len(shares) != 2 {
+		t.Errorf("Must move round shares to block height: %v", shares)
+	}
+
+	immature, _ := m.GetImmatureBlocks(2000)
+	if len(immature) != 1 {
+		t.Fatalf("Must write immature block: %+v", immature)
+	}
+	block = immature[0]
+	block.RoundHeight = 1001
+	block.Reward = big.NewInt(5e18)
+	if err := m.WriteMaturedBlock(block, rewards); err != nil {
+		t.Fatalf("Failed to write matured block: %v", err)
+	}
+	if immature, _ := m.GetImmatureBlocks(2000); len(immature) != 0 {
+		t.Error("Must remove immature block")
+	}
+	if balance, _ := m.GetBalance("y"); balance != 3e9 {
+		t.Errorf("Invalid balance: %v", balance)
+	}
+	if v, _ := m.hget(m.formatKey("miners", "y"), "immature"); v != "0" {
+		t.Errorf("Must decrement immature balance: %v", v)
+	}
+	finances := m.hgetall(m.formatKey("finances"))
+	if finances["balance"] != "5000000000" || finances["immature"] != "0" || finances["totalMined"] != "50000000000" {
+		t.Errorf("Invalid finances: %v", finances)
+	}
+	if len(m.hgetall(m.formatRound(1001, "0x1"))) != 0 {
+		t.Error("Must remove round shares")
+	}
+}
+
+func TestMemoryPendingOrphansMissingRound(t *testing.T) {
+	m := NewMemoryBackend(prefix)
+
+	m.zadd(m.formatKey("blocks", "candidates"), 10, "a")
+	m.zadd(m.formatKey("blocks", "candidates"), 20, "b")
+	blocks := []*BlockData{
+		{Height: 11, RoundHeight: 10, Nonce: "0x1", candidateKey: "a"},
+		{Height: 20, RoundHeight: 20, Nonce: "0x2", candidateKey: "b"},
+	}
+	// Like MULTI, failed rename doesn't roll back other writes
+	if err := m.WritePendingOrphans(blocks); err == nil {
+		t.Error("Must fail to rename missing round")
+	}
+	if n := m.zcard(m.formatKey("blocks", "candidates")); n != 0 {
+		t.Errorf("Must remove all candidates, left: %v", n)
+	}
+	if n := m.zcard(m.formatKey("blocks", "immature")); n != 2 {
+		t.Errorf("Must write all immature blocks, got: %v", n)
+	}
+}
+
+func TestMemoryPayouts(t *testing.T) {
+	m := NewMemoryBackend(prefix)
+
+	m.hincrBy(m.formatKey("miners", "x"), "balance", 250)
+	m.hincrBy(m.formatKey("miners", "y"), "balance", 0)
+	// Lock left by a payout without journal
+	m.strings[m.formatKey("payments", "lock")] = "x:250"
+	m.UpdateBalance("x", 250)
+	pending := m.GetPendingPayments()
+	if len(pending) != 1 || pending[0].Address != "x" || pending[0].Amount != 250 {
+		t.Errorf("Invalid pending payments: %+v", pending)
+	}
+
+	m.WritePayment("x", "0x0", 250)
+	if locked, _ := m.IsPayoutsLocked(); locked {
+		t.Error("Must unlock payouts")
+	}
+	if len(m.GetPendingPayments()) != 0 {
+		t.Error("Must remove pending payment")
+	}
+	stats := m.hgetall(m.formatKey("miners", "x"))
+	if stats["balance"] != "0" || stats["pending"] != "0" || stats["paid"] != "250" {
+		t.Errorf("Invalid miner stats: %v", stats)
+	}
+	minerStats, _ := m.GetMinerStats("x", 10)
+	if minerStats["paymentsTotal"] != int64(1) {
+		t.Errorf("Must count payment: %v", minerStats["paymentsTotal"])
+	}
+}
+
+func TestMemoryCollectStats(t *testing.T) {
+	m := NewMemoryBackend(prefix)
+
+	writeShare(m, "x", "rig", 100)
+	m.WriteReject(1000)
+	m.WriteNodeState("main", 1000, big.NewInt(100))
+	m.WriteNodeDetails("main", "upstreams", []string{"a"})
+
+	stats, err := m.CollectStats(10*time.Minute, 10, 10)
+	if err != nil {
+		t.Fatalf("Failed to collect stats: %v", err)
+	}
+	if stats["minersTotal"] != 1 || stats["rejectsTotal"] != int64(1) {
+		t.Errorf("Invalid stats: %v", stats)
+	}
+	workers, _ := m.CollectWorkersStats(10*time.Minute, 3*time.Hour, "x")
+	if workers["workersTotal"] != 1 {
+		t.Errorf("Invalid workers stats: %v", workers)
+	}
+	nodes, _ := m.GetNodeStates()
+	if len(nodes) != 1 || !reflect.DeepEqual(nodes[0]["upstreams"], []interface{}{"a"}) {
+		t.Errorf("Invalid node states: %v", nodes)
+	}
+}
+
+func TestMemoryAccountingAudit(t *testing.T) {
+	m := NewMemoryBackend(prefix)
+
+	writeShare(m, "x", "x", 100)
+	m.WriteBlock("x", "x", []string{"0x1", "0x2", "0x3"}, 100, 1000, 0, false, 1000, time.Hour, nil, nil)
+	candidates, _ := m.GetCandidates(1000)
+	block := candidates[0]
+	block.Hash = "0xa"
+	block.Reward = big.NewInt(5e18)
+	rewards := map[string]int64{"x": 4e9, "y": 1e9}
+	m.WriteImmatureBlock(block, rewards)
+
+	snapshot, _ := m.GetAccountingSnapshot()
+	if mismatches := snapshot.Audit(); len(mismatches) != 0 {
+		t.Errorf("Books must balance with immature block: %v", mismatches)
+	}
+
+	immature, _ := m.GetImmatureBlocks(1000)
+	block = immature[0]
+	block.Reward = big.NewInt(5e18)
+	m.WriteMaturedBlock(block, rewards)
+	m.UpdateBalance("x", 3e9)
+	m.WritePayment("x", "0xf", 3e9)
+	m.UpdateBalance("y", 1e9)
+
+	snapshot, _ = m.GetAccountingSnapshot()
+	if mismatches := snapshot.Audit(); len(mismatches) != 0 {
+		t.Errorf("Books must balance after payouts: %v", mismatches)
+	}
+
+	m.hincrBy(m.formatKey("miners", "y"), "balance", 5)
+	snapshot, _ = m.GetAccountingSnapshot()
+	mismatches := snapshot.Audit()
+	if len(mismatches) != 3 {
+		t.Fatalf("Must find drift of finances, credited balance and balance index: %v", mismatches)
+	}
+	if mismatches[0].Check != "finances.balance" || mismatches[1].Check != "credited" || mismatches[1].Login != "y" || mismatches[2].Check != "balanceIndex" {
+		t.Errorf("Invalid mismatches: %v", mismatches)
+	}
+
+	m.WriteAuditResult(mismatches, true)
+	if blocked, _ := m.IsPayoutsBlocked(); !blocked {
+		t.Error("Must block payouts")
+	}
+	m.WriteAuditResult(nil, true)
+	if blocked, _ := m.IsPayoutsBlocked(); blocked {
+		t.Error("Must unblock payouts once books balance")
+	}
+}
+
+func TestMemoryHistory(t *testing.T) {
+	m := NewMemoryBackend(prefix)
+
+	ts := int64(1500000000)
+	m.WriteShares("4", []*Share{
+		{Login: "x", Id: "a", Diff: 100, Timestamp: ts * 1000},
+		{Login: "x", Id: "a", Diff: 100, Timestamp: (ts + 599) * 1000},
+		{Login: "x", Id: "b", Diff: 100, Timestamp: (ts + 600) * 1000},
+	}, time.Hour)
+	shares, _ := m.CollectShares(ts, ts+600)
+	if len(shares["x"]) != 1 || *shares["x"]["a"] != (ShareTotal{Difficulty: 200, Count: 2}) {
+		t.Errorf("Must collect shares within bucket only: %v", shares["x"])
+	}
+
+	bucket := &HistoryBucket{
+		Timestamp: ts,
+		Pool:      &HistoryPoint{Hashrate: 1, Shares: 2, Miners: 1, Workers: 1},
+		Miners:    map[string]*HistoryPoint{"x": {Hashrate: 1, Shares: 2, Workers: 1}},
+		Workers:   map[string]map[string]*HistoryPoint{"x": {"a": {Hashrate: 1, Shares: 2}}},
+	}
+	m.WriteHistory("10m", time.Hour, bucket)
+	bucket.Pool.Hashrate = 3
+	m.WriteHistory("10m", time.Hour, bucket)
+	pool, _ := m.GetPoolHistory("10m", 0)
+	if len(pool) != 1 || pool[0].Hashrate != 3 || pool[0].Timestamp != ts {
+		t.Errorf("Must rewrite point of the same bucket: %+v", pool)
+	}
+
+	bucket.Timestamp = ts + 4200
+	bucket.Workers["x"]["b"] = &HistoryPoint{Hashrate: 5}
+	m.WriteHistory("10m", time.Hour, bucket)
+	pool, _ = m.GetPoolHistory("10m", 0)
+	if len(pool) != 1 || pool[0].Timestamp != ts+4200 {
+		t.Errorf("Must trim points older than retention: %+v", pool)
+	}
+	miner, workers, _ := m.GetMinerHistory("10m", "x", 0)
+	if len(miner) != 1 || len(workers) != 2 || workers["b"][0].Hashrate != 5 {
+		t.Errorf("Invalid miner history: %+v %+v", miner, workers)
+	}
+
+	series, _ := m.GetHistory("10m", ts+4200, ts+4800)
+	if len(series.Pool) != 1 || len(series.Miners["x"]) != 1 || len(series.Workers["x"]) != 2 {
+		t.Errorf("Invalid history series: %+v", series)
+	}
+	series, _ = m.GetHistory("10m", ts+4800, ts+5400)
+	if len(series.Pool) != 0 || len(series.Miners) != 0 || len(series.Workers) != 0 {
+		t.Errorf("Must return nothing out of range: %+v", series)
+	}
+}
+
+func TestMemoryPayeesAbove(t *testing.T) {
+	m := NewMemoryBackend(prefix)
+
+	block := &BlockData{Height: 1000, RoundHeight: 1000, Hash: "0xa", Reward: big.NewInt(5e18)}
+	m.WriteMaturedBlock(block, map[string]int64{"x": 1000, "y": 250})
+	payees, _ := m.GetPayeesAbove(250)
+	if !reflect.DeepEqual(payees, map[string]int64{"x": 1000}) {
+		t.Errorf("Must skip balance at threshold: %v", payees)
+	}
+	m.UpdateBalance("x", 1000)
+	if payees, _ = m.GetPayeesAbove(0); !reflect.DeepEqual(payees, map[string]int64{"y": 250}) {
+		t.Errorf("Must drop drained balance: %v", payees)
+	}
+	if m.zcard(m.formatKey("balances")) != 1 {
+		t.Error("Must remove zero balance from index")
+	}
+	m.RollbackBalance("x", 1000)
+	if payees, _ = m.GetPayeesAbove(250); payees["x"] != 1000 {
+		t.Errorf("Must restore rolled back balance: %v", payees)
+	}
+}
+
+func TestMemoryPayoutJournal(t *testing.T) {
+	m := NewMemoryBackend(prefix)
+
+	block := &BlockData{Height: 1000, RoundHeight: 1000, Hash: "0xa", Reward: big.NewInt(5e18)}
+	m.WriteMaturedBlock(block, map[string]int64{"x": 1000, "y": 500, "z": 250})
+	first := &PayoutBatch{Id: "1-0", Payees: map[string]int64{"x": 600, "y": 500}}
+	if err := m.PlanPayoutBatch(first); err != nil {
+		t.Fatalf("Must plan batch: %v", err)
+	}
+	if err := m.PlanPayoutBatch(&PayoutBatch{Id: "1-1", Payees: map[string]int64{"z": 250}}); err == nil {
+		t.Error("Must not plan while other batch is open")
+	}
+	if err := m.AdvancePayoutBatch(first, PayoutCreated); err == nil {
+		t.Error("Must not skip debit")
+	}
+	m.AdvancePayoutBatch(first, PayoutDebited)
+	if len(m.GetPendingPayments()) != 2 {
+		t.Errorf("Invalid pending payments: %+v", m.GetPendingPayments())
+	}
+	first.RawTx = "0x01"
+	m.AdvancePayoutBatch(first, PayoutCreated)
+
+	open, err := m.GetOpenPayoutBatch()
+	if err != nil || !reflect.DeepEqual(open, first) {
+		t.Errorf("Must resume journaled batch: %+v, %v", open, err)
+	}
+	if err := m.AdvancePayoutBatch(open, PayoutFailed); err != nil {
+		t.Fatalf("Must fail batch: %v", err)
+	}
+	if payees, _ := m.GetPayeesAbove(0); payees["x"] != 1000 || payees["y"] != 500 {
+		t.Errorf("Must credit back failed batch: %v", payees)
+	}
+	if open, _ = m.GetOpenPayoutBatch(); open != nil {
+		t.Errorf("Must close failed batch: %+v", open)
+	}
+
+	second := &PayoutBatch{Id: "1-1", Payees: map[string]int64{"x": 600, "y": 500}}
+	m.PlanPayoutBatch(second)
+	m.AdvancePayoutBatch(second, PayoutDebited)
+	m.AdvancePayoutBatch(second, PayoutCreated)
+	second.TxHash = "0xf"
+	m.AdvancePayoutBatch(second, PayoutSigned)
+	if err := m.AdvancePayoutBatch(second, PayoutFailed); err == nil {
+		t.Error("Must not fail signed batch")
+	}
+	m.AdvancePayoutBatch(second, PayoutBroadcast)
+	if err := m.AdvancePayoutBatch(second, PayoutConfirmed); err != nil {
+		t.Fatalf("Must confirm batch: %v", err)
+	}
+	if locked, _ := m.IsPayoutsLocked(); locked {
+		t.Error("Must unlock payouts")
+	}
+	if len(m.GetPendingPayments()) != 0 {
+		t.Error("Must remove pending payments")
+	}
+	if payees, _ := m.GetPayeesAbove(0); !reflect.DeepEqual(payees, map[string]int64{"x": 400, "z": 250}) {
+		t.Errorf("Must keep remainder and unpaid balances: %v", payees)
+	}
+	snapshot, _ := m.GetAccountingSnapshot()
+	if mismatches := snapshot.Audit(); len(mismatches) != 0 {
+		t.Errorf("Books must balance after batches: %v", mismatches)
+	}
+
+	m.strings[m.formatKey("payments", "lock")] = "x:100"
+	if _, err := m.GetOpenPayoutBatch(); err == nil {
+		t.Error("Must refuse lock without journal")
+	}
+}
+
+func TestMemoryPPLNSWindow(t *testing.T) {
+	m := NewMemoryBackend(prefix)
+	writeShare(m, "x", "x", 100)
+	if m.exists(m.formatKey("window")) {
+		t.Fatal("Must not keep window unless PPLNS is enabled")
+	}
+
+	m.SetPPLNS(2)
+	ms := util.MakeTimestamp() - 1000
+	m.WriteShares("5", []*Share{
+		{Login: "z", Id: "a", Nonce: "0x10", Diff: 100, Timestamp: ms - 2},
+		{Login: "z", Id: "a", Nonce: "0x11", Diff: 200, Timestamp: ms - 1},
+		{Login: "y", Id: "a", Nonce: "0x12", Diff: 100, Timestamp: ms},
+		{Login: "x", Id: "a", Nonce: "0x13", Diff: 100, Timestamp: ms + 1},
+		// Equal shares of the same ms
+		{Login: "y", Id: "a", Nonce: "0x14", Diff: 25, Timestamp: ms + 2},
+		{Login: "y", Id: "a", Nonce: "0x15", Diff: 25, Timestamp: ms + 2},
+	}, time.Hour)
+	m.WriteBlock("x", "a", []string{"0x1", "0x2", "0x3"}, 100, 120, 0, false, 1000, time.Hour, nil, nil)
+
+	window, _ := m.GetWindowShares("0x1")
+	if !reflect.DeepEqual(window, map[string]int64{"x": 190, "y": 50}) {
+		t.Errorf("Must credit the oldest share partially: %v", window)
+	}
+	// Shares of two windows are kept for the next block, the oldest one is trimmed
+	if n := m.zcard(m.formatKey("window")); n != 6 {
+		t.Errorf("Must trim shares beyond retained windows, %v left", n)
+	}
+	// Round shares are kept for luck stats
+	candidates, _ := m.GetCandidates(1000)
+	if len(candidates) != 1 || candidates[0].TotalShares != 750 {
+		t.Errorf("Invalid candidate: %+v", candidates)
+	}
+
+	block := candidates[0]
+	block.Hash = "0xa"
+	block.Reward = big.NewInt(5e18)
+	m.WriteImmatureBlock(block, map[string]int64{"x": 1})
+	immature, _ := m.GetImmatureBlocks(1000)
+	immature[0].Reward = big.NewInt(5e18)
+	m.WriteMaturedBlock(immature[0], map[string]int64{"x": 1})
+	if window, _ = m.GetWindowShares("0x1"); len(window) != 0 {
+		t.Errorf("Must drop snapshot once block matured: %v", window)
+	}
+}
+
+func TestMemoryPPSReserve(t *testing.T) {
+	m := NewMemoryBackend(prefix)
+
+	ms := util.MakeTimestamp()
+	m.WriteShares("6", []*Share{
+		{Login: "x", Id: "a", Diff: 100, Timestamp: ms, Reward: 300},
+		{Login: "y", Id: "a", Diff: 100, Timestamp: ms, Stale: true},
+	}, time.Hour)
+	m.WriteBlock("x", "a", []string{"0x1", "0x2", "0x3"}, 100, 1000, 300, false, 1000, time.Hour, nil, nil)
+
+	if balance, _ := m.GetBalance("x"); balance != 600 {
+		t.Errorf("Must credit shares right away: %v", balance)
+	}
+	finances := m.hgetall(m.formatKey("finances"))
+	if finances["reserve"] != "-600" || finances["exposure"] != "" || finances["ppsCredited"] != "600" {
+		t.Errorf("Invalid finances: %v", finances)
+	}
+	snapshot, _ := m.GetAccountingSnapshot()
+	if mismatches := snapshot.Audit(); len(mismatches) != 0 {
+		t.Errorf("Books must balance with PPS credits: %v", mismatches)
+	}
+
+	candidates, _ := m.GetCandidates(1000)
+	block := candidates[0]
+	block.Hash = "0xa"
+	block.Reward = big.NewInt(1000)
+	block.ExtraReward = big.NewInt(50)
+	m.WriteImmatureBlock(block, map[string]int64{})
+	immature, _ := m.GetImmatureBlocks(1000)
+	immature[0].Reward = big.NewInt(1000)
+	immature[0].ExtraReward = big.NewInt(50)
+	m.WriteReserveBlock(immature[0], 50)
+
+	finances = m.hgetall(m.formatKey("finances"))
+	if finances["reserve"] != "450" || finances["balance"] != "600" {
+		t.Errorf("Must reconcile block into reserve: %v", finances)
+	}
+	if fees, _ := m.GetAverageTxFees(); fees != 50 {
+		t.Errorf("Invalid average tx fees: %v", fees)
+	}
+	if immature, _ = m.GetImmatureBlocks(1000); len(immature) != 0 {
+		t.Error("Must remove immature block")
+	}
+
+	m.WriteShares("7", []*Share{{Login: "x", Id: "a", Diff: 100, Timestamp: ms, Reward: 300}}, time.Hour)
+	stats, _ := m.CollectStats(time.Minute, 10, 10)
+	if f := stats["finances"].(map[string]interface{}); f["reserve"] != int64(150) || f["exposure"] != int64(300) {
+		t.Errorf("Must expose reserve in stats: %v", f)
+	}
+}
+
+func TestMemorySoloRound(t *testing.T) {
+	m := NewMemoryBackend(prefix)
+	m.SetPPLNS(2)
+
+	ms := util.MakeTimestamp()
+	m.WriteShares("8", []*Share{
+		{Login: "x", Id: "a", Diff: 100, Timestamp: ms},
+		{Login: "y", Id: "a", Diff: 200, Timestamp: ms, Solo: true},
+		{Login: "z", Id: "a", Diff: 300, Timestamp: ms, Solo: true},
+	}, time.Hour)
+	m.WriteBlock("y", "a", []string{"0x1", "0x2", "0x3"}, 100, 1000, 0, true, 1000, time.Hour, nil, nil)
+
+	shares, _ := m.GetRoundShares(1000, "0x1")
+	if !reflect.DeepEqual(shares, map[string]int64{"y": 300}) {
+		t.Errorf("Solo round must hold shares of the finder only: %v", shares)
+	}
+	if v, _ := m.hget(m.formatKey("stats"), "roundShares"); v != "100" {
+		t.Errorf("Must keep pool round running: %v", v)
+	}
+	if n := m.zcard(m.formatKey("window")); n != 1 {
+		t.Errorf("Solo shares must not go to PPLNS window, %v in window", n)
+	}
+	stats, _ := m.GetMinerStats("z", 10)
+	if stats["soloRoundShares"] != int64(300) {
+		t.Errorf("Must keep solo round of other miners: %v", stats)
+	}
+
+	candidates, _ := m.GetCandidates(1000)
+	if len(candidates) != 1 || !candidates[0].Solo || candidates[0].TotalShares != 300 {
+		t.Fatalf("Must flag solo candidate: %+v", candidates)
+	}
+	if window, _ := m.GetWindowShares("0x1"); len(window) != 0 {
+		t.Errorf("Must not snapshot window for solo block: %v", window)
+	}
+	block := candidates[0]
+	block.Hash = "0xa"
+	block.Reward = big.NewInt(5e18)
+	m.WriteImmatureBlock(block, map[string]int64{"y": 1})
+	immature, _ := m.GetImmatureBlocks(1000)
+	if len(immature) != 1 || !immature[0].Solo {
+		t.Errorf("Must keep solo flag of immature block: %+v", immature)
+	}
+}
@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Payout batch journal, states only move forward. Open batch holds the payouts lock
+// and is settled on start, balances move with the state change in the same transaction.
+const (
+	PayoutPlanned   = "planned"
+	PayoutDebited   = "debited"
+	PayoutCreated   = "created"
+	PayoutSigned    = "signed"
+	PayoutBroadcast = "broadcast"
+	PayoutConfirmed = "confirmed"
+	PayoutFailed    = "failed"
+)
+
+// Signed tx may have been broadcast already, it fails only once it is mined and failed
+var payoutTransitions = map[string][]string{
+	PayoutPlanned:   {PayoutDebited, PayoutFailed},
+	PayoutDebited:   {PayoutCreated, PayoutFailed},
+	PayoutCreated:   {PayoutSigned, PayoutFailed},
+	PayoutSigned:    {PayoutBroadcast},
+	PayoutBroadcast: {PayoutConfirmed, PayoutFailed},
+}
+
+type PayoutBatch struct {
+	Id        string           `json:"id"`
+	State     string           `json:"state"`
+	Payees    map[string]int64 `json:"payees"`
+	RawTx     string           `json:"rawTx,omitempty"`
+	SignedTx  string           `json:"signedTx,omitempty"`
+	TxHash    string           `json:"tx,omitempty"`
+	Timestamp int64            `json:"timestamp"`
+	Updated   int64            `json:"updated"`
+}
+
+func (b *PayoutBatch) Total() int64 {
+	total := int64(0)
+	for _, amount := range b.Payees {
+		total += amount
+	}
+	return total
+}
+
+func checkPayoutTransition(id, from, to string) error {
+	for _, state := range payoutTransitions[from] {
+		if state == to {
+			return nil
+		}
+	}
+	return fmt.Errorf("Payout batch %s can't move from '%s' to '%s'", id, from, to)
+}
+
+func formatPayoutBatch(b *PayoutBatch) map[string]string {
+	payees := make([]string, 0, len(b.Payees))
+	for login, amount := range b.Payees {
+		payees = append(payees, join(login, amount))
+	}
+	sort.Strings(payees)
+	return map[string]string{
+		"state":    b.State,
+		"payees":   strings.Join(payees, ","),
+		"rawTx":    b.RawTx,
+		"signedTx": b.SignedTx,
+		"tx":       b.TxHash,
+		"ts":       strconv.FormatInt(b.Timestamp, 10),
+		"updated":  strconv.FormatInt(b.Updated, 10),
+	}
+}
+
+func convertPayoutBatch(id string, fields map[string]string) *PayoutBatch {
+	b := &PayoutBatch{
+		Id:       id,
+		State:    fields["state"],
+		Payees:   make(map[string]int64),
+		RawTx:    fields["rawTx"],
+		SignedTx: fields["signedTx"],
+		TxHash:   fields["tx"],
+	}
+	b.Timestamp, _ = strconv.ParseInt(fields["ts"], 10, 64)
+	b.Updated, _ = strconv.ParseInt(fields["updated"], 10, 64)
+	for _, v := range strings.Split(fields["payees"], ",") {
+		parts := strings.Split(v, ":")
+		if len(parts) != 2 {
+			continue
+		}
+		b.Payees[parts[0]], _ = strconv.ParseInt(parts[1], 10, 64)
+	}
+	return b
+}
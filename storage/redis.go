@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"encoding/json"
 	"fmt"
 	"math/big"
 	"strconv"
@@ -17,11 +18,47 @@ type Config struct {
 	Password string `json:"password"`
 	Database int64  `json:"database"`
 	PoolSize int    `json:"poolSize"`
+
+	// Master is discovered through sentinels if set, endpoint is ignored
+	MasterName string   `json:"masterName"`
+	Sentinels  []string `json:"sentinels"`
+	// Seed nodes of redis cluster, takes precedence over endpoint and sentinels
+	Cluster []string `json:"cluster"`
+	// Wrap prefix into hash tag, so all keys land in a single slot. Always on for cluster.
+	HashTags bool `json:"hashTags"`
+}
+
+// Commands served by single node, sentinel and cluster clients
+type redisCmdable interface {
+	Ping() *redis.StatusCmd
+	BgSave() *redis.StatusCmd
+	Get(key string) *redis.StringCmd
+	Set(key string, value interface{}, expiration time.Duration) *redis.StatusCmd
+	SetNX(key string, value interface{}, expiration time.Duration) *redis.BoolCmd
+	Del(keys ...string) *redis.IntCmd
+	Exists(key string) *redis.BoolCmd
+	Keys(pattern string) *redis.StringSliceCmd
+	Scan(cursor int64, match string, count int64) *redis.ScanCmd
+	HGet(key, field string) *redis.StringCmd
+	HSet(key, field, value string) *redis.BoolCmd
+	HMSetMap(key string, fields map[string]string) *redis.StatusCmd
+	HGetAllMap(key string) *redis.StringStringMapCmd
+	SMembers(key string) *redis.StringSliceCmd
+	ZAdd(key string, members ...redis.Z) *redis.IntCmd
+	ZRank(key, member string) *redis.IntCmd
+	ZRemRangeByScore(key, min, max string) *redis.IntCmd
+	ZRangeByScoreWithScores(key string, opt redis.ZRangeByScore) *redis.ZSliceCmd
+	ZRevRangeWithScores(key string, start, stop int64) *redis.ZSliceCmd
+	ZRevRangeByScoreWithScores(key string, opt redis.ZRangeByScore) *redis.ZSliceCmd
+	Watch(keys ...string) (*redis.Multi, error)
 }
 
 type RedisClient struct {
-	client *redis.Client
-	prefix string
+	client  redisCmdable
+	prefix  string
+	cluster bool
+	// PPLNS window in network difficulties, rolling share window is kept only if set
+	pplns float64
 }
 
 type BlockData struct {
@@ -43,6 +80,13 @@ type BlockData struct {
 	RoundHeight    int64    `json:"-"`
 	candidateKey   string
 	immatureKey    string
+
+	// Upstreams answers on submission, known for candidates only
+	AcceptedBy []string `json:"acceptedBy,omitempty"`
+	RejectedBy []string `json:"rejectedBy,omitempty"`
+
+	// Found by solo miner, round shares are of the finder only
+	Solo bool `json:"solo,omitempty"`
 }
 
 func (b *BlockData) RewardInShannon() int64 {
@@ -63,7 +107,11 @@ func (b *BlockData) RoundKey() string {
 }
 
 func (b *BlockData) key() string {
-	return join(b.UncleHeight, b.Orphan, b.Nonce, b.serializeHash(), b.Timestamp, b.Difficulty, b.TotalShares, b.Reward)
+	key := join(b.UncleHeight, b.Orphan, b.Nonce, b.serializeHash(), b.Timestamp, b.Difficulty, b.TotalShares, b.Reward)
+	if b.Solo {
+		return join(key, "solo")
+	}
+	return key
 }
 
 type Miner struct {
@@ -75,21 +123,72 @@ type Miner struct {
 
 type Worker struct {
 	Miner
-	TotalHR int64 `json:"hr2"`
+	TotalHR    int64 `json:"hr2"`
+	ReportedHR int64 `json:"reportedHr"`
 }
 
 func NewRedisClient(cfg *Config, prefix string) *RedisClient {
-	client := redis.NewClient(&redis.Options{
-		Addr:     cfg.Endpoint,
-		Password: cfg.Password,
-		DB:       cfg.Database,
-		PoolSize: cfg.PoolSize,
-	})
-	return &RedisClient{client: client, prefix: prefix}
+	r := &RedisClient{prefix: prefix}
+	switch {
+	case len(cfg.Cluster) > 0:
+		r.client = redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:    cfg.Cluster,
+			Password: cfg.Password,
+			PoolSize: cfg.PoolSize,
+		})
+		r.cluster = true
+	case len(cfg.MasterName) > 0:
+		r.client = redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:    cfg.MasterName,
+			SentinelAddrs: cfg.Sentinels,
+			Password:      cfg.Password,
+			DB:            cfg.Database,
+			PoolSize:      cfg.PoolSize,
+		})
+	default:
+		r.client = redis.NewClient(&redis.Options{
+			Addr:     cfg.Endpoint,
+			Password: cfg.Password,
+			DB:       cfg.Database,
+			PoolSize: cfg.PoolSize,
+		})
+	}
+	// Transactions touch many keys, cluster executes them only if all keys share a slot
+	if r.cluster || cfg.HashTags {
+		r.prefix = "{" + prefix + "}"
+	}
+	return r
 }
 
+// Returns nil for cluster
 func (r *RedisClient) Client() *redis.Client {
-	return r.client
+	client, _ := r.client.(*redis.Client)
+	return client
+}
+
+// Cluster client has no MULTI, transaction is started on the node of the hash tag slot by watching a key nobody writes
+func (r *RedisClient) multi() (*redis.Multi, error) {
+	if !r.cluster {
+		return r.client.(*redis.Client).Multi(), nil
+	}
+	return r.client.Watch(r.formatKey("tx"))
+}
+
+// SCAN has no key to route by in cluster, so it runs on connection of the hash tag slot
+func (r *RedisClient) scan(cursor int64, match string, count int64) (int64, []string, error) {
+	if !r.cluster {
+		return r.client.Scan(cursor, match, count).Result()
+	}
+	tx, err := r.multi()
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Close()
+	return tx.Scan(cursor, match, count).Result()
+}
+
+func (r *RedisClient) SetPPLNS(n float64) {
+	r.pplns = n
 }
 
 func (r *RedisClient) Check() (string, error) {
@@ -119,12 +218,15 @@ func (r *RedisClient) GetWhitelist() ([]string, error) {
 }
 
 func (r *RedisClient) WriteNodeState(id string, height uint64, diff *big.Int) error {
-	tx := r.client.Multi()
+	tx, err := r.multi()
+	if err != nil {
+		return err
+	}
 	defer tx.Close()
 
 	now := util.MakeTimestamp() / 1000
 
-	_, err := tx.Exec(func() error {
+	_, err = tx.Exec(func() error {
 		tx.HSet(r.formatKey("nodes"), join(id, "name"), id)
 		tx.HSet(r.formatKey("nodes"), join(id, "height"), strconv.FormatUint(height, 10))
 		tx.HSet(r.formatKey("nodes"), join(id, "difficulty"), diff.String())
@@ -134,29 +236,21 @@ func (r *RedisClient) WriteNodeState(id string, height uint64, diff *big.Int) er
 	return err
 }
 
+// Stores structured node details such as notifier health, kept as JSON under a single field
+func (r *RedisClient) WriteNodeDetails(id, section string, details interface{}) error {
+	data, err := json.Marshal(details)
+	if err != nil {
+		return err
+	}
+	return r.client.HSet(r.formatKey("nodes"), join(id, section), string(data)).Err()
+}
+
 func (r *RedisClient) GetNodeStates() ([]map[string]interface{}, error) {
 	cmd := r.client.HGetAllMap(r.formatKey("nodes"))
 	if cmd.Err() != nil {
 		return nil, cmd.Err()
 	}
-	m := make(map[string]map[string]interface{})
-	for key, value := range cmd.Val() {
-		parts := strings.Split(key, ":")
-		if val, ok := m[parts[0]]; ok {
-			val[parts[1]] = value
-		} else {
-			node := make(map[string]interface{})
-			node[parts[1]] = value
-			m[parts[0]] = node
-		}
-	}
-	v := make([]map[string]interface{}, len(m), len(m))
-	i := 0
-	for _, value := range m {
-		v[i] = value
-		i++
-	}
-	return v, nil
+	return convertNodeStates(cmd.Val()), nil
 }
 
 func (r *RedisClient) checkPoWExist(height uint64, params []string) (bool, error) {
@@ -166,31 +260,57 @@ func (r *RedisClient) checkPoWExist(height uint64, params []string) (bool, error
 	return val == 0, err
 }
 
-func (r *RedisClient) WriteShare(login, id string, params []string, diff int64, height uint64, window time.Duration) (bool, error) {
-	exist, err := r.checkPoWExist(height, params)
+// Writes batch of valid shares in a single transaction, caller checks duplicates.
+// Batch is marked as written in the same transaction, so replay of a written batch is a no-op.
+func (r *RedisClient) WriteShares(batch string, shares []*Share, window time.Duration) error {
+	marker := r.formatKey("shares", "batch", batch)
+	tx, err := r.client.Watch(marker)
 	if err != nil {
-		return false, err
-	}
-	// Duplicate share, (nonce, powHash, mixDigest) pair exist
-	if exist {
-		return true, nil
+		return err
 	}
-	tx := r.client.Multi()
 	defer tx.Close()
 
-	ms := util.MakeTimestamp()
-	ts := ms / 1000
-
+	written, err := tx.Exists(marker).Result()
+	if err != nil || written {
+		return err
+	}
 	_, err = tx.Exec(func() error {
-		r.writeShare(tx, ms, ts, login, id, diff, window)
-		tx.HIncrBy(r.formatKey("stats"), "roundShares", diff)
+		tx.SetNX(marker, util.MakeTimestamp(), shareBatchExpiration)
+		var roundShares, staleShares int64
+		for _, s := range shares {
+			r.writeShare(tx, s.Timestamp, s.Timestamp/1000, s.Login, s.Id, s.Nonce, s.Diff, window, s.Solo)
+			if s.Reward > 0 {
+				r.writeShareCredit(tx, s.Login, s.Reward)
+			}
+			if !s.Solo {
+				roundShares += s.Diff
+			}
+			if s.Stale {
+				staleShares++
+				tx.HIncrBy(r.formatKey("miners", s.Login), "staleShares", 1)
+			}
+		}
+		tx.HIncrBy(r.formatKey("stats"), "roundShares", roundShares)
+		if r.pplns > 0 {
+			tx.ZRemRangeByRank(r.formatKey("window"), 0, -maxWindowShares-1)
+		}
+		if staleShares > 0 {
+			tx.HIncrBy(r.formatKey("stats"), "staleShares", staleShares)
+		}
 		return nil
 	})
-	return false, err
+	// Concurrent replay of the same batch marked it first
+	if err == redis.TxFailedErr {
+		return nil
+	}
+	return err
 }
 
 func (r *RedisClient) WriteReject(height uint64) (bool, error) {
-	tx := r.client.Multi()
+	tx, err := r.multi()
+	if err != nil {
+		return false, err
+	}
 	defer tx.Close()
 
 	ms := util.MakeTimestamp()
@@ -201,7 +321,9 @@ func (r *RedisClient) WriteReject(height uint64) (bool, error) {
 	return true, nil
 }
 
-func (r *RedisClient) WriteBlock(login, id string, params []string, diff, roundDiff int64, height uint64, window time.Duration) (bool, error) {
+// Upstreams which accepted and rejected the block are kept with the candidate,
+// PPS reward of the block share is credited right away. Solo block closes round of the finder only.
+func (r *RedisClient) WriteBlock(login, id string, params []string, diff, roundDiff, reward int64, solo bool, height uint64, window time.Duration, accepted, rejected []string) (bool, error) {
 	exist, err := r.checkPoWExist(height, params)
 	if err != nil {
 		return false, err
@@ -210,44 +332,139 @@ func (r *RedisClient) WriteBlock(login, id string, params []string, diff, roundD
 	if exist {
 		return true, nil
 	}
-	tx := r.client.Multi()
+	tx, err := r.multi()
+	if err != nil {
+		return false, err
+	}
 	defer tx.Close()
 
 	ms := util.MakeTimestamp()
 	ts := ms / 1000
 
 	cmds, err := tx.Exec(func() error {
-		r.writeShare(tx, ms, ts, login, id, diff, window)
-		tx.HSet(r.formatKey("stats"), "lastBlockFound", strconv.FormatInt(ts, 10))
-		tx.HDel(r.formatKey("stats"), "roundShares")
+		r.writeShare(tx, ms, ts, login, id, params[0], diff, window, solo)
+		if reward > 0 {
+			r.writeShareCredit(tx, login, reward)
+		}
+		round := r.formatKey("shares", "roundCurrent")
+		if solo {
+			round = r.formatSoloRound(login)
+		} else {
+			tx.HSet(r.formatKey("stats"), "lastBlockFound", strconv.FormatInt(ts, 10))
+			tx.HDel(r.formatKey("stats"), "roundShares")
+			tx.HDel(r.formatKey("finances"), "exposure")
+		}
 		tx.ZIncrBy(r.formatKey("finders"), 1, login)
 		tx.HIncrBy(r.formatKey("miners", login), "blocksFound", 1)
-		tx.Rename(r.formatKey("shares", "roundCurrent"), r.formatRound(int64(height), params[0]))
+		tx.Rename(round, r.formatRound(int64(height), params[0]))
 		tx.HGetAllMap(r.formatRound(int64(height), params[0]))
 		return nil
 	})
 	if err != nil {
 		return false, err
 	} else {
-		sharesMap, _ := cmds[10].(*redis.StringStringMapCmd).Result()
+		sharesMap, _ := cmds[len(cmds)-1].(*redis.StringStringMapCmd).Result()
 		totalShares := int64(0)
 		for _, v := range sharesMap {
 			n, _ := strconv.ParseInt(v, 10, 64)
 			totalShares += n
 		}
 		hashHex := strings.Join(params, ":")
-		s := join(hashHex, ts, roundDiff, totalShares)
-		cmd := r.client.ZAdd(r.formatKey("blocks", "candidates"), redis.Z{Score: float64(height), Member: s})
+		s := join(hashHex, ts, roundDiff, totalShares, strings.Join(accepted, ","), strings.Join(rejected, ","))
+		if solo {
+			s = join(s, "solo")
+		}
+		candidate := redis.Z{Score: float64(height), Member: s}
+		if r.pplns > 0 && !solo {
+			return false, r.writeCandidateWindow(ms, int64(r.pplns*float64(roundDiff)), params[0], candidate)
+		}
+		cmd := r.client.ZAdd(r.formatKey("blocks", "candidates"), candidate)
 		return false, cmd.Err()
 	}
 }
 
-func (r *RedisClient) writeShare(tx *redis.Multi, ms, ts int64, login, id string, diff int64, expire time.Duration) {
-	tx.HIncrBy(r.formatKey("shares", "roundCurrent"), login, diff)
+// Stores window snapshot along with the candidate. Shares older than windowRetain windows
+// of this block are trimmed, window of the next block may be larger.
+func (r *RedisClient) writeCandidateWindow(ms, size int64, nonce string, candidate redis.Z) error {
+	shares := make(map[string]int64)
+	var total, sum, edge int64
+	option := redis.ZRangeByScore{Min: "-inf", Max: strconv.FormatInt(ms, 10), Count: windowChunk}
+	for edge == 0 {
+		raw, err := r.client.ZRevRangeByScoreWithScores(r.formatKey("window"), option).Result()
+		if err != nil {
+			return err
+		}
+		total = fillWindow(shares, total, size, raw)
+		sum, edge = windowEdge(sum, windowRetain*size, raw)
+		if len(raw) < windowChunk {
+			break
+		}
+		option.Offset += windowChunk
+	}
+
+	tx, err := r.multi()
+	if err != nil {
+		return err
+	}
+	defer tx.Close()
+
+	_, err = tx.Exec(func() error {
+		if len(shares) > 0 {
+			tx.HMSetMap(r.formatKey("window", nonce), formatWindowShares(shares))
+		}
+		if edge > 0 {
+			tx.ZRemRangeByScore(r.formatKey("window"), "-inf", fmt.Sprint("(", edge))
+		}
+		tx.ZAdd(r.formatKey("blocks", "candidates"), candidate)
+		return nil
+	})
+	return err
+}
+
+// Solo shares go to the round of their login and never to the PPLNS window
+func (r *RedisClient) writeShare(tx *redis.Multi, ms, ts int64, login, id, nonce string, diff int64, expire time.Duration, solo bool) {
+	if solo {
+		tx.HIncrBy(r.formatSoloRound(login), login, diff)
+	} else {
+		tx.HIncrBy(r.formatKey("shares", "roundCurrent"), login, diff)
+	}
 	tx.ZAdd(r.formatKey("hashrate"), redis.Z{Score: float64(ts), Member: join(diff, login, id, ms)})
 	tx.ZAdd(r.formatKey("hashrate", login), redis.Z{Score: float64(ts), Member: join(diff, id, ms)})
 	tx.Expire(r.formatKey("hashrate", login), expire) // Will delete hashrates for miners that gone
 	tx.HSet(r.formatKey("miners", login), "lastShare", strconv.FormatInt(ts, 10))
+	if r.pplns > 0 && !solo {
+		// Nonce keeps equal shares of the same ms apart
+		tx.ZAdd(r.formatKey("window"), redis.Z{Score: float64(ms), Member: join(diff, login, id, ms, nonce)})
+	}
+}
+
+// PPS credit goes straight to balance and is drawn from the reserve, exposure is credit of the current round
+func (r *RedisClient) writeShareCredit(tx *redis.Multi, login string, amount int64) {
+	tx.HIncrBy(r.formatKey("miners", login), "balance", amount)
+	tx.ZIncrBy(r.formatKey("balances"), float64(amount), login)
+	tx.HIncrBy(r.formatKey("credits", "pps"), login, amount)
+	tx.HIncrBy(r.formatKey("finances"), "balance", amount)
+	tx.HIncrBy(r.formatKey("finances"), "reserve", (amount * -1))
+	tx.HIncrBy(r.formatKey("finances"), "exposure", amount)
+	tx.HIncrBy(r.formatKey("finances"), "ppsCredited", amount)
+}
+
+// Hashrate reported by mining software, entry per worker "hashrate:clientId:timestamp"
+func (r *RedisClient) WriteReportedHashrate(login, id string, hashrate int64, clientId string, expire time.Duration) error {
+	tx, err := r.multi()
+	if err != nil {
+		return err
+	}
+	defer tx.Close()
+
+	ts := util.MakeTimestamp() / 1000
+
+	_, err = tx.Exec(func() error {
+		tx.HSet(r.formatKey("report", login), id, join(hashrate, clientId, ts))
+		tx.Expire(r.formatKey("report", login), expire)
+		return nil
+	})
+	return err
 }
 
 func (r *RedisClient) formatKey(args ...interface{}) string {
@@ -258,6 +475,10 @@ func (r *RedisClient) formatRound(height int64, nonce string) string {
 	return r.formatKey("shares", "round"+strconv.FormatInt(height, 10), nonce)
 }
 
+func (r *RedisClient) formatSoloRound(login string) string {
+	return r.formatKey("shares", "solo", login)
+}
+
 func join(args ...interface{}) string {
 	s := make([]string, len(args))
 	for i, v := range args {
@@ -296,7 +517,7 @@ func (r *RedisClient) GetCandidates(maxHeight int64) ([]*BlockData, error) {
 	if cmd.Err() != nil {
 		return nil, cmd.Err()
 	}
-	return convertCandidateResults(cmd), nil
+	return convertCandidateResults(cmd.Val()), nil
 }
 
 func (r *RedisClient) GetImmatureBlocks(maxHeight int64) ([]*BlockData, error) {
@@ -305,7 +526,7 @@ func (r *RedisClient) GetImmatureBlocks(maxHeight int64) ([]*BlockData, error) {
 	if cmd.Err() != nil {
 		return nil, cmd.Err()
 	}
-	return convertBlockResults(cmd), nil
+	return convertBlockResults(cmd.Val()), nil
 }
 
 func (r *RedisClient) GetRoundShares(height int64, nonce string) (map[string]int64, error) {
@@ -330,7 +551,7 @@ func (r *RedisClient) GetPayees() ([]string, error) {
 	for {
 		var keys []string
 		var err error
-		c, keys, err = r.client.Scan(c, r.formatKey("miners", "*"), 100).Result()
+		c, keys, err = r.scan(c, r.formatKey("miners", "*"), 100)
 		if err != nil {
 			return nil, err
 		}
@@ -348,6 +569,16 @@ func (r *RedisClient) GetPayees() ([]string, error) {
 	return result, nil
 }
 
+// Balances above threshold from sorted set mirroring "balance" of every miner
+func (r *RedisClient) GetPayeesAbove(threshold int64) (map[string]int64, error) {
+	option := redis.ZRangeByScore{Min: fmt.Sprint("(", threshold), Max: "+inf"}
+	cmd := r.client.ZRangeByScoreWithScores(r.formatKey("balances"), option)
+	if cmd.Err() != nil {
+		return nil, cmd.Err()
+	}
+	return convertBalances(cmd.Val()), nil
+}
+
 func (r *RedisClient) GetBalance(login string) (int64, error) {
 	cmd := r.client.HGet(r.formatKey("miners", login), "balance")
 	if cmd.Err() == redis.Nil {
@@ -384,6 +615,13 @@ func (r *RedisClient) IsPayoutsLocked() (bool, error) {
 	}
 }
 
+type Payment struct {
+	Timestamp int64  `json:"timestamp"`
+	TxHash    string `json:"tx"`
+	Address   string `json:"address"`
+	Amount    int64  `json:"amount"`
+}
+
 type PendingPayment struct {
 	Timestamp int64  `json:"timestamp"`
 	Amount    int64  `json:"amount"`
@@ -392,77 +630,215 @@ type PendingPayment struct {
 
 func (r *RedisClient) GetPendingPayments() []*PendingPayment {
 	raw := r.client.ZRevRangeWithScores(r.formatKey("payments", "pending"), 0, -1)
-	var result []*PendingPayment
-	for _, v := range raw.Val() {
-		// timestamp -> "address:amount"
-		payment := PendingPayment{}
-		payment.Timestamp = int64(v.Score)
-		fields := strings.Split(v.Member.(string), ":")
-		payment.Address = fields[0]
-		payment.Amount, _ = strconv.ParseInt(fields[1], 10, 64)
-		result = append(result, &payment)
-	}
-	return result
+	return convertPendingPayments(raw.Val())
 }
 
 // Deduct miner's balance for payment
 func (r *RedisClient) UpdateBalance(login string, amount int64) error {
-	tx := r.client.Multi()
+	tx, err := r.multi()
+	if err != nil {
+		return err
+	}
 	defer tx.Close()
 
 	ts := util.MakeTimestamp() / 1000
 
-	_, err := tx.Exec(func() error {
-		tx.HIncrBy(r.formatKey("miners", login), "balance", (amount * -1))
-		tx.HIncrBy(r.formatKey("miners", login), "pending", amount)
-		tx.HIncrBy(r.formatKey("finances"), "balance", (amount * -1))
-		tx.HIncrBy(r.formatKey("finances"), "pending", amount)
-		tx.ZAdd(r.formatKey("payments", "pending"), redis.Z{Score: float64(ts), Member: join(login, amount)})
+	_, err = tx.Exec(func() error {
+		r.debitBalance(tx, ts, login, amount)
 		return nil
 	})
 	return err
 }
 
+func (r *RedisClient) debitBalance(tx *redis.Multi, ts int64, login string, amount int64) {
+	tx.HIncrBy(r.formatKey("miners", login), "balance", (amount * -1))
+	tx.HIncrBy(r.formatKey("miners", login), "pending", amount)
+	tx.ZIncrBy(r.formatKey("balances"), float64(amount*-1), login)
+	tx.ZRemRangeByScore(r.formatKey("balances"), "0", "0")
+	tx.HIncrBy(r.formatKey("finances"), "balance", (amount * -1))
+	tx.HIncrBy(r.formatKey("finances"), "pending", amount)
+	tx.ZAdd(r.formatKey("payments", "pending"), redis.Z{Score: float64(ts), Member: join(login, amount)})
+}
+
 func (r *RedisClient) RollbackBalance(login string, amount int64) error {
-	tx := r.client.Multi()
+	tx, err := r.multi()
+	if err != nil {
+		return err
+	}
 	defer tx.Close()
 
-	_, err := tx.Exec(func() error {
-		tx.HIncrBy(r.formatKey("miners", login), "balance", amount)
-		tx.HIncrBy(r.formatKey("miners", login), "pending", (amount * -1))
-		tx.HIncrBy(r.formatKey("finances"), "balance", amount)
-		tx.HIncrBy(r.formatKey("finances"), "pending", (amount * -1))
-		tx.ZRem(r.formatKey("payments", "pending"), join(login, amount))
+	_, err = tx.Exec(func() error {
+		r.rollbackBalance(tx, login, amount)
 		return nil
 	})
 	return err
 }
 
+func (r *RedisClient) rollbackBalance(tx *redis.Multi, login string, amount int64) {
+	tx.HIncrBy(r.formatKey("miners", login), "balance", amount)
+	tx.HIncrBy(r.formatKey("miners", login), "pending", (amount * -1))
+	tx.ZIncrBy(r.formatKey("balances"), float64(amount), login)
+	tx.HIncrBy(r.formatKey("finances"), "balance", amount)
+	tx.HIncrBy(r.formatKey("finances"), "pending", (amount * -1))
+	tx.ZRem(r.formatKey("payments", "pending"), join(login, amount))
+}
+
 func (r *RedisClient) WritePayment(login, txHash string, amount int64) error {
-	tx := r.client.Multi()
+	tx, err := r.multi()
+	if err != nil {
+		return err
+	}
 	defer tx.Close()
 
 	ts := util.MakeTimestamp() / 1000
 
-	_, err := tx.Exec(func() error {
-		tx.HIncrBy(r.formatKey("miners", login), "pending", (amount * -1))
-		tx.HIncrBy(r.formatKey("miners", login), "paid", amount)
-		tx.HIncrBy(r.formatKey("finances"), "pending", (amount * -1))
-		tx.HIncrBy(r.formatKey("finances"), "paid", amount)
-		tx.ZAdd(r.formatKey("payments", "all"), redis.Z{Score: float64(ts), Member: join(txHash, login, amount)})
-		tx.ZAdd(r.formatKey("payments", login), redis.Z{Score: float64(ts), Member: join(txHash, amount)})
-		tx.ZRem(r.formatKey("payments", "pending"), join(login, amount))
+	_, err = tx.Exec(func() error {
+		r.writePayment(tx, ts, login, txHash, amount)
 		tx.Del(r.formatKey("payments", "lock"))
 		return nil
 	})
 	return err
 }
 
+func (r *RedisClient) writePayment(tx *redis.Multi, ts int64, login, txHash string, amount int64) {
+	tx.HIncrBy(r.formatKey("miners", login), "pending", (amount * -1))
+	tx.HIncrBy(r.formatKey("miners", login), "paid", amount)
+	tx.HIncrBy(r.formatKey("finances"), "pending", (amount * -1))
+	tx.HIncrBy(r.formatKey("finances"), "paid", amount)
+	tx.ZAdd(r.formatKey("payments", "all"), redis.Z{Score: float64(ts), Member: join(txHash, login, amount)})
+	tx.ZAdd(r.formatKey("payments", login), redis.Z{Score: float64(ts), Member: join(txHash, amount)})
+	tx.ZRem(r.formatKey("payments", "pending"), join(login, amount))
+}
+
+// Payouts lock must be held by the batch until it is settled
+func (r *RedisClient) watchPayoutBatch(id string) (*redis.Multi, error) {
+	key := r.formatKey("payments", "lock")
+	tx, err := r.client.Watch(key, r.formatKey("payouts", id))
+	if err != nil {
+		return nil, err
+	}
+	if lock := tx.Get(key).Val(); lock != id {
+		tx.Close()
+		return nil, fmt.Errorf("Payouts lock is held by '%s', not by batch %s", lock, id)
+	}
+	return tx, nil
+}
+
+// Takes payouts lock for the batch and journals it as planned, nothing is debited yet
+func (r *RedisClient) PlanPayoutBatch(batch *PayoutBatch) error {
+	key := r.formatKey("payments", "lock")
+	tx, err := r.client.Watch(key)
+	if err != nil {
+		return err
+	}
+	defer tx.Close()
+
+	lock, err := tx.Get(key).Result()
+	if err == nil {
+		return fmt.Errorf("Unable to acquire lock '%s', held by '%s'", key, lock)
+	} else if err != redis.Nil {
+		return err
+	}
+	ts := util.MakeTimestamp() / 1000
+	planned := *batch
+	planned.State = PayoutPlanned
+	planned.Timestamp = ts
+	planned.Updated = ts
+
+	_, err = tx.Exec(func() error {
+		tx.Set(key, batch.Id, 0)
+		tx.HMSetMap(r.formatKey("payouts", batch.Id), formatPayoutBatch(&planned))
+		return nil
+	})
+	if err == nil {
+		*batch = planned
+	}
+	return err
+}
+
+// Moves batch to the next state together with its tx data and balances.
+// Payees are debited when batch is debited, paid when confirmed and credited back
+// when it fails. Batch releases payouts lock once confirmed or failed.
+func (r *RedisClient) AdvancePayoutBatch(batch *PayoutBatch, state string) error {
+	tx, err := r.watchPayoutBatch(batch.Id)
+	if err != nil {
+		return err
+	}
+	defer tx.Close()
+
+	key := r.formatKey("payouts", batch.Id)
+	from := tx.HGet(key, "state").Val()
+	if err := checkPayoutTransition(batch.Id, from, state); err != nil {
+		return err
+	}
+	ts := util.MakeTimestamp() / 1000
+	next := *batch
+	next.State = state
+	next.Updated = ts
+
+	_, err = tx.Exec(func() error {
+		tx.HMSetMap(key, formatPayoutBatch(&next))
+		switch state {
+		case PayoutDebited:
+			for login, amount := range batch.Payees {
+				r.debitBalance(tx, ts, login, amount)
+			}
+		case PayoutConfirmed:
+			for login, amount := range batch.Payees {
+				r.writePayment(tx, ts, login, batch.TxHash, amount)
+			}
+			tx.Del(r.formatKey("payments", "lock"))
+		case PayoutFailed:
+			if from != PayoutPlanned {
+				for login, amount := range batch.Payees {
+					r.rollbackBalance(tx, login, amount)
+				}
+			}
+			tx.Del(r.formatKey("payments", "lock"))
+		}
+		return nil
+	})
+	if err == nil {
+		*batch = next
+	}
+	return err
+}
+
+// Batch holding payouts lock, nil if payouts are not locked
+func (r *RedisClient) GetOpenPayoutBatch() (*PayoutBatch, error) {
+	id, err := r.client.Get(r.formatKey("payments", "lock")).Result()
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	fields, err := r.client.HGetAllMap(r.formatKey("payouts", id)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("Payouts are locked by '%s' which has no payout journal", id)
+	}
+	return convertPayoutBatch(id, fields), nil
+}
+
+// PPLNS window snapshot of the block, empty if block was found without it
+func (r *RedisClient) GetWindowShares(nonce string) (map[string]int64, error) {
+	cmd := r.client.HGetAllMap(r.formatKey("window", nonce))
+	if cmd.Err() != nil {
+		return nil, cmd.Err()
+	}
+	return convertCredits(cmd.Val()), nil
+}
+
 func (r *RedisClient) WriteImmatureBlock(block *BlockData, roundRewards map[string]int64) error {
-	tx := r.client.Multi()
+	tx, err := r.multi()
+	if err != nil {
+		return err
+	}
 	defer tx.Close()
 
-	_, err := tx.Exec(func() error {
+	_, err = tx.Exec(func() error {
 		r.writeImmatureBlock(tx, block)
 		total := int64(0)
 		for login, amount := range roundRewards {
@@ -507,6 +883,7 @@ func (r *RedisClient) WriteMaturedBlock(block *BlockData, roundRewards map[strin
 			total += amount
 			// NOTICE: Maybe expire round reward entry in 604800 (a week)?
 			tx.HIncrBy(r.formatKey("miners", login), "balance", amount)
+			tx.ZIncrBy(r.formatKey("balances"), float64(amount), login)
 			tx.HSetNX(r.formatKey("credits", block.Height, block.Hash), login, strconv.FormatInt(amount, 10))
 		}
 		tx.Del(creditKey)
@@ -520,6 +897,44 @@ func (r *RedisClient) WriteMaturedBlock(block *BlockData, roundRewards map[strin
 	return err
 }
 
+// Matured block of PPS pool goes to the reserve, miners were paid for shares already
+func (r *RedisClient) WriteReserveBlock(block *BlockData, txFees int64) error {
+	tx, err := r.multi()
+	if err != nil {
+		return err
+	}
+	defer tx.Close()
+
+	ts := util.MakeTimestamp() / 1000
+	value := join(block.Hash, ts, block.Reward)
+	amount := block.Reward.Int64()
+	if block.ExtraReward != nil {
+		amount += block.ExtraReward.Int64()
+	}
+
+	_, err = tx.Exec(func() error {
+		r.writeMaturedBlock(tx, block)
+		tx.ZAdd(r.formatKey("credits", "all"), redis.Z{Score: float64(block.Height), Member: value})
+		tx.HIncrBy(r.formatKey("finances"), "reserve", amount)
+		tx.HIncrBy(r.formatKey("finances"), "reserveBlocks", 1)
+		tx.HIncrBy(r.formatKey("finances"), "txFees", txFees)
+		tx.HSet(r.formatKey("finances"), "lastCreditHeight", strconv.FormatInt(block.Height, 10))
+		tx.HSet(r.formatKey("finances"), "lastCreditHash", block.Hash)
+		tx.HIncrBy(r.formatKey("finances"), "totalMined", block.RewardInShannon())
+		return nil
+	})
+	return err
+}
+
+// Average tx fees of blocks reconciled into the reserve, expected on top of subsidy by FPPS
+func (r *RedisClient) GetAverageTxFees() (int64, error) {
+	cmd := r.client.HGetAllMap(r.formatKey("finances"))
+	if cmd.Err() != nil {
+		return 0, cmd.Err()
+	}
+	return averageTxFees(cmd.Val()), nil
+}
+
 func (r *RedisClient) WriteOrphan(block *BlockData) error {
 	creditKey := r.formatKey("credits", "immature", block.RoundHeight, block.Hash)
 	tx, err := r.client.Watch(creditKey)
@@ -548,10 +963,13 @@ func (r *RedisClient) WriteOrphan(block *BlockData) error {
 }
 
 func (r *RedisClient) WritePendingOrphans(blocks []*BlockData) error {
-	tx := r.client.Multi()
+	tx, err := r.multi()
+	if err != nil {
+		return err
+	}
 	defer tx.Close()
 
-	_, err := tx.Exec(func() error {
+	_, err = tx.Exec(func() error {
 		for _, block := range blocks {
 			r.writeImmatureBlock(tx, block)
 		}
@@ -571,25 +989,173 @@ func (r *RedisClient) writeImmatureBlock(tx *redis.Multi, block *BlockData) {
 
 func (r *RedisClient) writeMaturedBlock(tx *redis.Multi, block *BlockData) {
 	tx.Del(r.formatRound(block.RoundHeight, block.Nonce))
+	tx.Del(r.formatKey("window", block.Nonce))
 	tx.ZRem(r.formatKey("blocks", "immature"), block.immatureKey)
 	tx.ZAdd(r.formatKey("blocks", "matured"), redis.Z{Score: float64(block.Height), Member: block.key()})
 }
 
-func (r *RedisClient) IsMinerExists(login string) (bool, error) {
-	return r.client.Exists(r.formatKey("miners", login)).Result()
+// Matured blocks and orphans starting from height, in ascending order
+func (r *RedisClient) GetMaturedBlocks(fromHeight int64) ([]*BlockData, error) {
+	option := redis.ZRangeByScore{Min: strconv.FormatInt(fromHeight, 10), Max: "+inf"}
+	cmd := r.client.ZRangeByScoreWithScores(r.formatKey("blocks", "matured"), option)
+	if cmd.Err() != nil {
+		return nil, cmd.Err()
+	}
+	return convertBlockResults(cmd.Val()), nil
 }
 
-func (r *RedisClient) GetMinerStats(login string, maxPayments int64) (map[string]interface{}, error) {
-	stats := make(map[string]interface{})
-
-	tx := r.client.Multi()
-	defer tx.Close()
+func (r *RedisClient) GetBlockCredits(height int64, hash string) (map[string]int64, error) {
+	cmd := r.client.HGetAllMap(r.formatKey("credits", height, hash))
+	if cmd.Err() != nil {
+		return nil, cmd.Err()
+	}
+	return convertCredits(cmd.Val()), nil
+}
 
-	cmds, err := tx.Exec(func() error {
-		tx.HGetAllMap(r.formatKey("miners", login))
+// Payments made since timestamp, in ascending order
+func (r *RedisClient) GetPayments(since int64) ([]*Payment, error) {
+	option := redis.ZRangeByScore{Min: strconv.FormatInt(since, 10), Max: "+inf"}
+	cmd := r.client.ZRangeByScoreWithScores(r.formatKey("payments", "all"), option)
+	if cmd.Err() != nil {
+		return nil, cmd.Err()
+	}
+	return convertPayments(cmd.Val()), nil
+}
+
+func (r *RedisClient) scanKeys(pattern string) ([]string, error) {
+	var result []string
+	var c int64
+	for {
+		var keys []string
+		var err error
+		c, keys, err = r.scan(c, pattern, 100)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, keys...)
+		if c == 0 {
+			break
+		}
+	}
+	return result, nil
+}
+
+// Keys are scanned first, then everything is read in a single transaction
+func (r *RedisClient) GetAccountingSnapshot() (*AccountingSnapshot, error) {
+	minerKeys, err := r.scanKeys(r.formatKey("miners", "*"))
+	if err != nil {
+		return nil, err
+	}
+	creditKeys, err := r.scanKeys(r.formatKey("credits", "*"))
+	if err != nil {
+		return nil, err
+	}
+	allCredits := r.formatKey("credits", "all")
+
+	tx, err := r.multi()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Close()
+
+	cmds, err := tx.Exec(func() error {
+		tx.HGetAllMap(r.formatKey("finances"))
+		tx.ZRangeWithScores(r.formatKey("payments", "pending"), 0, -1)
+		tx.ZRangeWithScores(r.formatKey("payments", "all"), 0, -1)
+		tx.ZRangeWithScores(r.formatKey("balances"), 0, -1)
+		for _, key := range minerKeys {
+			tx.HGetAllMap(key)
+		}
+		for _, key := range creditKeys {
+			if key != allCredits {
+				tx.HGetAllMap(key)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s := newAccountingSnapshot()
+	for k, v := range cmds[0].(*redis.StringStringMapCmd).Val() {
+		s.Finances[k], _ = strconv.ParseInt(v, 10, 64)
+	}
+	for _, v := range cmds[1].(*redis.ZSliceCmd).Val() {
+		s.addPayment(true, v.Member.(string))
+	}
+	for _, v := range cmds[2].(*redis.ZSliceCmd).Val() {
+		s.addPayment(false, v.Member.(string))
+	}
+	s.Balances = convertBalances(cmds[3].(*redis.ZSliceCmd).Val())
+	i := 4
+	for _, key := range minerKeys {
+		s.addMiner(strings.Split(key, ":")[2], cmds[i].(*redis.StringStringMapCmd).Val())
+		i++
+	}
+	for _, key := range creditKeys {
+		if key == allCredits {
+			continue
+		}
+		s.addCredits(strings.Split(key, ":")[2] == "immature", cmds[i].(*redis.StringStringMapCmd).Val())
+		i++
+	}
+	return s, nil
+}
+
+// Payouts processor checks blocked flag before each run
+func (r *RedisClient) WriteAuditResult(mismatches []*AuditMismatch, blockPayouts bool) error {
+	report, err := json.Marshal(mismatches)
+	if err != nil {
+		return err
+	}
+	tx, err := r.multi()
+	if err != nil {
+		return err
+	}
+	defer tx.Close()
+
+	ts := util.MakeTimestamp() / 1000
+
+	_, err = tx.Exec(func() error {
+		tx.HSet(r.formatKey("audit"), "lastRun", strconv.FormatInt(ts, 10))
+		tx.HSet(r.formatKey("audit"), "mismatches", strconv.Itoa(len(mismatches)))
+		tx.HSet(r.formatKey("audit"), "report", string(report))
+		tx.HSet(r.formatKey("audit"), "blocked", join(blockPayouts && len(mismatches) > 0))
+		return nil
+	})
+	return err
+}
+
+func (r *RedisClient) IsPayoutsBlocked() (bool, error) {
+	v, err := r.client.HGet(r.formatKey("audit"), "blocked").Result()
+	if err == redis.Nil {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return v == "1", nil
+}
+
+func (r *RedisClient) IsMinerExists(login string) (bool, error) {
+	return r.client.Exists(r.formatKey("miners", login)).Result()
+}
+
+func (r *RedisClient) GetMinerStats(login string, maxPayments int64) (map[string]interface{}, error) {
+	stats := make(map[string]interface{})
+
+	tx, err := r.multi()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Close()
+
+	cmds, err := tx.Exec(func() error {
+		tx.HGetAllMap(r.formatKey("miners", login))
 		tx.ZRevRangeWithScores(r.formatKey("payments", login), 0, maxPayments-1)
 		tx.ZCard(r.formatKey("payments", login))
 		tx.HGet(r.formatKey("shares", "roundCurrent"), login)
+		tx.HGet(r.formatSoloRound(login), login)
 		return nil
 	})
 
@@ -598,11 +1164,13 @@ func (r *RedisClient) GetMinerStats(login string, maxPayments int64) (map[string
 	} else {
 		result, _ := cmds[0].(*redis.StringStringMapCmd).Result()
 		stats["stats"] = convertStringMap(result)
-		payments := convertPaymentsResults(cmds[1].(*redis.ZSliceCmd))
+		payments := convertPaymentsResults(cmds[1].(*redis.ZSliceCmd).Val())
 		stats["payments"] = payments
 		stats["paymentsTotal"] = cmds[2].(*redis.IntCmd).Val()
 		roundShares, _ := cmds[3].(*redis.StringCmd).Int64()
 		stats["roundShares"] = roundShares
+		soloShares, _ := cmds[4].(*redis.StringCmd).Int64()
+		stats["soloRoundShares"] = soloShares
 	}
 
 	return stats, nil
@@ -637,7 +1205,7 @@ func (r *RedisClient) FlushStaleStats(window, largeWindow time.Duration) (int64,
 	for {
 		var keys []string
 		var err error
-		c, keys, err = r.client.Scan(c, r.formatKey("hashrate", "*"), 100).Result()
+		c, keys, err = r.scan(c, r.formatKey("hashrate", "*"), 100)
 		if err != nil {
 			return total, err
 		}
@@ -663,7 +1231,10 @@ func (r *RedisClient) CollectStats(smallWindow time.Duration, maxBlocks, maxPaym
 	window := int64(smallWindow / time.Second)
 	stats := make(map[string]interface{})
 
-	tx := r.client.Multi()
+	tx, err := r.multi()
+	if err != nil {
+		return nil, err
+	}
 	defer tx.Close()
 
 	now := util.MakeTimestamp() / 1000
@@ -683,6 +1254,7 @@ func (r *RedisClient) CollectStats(smallWindow time.Duration, maxBlocks, maxPaym
 
 		tx.ZRevRangeWithScores(r.formatKey("blocks", "rejects"), 0, -1)
 		tx.ZCard(r.formatKey("blocks", "rejects"))
+		tx.HGetAllMap(r.formatKey("finances"))
 		return nil
 	})
 
@@ -693,27 +1265,30 @@ func (r *RedisClient) CollectStats(smallWindow time.Duration, maxBlocks, maxPaym
 	result, _ := cmds[2].(*redis.StringStringMapCmd).Result()
 	stats["stats"] = convertStringMap(result)
 
-	rejects := convertRejectResults(cmds[11].(*redis.ZSliceCmd))
+	rejects := convertRejectResults(cmds[11].(*redis.ZSliceCmd).Val())
 	stats["rejects"] = rejects
 	stats["rejectsTotal"] = cmds[12].(*redis.IntCmd).Val()
 
-	candidates := convertCandidateResults(cmds[3].(*redis.ZSliceCmd))
+	finances, _ := cmds[13].(*redis.StringStringMapCmd).Result()
+	stats["finances"] = convertStringMap(finances)
+
+	candidates := convertCandidateResults(cmds[3].(*redis.ZSliceCmd).Val())
 	stats["candidates"] = candidates
 	stats["candidatesTotal"] = cmds[6].(*redis.IntCmd).Val()
 
-	immature := convertBlockResults(cmds[4].(*redis.ZSliceCmd))
+	immature := convertBlockResults(cmds[4].(*redis.ZSliceCmd).Val())
 	stats["immature"] = immature
 	stats["immatureTotal"] = cmds[7].(*redis.IntCmd).Val()
 
-	matured := convertBlockResults(cmds[5].(*redis.ZSliceCmd))
+	matured := convertBlockResults(cmds[5].(*redis.ZSliceCmd).Val())
 	stats["matured"] = matured
 	stats["maturedTotal"] = cmds[8].(*redis.IntCmd).Val()
 
-	payments := convertPaymentsResults(cmds[10].(*redis.ZSliceCmd))
+	payments := convertPaymentsResults(cmds[10].(*redis.ZSliceCmd).Val())
 	stats["payments"] = payments
 	stats["paymentsTotal"] = cmds[9].(*redis.IntCmd).Val()
 
-	totalHashrate, miners := convertMinersStats(window, cmds[1].(*redis.ZSliceCmd))
+	totalHashrate, miners := convertMinersStats(window, cmds[1].(*redis.ZSliceCmd).Val())
 	stats["miners"] = miners
 	stats["minersTotal"] = len(miners)
 	stats["hashrate"] = totalHashrate
@@ -723,9 +1298,11 @@ func (r *RedisClient) CollectStats(smallWindow time.Duration, maxBlocks, maxPaym
 func (r *RedisClient) CollectWorkersStats(sWindow, lWindow time.Duration, login string) (map[string]interface{}, error) {
 	smallWindow := int64(sWindow / time.Second)
 	largeWindow := int64(lWindow / time.Second)
-	stats := make(map[string]interface{})
 
-	tx := r.client.Multi()
+	tx, err := r.multi()
+	if err != nil {
+		return nil, err
+	}
 	defer tx.Close()
 
 	now := util.MakeTimestamp() / 1000
@@ -733,18 +1310,225 @@ func (r *RedisClient) CollectWorkersStats(sWindow, lWindow time.Duration, login
 	cmds, err := tx.Exec(func() error {
 		tx.ZRemRangeByScore(r.formatKey("hashrate", login), "-inf", fmt.Sprint("(", now-largeWindow))
 		tx.ZRangeWithScores(r.formatKey("hashrate", login), 0, -1)
+		tx.HGetAllMap(r.formatKey("report", login))
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	reports, _ := cmds[2].(*redis.StringStringMapCmd).Result()
+	return buildWorkersStats(now, smallWindow, largeWindow, cmds[1].(*redis.ZSliceCmd).Val(), reports), nil
+}
+
+func (r *RedisClient) CollectLuckStats(windows []int) (map[string]interface{}, error) {
+	tx, err := r.multi()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Close()
+
+	max := int64(windows[len(windows)-1])
+
+	cmds, err := tx.Exec(func() error {
+		tx.ZRevRangeWithScores(r.formatKey("blocks", "immature"), 0, -1)
+		tx.ZRevRangeWithScores(r.formatKey("blocks", "matured"), 0, max-1)
+		return nil
+	})
+	if err != nil {
+		return make(map[string]interface{}), err
+	}
+	blocks := convertBlockResults(cmds[0].(*redis.ZSliceCmd).Val(), cmds[1].(*redis.ZSliceCmd).Val())
+	return buildLuckStats(windows, blocks), nil
+}
+
+// Shares of every miner within [from, to), keys are scanned first, then read in a single transaction
+func (r *RedisClient) CollectShares(from, to int64) (map[string]map[string]*ShareTotal, error) {
+	keys, err := r.scanKeys(r.formatKey("hashrate", "*"))
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]map[string]*ShareTotal)
+	if len(keys) == 0 {
+		return result, nil
+	}
+
+	tx, err := r.multi()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Close()
+
+	option := redis.ZRangeByScore{Min: strconv.FormatInt(from, 10), Max: fmt.Sprint("(", to)}
+	cmds, err := tx.Exec(func() error {
+		for _, key := range keys {
+			tx.ZRangeByScoreWithScores(key, option)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		convertShareTotals(strings.Split(key, ":")[2], cmds[i].(*redis.ZSliceCmd).Val(), result)
+	}
+	return result, nil
+}
+
+// Rewrites points of the bucket, so rerun of the same bucket is harmless.
+// Points older than retention are trimmed, keys of miners that gone expire.
+func (r *RedisClient) WriteHistory(tier string, retention time.Duration, bucket *HistoryBucket) error {
+	tx, err := r.multi()
+	if err != nil {
+		return err
+	}
+	defer tx.Close()
+
+	ts := bucket.Timestamp
+	score := strconv.FormatInt(ts, 10)
+	cutoff := fmt.Sprint("(", ts-int64(retention/time.Second))
+
+	_, err = tx.Exec(func() error {
+		write := func(key string, members ...string) {
+			tx.ZRemRangeByScore(key, score, score)
+			for _, member := range members {
+				tx.ZAdd(key, redis.Z{Score: float64(ts), Member: member})
+			}
+			tx.ZRemRangeByScore(key, "-inf", cutoff)
+			tx.Expire(key, retention)
+		}
+		write(r.formatKey("history", tier, "pool"), encodeHistoryPoint(ts, bucket.Pool))
+		for login, p := range bucket.Miners {
+			write(r.formatKey("history", tier, "miners", login), encodeHistoryPoint(ts, p))
+		}
+		for login, workers := range bucket.Workers {
+			members := make([]string, 0, len(workers))
+			for id, p := range workers {
+				members = append(members, join(id, encodeHistoryPoint(ts, p)))
+			}
+			write(r.formatKey("history", tier, "workers", login), members...)
+		}
 		return nil
 	})
+	return err
+}
 
+// Every series of a tier within [from, to), used for downsampling into the next tier
+func (r *RedisClient) GetHistory(tier string, from, to int64) (*HistorySeries, error) {
+	minerKeys, err := r.scanKeys(r.formatKey("history", tier, "miners", "*"))
+	if err != nil {
+		return nil, err
+	}
+	workerKeys, err := r.scanKeys(r.formatKey("history", tier, "workers", "*"))
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := r.multi()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Close()
+
+	option := redis.ZRangeByScore{Min: strconv.FormatInt(from, 10), Max: fmt.Sprint("(", to)}
+	cmds, err := tx.Exec(func() error {
+		tx.ZRangeByScoreWithScores(r.formatKey("history", tier, "pool"), option)
+		for _, key := range minerKeys {
+			tx.ZRangeByScoreWithScores(key, option)
+		}
+		for _, key := range workerKeys {
+			tx.ZRangeByScoreWithScores(key, option)
+		}
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
 
+	s := NewHistorySeries()
+	s.Pool = convertHistoryPoints(cmds[0].(*redis.ZSliceCmd).Val())
+	i := 1
+	for _, key := range minerKeys {
+		if points := convertHistoryPoints(cmds[i].(*redis.ZSliceCmd).Val()); len(points) > 0 {
+			s.Miners[strings.Split(key, ":")[4]] = points
+		}
+		i++
+	}
+	for _, key := range workerKeys {
+		s.addWorkers(strings.Split(key, ":")[4], cmds[i].(*redis.ZSliceCmd).Val())
+		i++
+	}
+	return s, nil
+}
+
+func (r *RedisClient) GetPoolHistory(tier string, from int64) ([]*HistoryPoint, error) {
+	option := redis.ZRangeByScore{Min: strconv.FormatInt(from, 10), Max: "+inf"}
+	cmd := r.client.ZRangeByScoreWithScores(r.formatKey("history", tier, "pool"), option)
+	if cmd.Err() != nil {
+		return nil, cmd.Err()
+	}
+	return convertHistoryPoints(cmd.Val()), nil
+}
+
+// Returns miner series and series of each worker
+func (r *RedisClient) GetMinerHistory(tier, login string, from int64) ([]*HistoryPoint, map[string][]*HistoryPoint, error) {
+	tx, err := r.multi()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Close()
+
+	option := redis.ZRangeByScore{Min: strconv.FormatInt(from, 10), Max: "+inf"}
+	cmds, err := tx.Exec(func() error {
+		tx.ZRangeByScoreWithScores(r.formatKey("history", tier, "miners", login), option)
+		tx.ZRangeByScoreWithScores(r.formatKey("history", tier, "workers", login), option)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	miner := convertHistoryPoints(cmds[0].(*redis.ZSliceCmd).Val())
+	workers := convertWorkerHistory(cmds[1].(*redis.ZSliceCmd).Val())
+	return miner, workers, nil
+}
+
+func convertNodeStates(raw map[string]string) []map[string]interface{} {
+	m := make(map[string]map[string]interface{})
+	for key, value := range raw {
+		parts := strings.Split(key, ":")
+		var val interface{} = value
+		if strings.HasPrefix(value, "{") || strings.HasPrefix(value, "[") {
+			var details interface{}
+			if err := json.Unmarshal([]byte(value), &details); err == nil {
+				val = details
+			}
+		}
+		if node, ok := m[parts[0]]; ok {
+			node[parts[1]] = val
+		} else {
+			node := make(map[string]interface{})
+			node[parts[1]] = val
+			m[parts[0]] = node
+		}
+	}
+	v := make([]map[string]interface{}, len(m), len(m))
+	i := 0
+	for _, node := range m {
+		v[i] = node
+		i++
+	}
+	return v
+}
+
+// Hashrates are averaged over online time, but not less than 10 minutes
+func buildWorkersStats(now, smallWindow, largeWindow int64, shares []redis.Z, reports map[string]string) map[string]interface{} {
+	stats := make(map[string]interface{})
 	totalHashrate := int64(0)
 	currentHashrate := int64(0)
 	online := int64(0)
 	offline := int64(0)
-	workers := convertWorkersStats(smallWindow, cmds[1].(*redis.ZSliceCmd))
+	workers := convertWorkersStats(smallWindow, shares)
 
 	for id, worker := range workers {
 		timeOnline := now - worker.startedAt
@@ -775,32 +1559,39 @@ func (r *RedisClient) CollectWorkersStats(sWindow, lWindow time.Duration, login
 		totalHashrate += worker.TotalHR
 		workers[id] = worker
 	}
+
+	reportedHashrate := int64(0)
+	for id, hashrate := range convertReportedHashrates(now-smallWindow, reports) {
+		worker, ok := workers[id]
+		if !ok {
+			// Rig reports hashrate but none of its shares reached the pool
+			worker.Offline = true
+			offline++
+		}
+		worker.ReportedHR = hashrate
+		reportedHashrate += hashrate
+		workers[id] = worker
+	}
 	stats["workers"] = workers
 	stats["workersTotal"] = len(workers)
 	stats["workersOnline"] = online
 	stats["workersOffline"] = offline
 	stats["hashrate"] = totalHashrate
 	stats["currentHashrate"] = currentHashrate
-	return stats, nil
+	stats["reportedHashrate"] = reportedHashrate
+	return stats
 }
 
-func (r *RedisClient) CollectLuckStats(windows []int) (map[string]interface{}, error) {
+func buildLuckStats(windows []int, all []*BlockData) map[string]interface{} {
 	stats := make(map[string]interface{})
 
-	tx := r.client.Multi()
-	defer tx.Close()
-
-	max := int64(windows[len(windows)-1])
-
-	cmds, err := tx.Exec(func() error {
-		tx.ZRevRangeWithScores(r.formatKey("blocks", "immature"), 0, -1)
-		tx.ZRevRangeWithScores(r.formatKey("blocks", "matured"), 0, max-1)
-		return nil
-	})
-	if err != nil {
-		return stats, err
+	// Solo rounds tell nothing of pool luck
+	var blocks []*BlockData
+	for _, block := range all {
+		if !block.Solo {
+			blocks = append(blocks, block)
+		}
 	}
-	blocks := convertBlockResults(cmds[0].(*redis.ZSliceCmd), cmds[1].(*redis.ZSliceCmd))
 
 	calcLuck := func(max int) (int, float64, float64, float64) {
 		var total int
@@ -835,13 +1626,68 @@ func (r *RedisClient) CollectLuckStats(windows []int) (map[string]interface{}, e
 			break
 		}
 	}
-	return stats, nil
+	return stats
+}
+
+func convertPendingPayments(raw []redis.Z) []*PendingPayment {
+	var result []*PendingPayment
+	for _, v := range raw {
+		// timestamp -> "address:amount"
+		payment := PendingPayment{}
+		payment.Timestamp = int64(v.Score)
+		fields := strings.Split(v.Member.(string), ":")
+		payment.Address = fields[0]
+		payment.Amount, _ = strconv.ParseInt(fields[1], 10, 64)
+		result = append(result, &payment)
+	}
+	return result
+}
+
+func convertBalances(raw []redis.Z) map[string]int64 {
+	result := make(map[string]int64)
+	for _, v := range raw {
+		result[v.Member.(string)] = int64(v.Score)
+	}
+	return result
+}
+
+func convertCredits(raw map[string]string) map[string]int64 {
+	result := make(map[string]int64)
+	for login, v := range raw {
+		n, _ := strconv.ParseInt(v, 10, 64)
+		result[login] = n
+	}
+	return result
 }
 
-func convertRejectResults(raw *redis.ZSliceCmd) []*BlockData {
+func averageTxFees(finances map[string]string) int64 {
+	fees, _ := strconv.ParseInt(finances["txFees"], 10, 64)
+	blocks, _ := strconv.ParseInt(finances["reserveBlocks"], 10, 64)
+	if blocks == 0 {
+		return 0
+	}
+	return fees / blocks
+}
+
+func convertPayments(raw []redis.Z) []*Payment {
+	var result []*Payment
+	for _, v := range raw {
+		// "txHash:login:amount"
+		payment := Payment{}
+		payment.Timestamp = int64(v.Score)
+		fields := strings.Split(v.Member.(string), ":")
+		payment.TxHash = fields[0]
+		payment.Address = fields[1]
+		payment.Amount, _ = strconv.ParseInt(fields[2], 10, 64)
+		result = append(result, &payment)
+	}
+	return result
+}
+
+func convertRejectResults(raw []redis.Z) []*BlockData {
 	var result []*BlockData
-	for _, v := range raw.Val() {
-		// "nonce:powHash:mixDigest:timestamp:diff:totalShares"
+	for _, v := range raw {
+		// "nonce:powHash:mixDigest:timestamp:diff:totalShares:acceptedBy:rejectedBy[:solo]"
 		block := BlockData{}
 		block.Height = int64(v.Score)
 		block.RoundHeight = block.Height
@@ -852,10 +1698,10 @@ func convertRejectResults(raw *redis.ZSliceCmd) []*BlockData {
 	return result
 }
 
-func convertCandidateResults(raw *redis.ZSliceCmd) []*BlockData {
+func convertCandidateResults(raw []redis.Z) []*BlockData {
 	var result []*BlockData
-	for _, v := range raw.Val() {
-		// "nonce:powHash:mixDigest:timestamp:diff:totalShares"
+	for _, v := range raw {
+		// "nonce:powHash:mixDigest:timestamp:diff:totalShares:acceptedBy:rejectedBy"
 		block := BlockData{}
 		block.Height = int64(v.Score)
 		block.RoundHeight = block.Height
@@ -866,17 +1712,29 @@ func convertCandidateResults(raw *redis.ZSliceCmd) []*BlockData {
 		block.Timestamp, _ = strconv.ParseInt(fields[3], 10, 64)
 		block.Difficulty, _ = strconv.ParseInt(fields[4], 10, 64)
 		block.TotalShares, _ = strconv.ParseInt(fields[5], 10, 64)
+		if len(fields) > 7 {
+			block.AcceptedBy = splitNames(fields[6])
+			block.RejectedBy = splitNames(fields[7])
+		}
+		block.Solo = len(fields) > 8 && fields[8] == "solo"
 		block.candidateKey = v.Member.(string)
 		result = append(result, &block)
 	}
 	return result
 }
 
-func convertBlockResults(rows ...*redis.ZSliceCmd) []*BlockData {
+func splitNames(s string) []string {
+	if len(s) == 0 {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+func convertBlockResults(rows ...[]redis.Z) []*BlockData {
 	var result []*BlockData
 	for _, row := range rows {
-		for _, v := range row.Val() {
-			// "uncleHeight:orphan:nonce:blockHash:timestamp:diff:totalShares:rewardInWei"
+		for _, v := range row {
+			// "uncleHeight:orphan:nonce:blockHash:timestamp:diff:totalShares:rewardInWei[:solo]"
 			block := BlockData{}
 			block.Height = int64(v.Score)
 			block.RoundHeight = block.Height
@@ -891,6 +1749,7 @@ func convertBlockResults(rows ...*redis.ZSliceCmd) []*BlockData {
 			block.TotalShares, _ = strconv.ParseInt(fields[6], 10, 64)
 			block.RewardString = fields[7]
 			block.ImmatureReward = fields[7]
+			block.Solo = len(fields) > 8 && fields[8] == "solo"
 			block.immatureKey = v.Member.(string)
 			result = append(result, &block)
 		}
@@ -900,11 +1759,11 @@ func convertBlockResults(rows ...*redis.ZSliceCmd) []*BlockData {
 
 // Build per login workers's total shares map {'rig-1': 12345, 'rig-2': 6789, ...}
 // TS => diff, id, ms
-func convertWorkersStats(window int64, raw *redis.ZSliceCmd) map[string]Worker {
+func convertWorkersStats(window int64, raw []redis.Z) map[string]Worker {
 	now := util.MakeTimestamp() / 1000
 	workers := make(map[string]Worker)
 
-	for _, v := range raw.Val() {
+	for _, v := range raw {
 		parts := strings.Split(v.Member.(string), ":")
 		share, _ := strconv.ParseInt(parts[0], 10, 64)
 		id := parts[1]
@@ -930,12 +1789,30 @@ func convertWorkersStats(window int64, raw *redis.ZSliceCmd) map[string]Worker {
 	return workers
 }
 
-func convertMinersStats(window int64, raw *redis.ZSliceCmd) (int64, map[string]Miner) {
+// Build per worker reported hashrate map, skip reports older than since
+// id => hashrate:clientId:timestamp
+func convertReportedHashrates(since int64, raw map[string]string) map[string]int64 {
+	result := make(map[string]int64)
+	for id, v := range raw {
+		parts := strings.Split(v, ":")
+		if len(parts) < 3 {
+			continue
+		}
+		ts, _ := strconv.ParseInt(parts[2], 10, 64)
+		if ts < since {
+			continue
+		}
+		result[id], _ = strconv.ParseInt(parts[0], 10, 64)
+	}
+	return result
+}
+
+func convertMinersStats(window int64, raw []redis.Z) (int64, map[string]Miner) {
 	now := util.MakeTimestamp() / 1000
 	miners := make(map[string]Miner)
 	totalHashrate := int64(0)
 
-	for _, v := range raw.Val() {
+	for _, v := range raw {
 		parts := strings.Split(v.Member.(string), ":")
 		share, _ := strconv.ParseInt(parts[0], 10, 64)
 		id := parts[1]
@@ -973,9 +1850,9 @@ func convertMinersStats(window int64, raw *redis.ZSliceCmd) (int64, map[string]M
 	return totalHashrate, miners
 }
 
-func convertPaymentsResults(raw *redis.ZSliceCmd) []map[string]interface{} {
+func convertPaymentsResults(raw []redis.Z) []map[string]interface{} {
 	var result []map[string]interface{}
-	for _, v := range raw.Val() {
+	for _, v := range raw {
 		tx := make(map[string]interface{})
 		tx["timestamp"] = int64(v.Score)
 		fields := strings.Split(v.Member.(string), ":")
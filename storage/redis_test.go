@@ -1,12 +1,16 @@
 package storage
 
 import (
+	"math/big"
 	"os"
 	"reflect"
 	"strconv"
 	"testing"
+	"time"
 
 	"gopkg.in/redis.v3"
+
+	"github.com/sammy007/open-ethereum-pool/util"
 )
 
 var r *RedisClient
@@ -21,28 +25,149 @@ func TestMain(m *testing.M) {
 	os.Exit(c)
 }
 
-func TestWriteShareCheckExist(t *testing.T) {
+func TestWriteStaleShare(t *testing.T) {
 	reset()
 
-	exist, _ := r.WriteShare("x", "x", []string{"0x0", "0x0", "0x0"}, 10, 1008, 0)
-	if exist {
-		t.Error("PoW must not exist")
+	ms := util.MakeTimestamp()
+	r.WriteShares("1", []*Share{
+		{Login: "x", Id: "x", Diff: 10, Height: 1008, Timestamp: ms},
+		{Login: "x", Id: "x", Diff: 10, Height: 1007, Stale: true, Timestamp: ms},
+	}, time.Hour)
+	if v := r.client.HGet(r.formatKey("shares", "roundCurrent"), "x").Val(); v != "20" {
+		t.Errorf("Must credit stale share, round shares: %v", v)
 	}
-	exist, _ = r.WriteShare("x", "x", []string{"0x0", "0x1", "0x0"}, 10, 1008, 0)
-	if exist {
-		t.Error("PoW must not exist")
+	if v := r.client.HGet(r.formatKey("stats"), "staleShares").Val(); v != "1" {
+		t.Errorf("Must count stale share for pool: %v", v)
+	}
+	if v := r.client.HGet(r.formatKey("miners", "x"), "staleShares").Val(); v != "1" {
+		t.Errorf("Must count stale share for miner: %v", v)
+	}
+}
+
+func TestWriteBlockUpstreams(t *testing.T) {
+	reset()
+
+	params := []string{"0x1", "0x2", "0x3"}
+	_, err := r.WriteBlock("x", "x", params, 10, 1000, 0, false, 1024, 0, []string{"main", "backup"}, []string{"lagging"})
+	if err != nil {
+		t.Errorf("Failed to write block: %v", err)
 	}
-	exist, _ = r.WriteShare("x", "x", []string{"0x0", "0x0", "0x1"}, 100, 1010, 0)
-	if exist {
+	candidates, _ := r.GetCandidates(1024)
+	if len(candidates) != 1 {
+		t.Fatal("Must store block candidate")
+	}
+	c := candidates[0]
+	if len(c.AcceptedBy) != 2 || c.AcceptedBy[0] != "main" || c.AcceptedBy[1] != "backup" {
+		t.Errorf("Invalid accepted upstreams: %v", c.AcceptedBy)
+	}
+	if len(c.RejectedBy) != 1 || c.RejectedBy[0] != "lagging" {
+		t.Errorf("Invalid rejected upstreams: %v", c.RejectedBy)
+	}
+}
+
+func TestShareWriterDuplicates(t *testing.T) {
+	w := NewShareWriter(&ShareWriterConfig{}, r, 0)
+
+	if w.Add("x", "x", []string{"0x0", "0x0", "0x0"}, 10, 1008, false, 0, false) {
 		t.Error("PoW must not exist")
 	}
-	exist, _ = r.WriteShare("z", "x", []string{"0x0", "0x0", "0x1"}, 100, 1016, 0)
-	if !exist {
+	if !w.Add("z", "x", []string{"0x0", "0x0", "0x0"}, 10, 1010, true, 0, false) {
 		t.Error("PoW must exist")
 	}
-	exist, _ = r.WriteShare("x", "x", []string{"0x0", "0x0", "0x1"}, 100, 1025, 0)
-	if exist {
-		t.Error("PoW must not exist")
+	if w.Add("x", "x", []string{"0x0", "0x0", "0x0"}, 10, 1025, false, 0, false) {
+		t.Error("PoW must be swept")
+	}
+	if w.Pending() != 2 {
+		t.Errorf("Must buffer valid shares, got %v", w.Pending())
+	}
+}
+
+func TestShareWriterFlush(t *testing.T) {
+	reset()
+
+	w := NewShareWriter(&ShareWriterConfig{}, r, time.Minute)
+	w.Add("x", "x", []string{"0x0", "0x0", "0x0"}, 10, 1008, false, 0, false)
+	w.Add("x", "x", []string{"0x0", "0x0", "0x1"}, 10, 1008, true, 0, false)
+	w.Add("y", "x", []string{"0x0", "0x0", "0x2"}, 20, 1008, false, 0, false)
+
+	if err := w.Flush(); err != nil {
+		t.Errorf("Failed to flush shares: %v", err)
+	}
+	if w.Pending() != 0 {
+		t.Error("Must not keep flushed shares")
+	}
+	stats := r.client.HGetAllMap(r.formatKey("stats")).Val()
+	if stats["roundShares"] != "40" || stats["staleShares"] != "1" {
+		t.Errorf("Invalid round stats %v", stats)
+	}
+	shares := r.client.HGetAllMap(r.formatKey("shares", "roundCurrent")).Val()
+	if shares["x"] != "20" || shares["y"] != "20" {
+		t.Errorf("Invalid round shares %v", shares)
+	}
+}
+
+func TestShareWriterJournal(t *testing.T) {
+	reset()
+
+	journal := os.TempDir() + "/test-shares.journal"
+	os.Remove(journal)
+	defer os.Remove(journal)
+
+	down := NewRedisClient(&Config{Endpoint: "127.0.0.1:1"}, prefix)
+	w := NewShareWriter(&ShareWriterConfig{Journal: journal}, down, time.Minute)
+	w.Add("x", "x", []string{"0x0", "0x0", "0x0"}, 10, 1008, false, 0, false)
+	if err := w.Flush(); err == nil {
+		t.Fatal("Flush must fail while backend is down")
+	}
+	if _, err := os.Stat(journal); err != nil {
+		t.Fatalf("Must save shares to journal: %v", err)
+	}
+
+	w = NewShareWriter(&ShareWriterConfig{Journal: journal}, r, time.Minute)
+	if err := w.Flush(); err != nil {
+		t.Errorf("Failed to replay journal: %v", err)
+	}
+	if _, err := os.Stat(journal); !os.IsNotExist(err) {
+		t.Error("Must remove replayed journal")
+	}
+	if v := r.client.HGet(r.formatKey("stats"), "roundShares").Val(); v != "10" {
+		t.Errorf("Must credit journaled shares, got %v", v)
+	}
+}
+
+func TestShareWriterReplayWrittenBatch(t *testing.T) {
+	reset()
+
+	journal := os.TempDir() + "/test-shares-replay.journal"
+	defer os.Remove(journal)
+
+	// Batch was committed, but its reply was lost and it went to journal
+	batch := &ShareBatch{Id: "1-a", Shares: []*Share{{Login: "x", Id: "x", Diff: 10, Height: 1008, Timestamp: util.MakeTimestamp()}}}
+	if err := r.WriteShares(batch.Id, batch.Shares, time.Minute); err != nil {
+		t.Fatalf("Failed to write shares: %v", err)
+	}
+	writeJournal(journal, []*ShareBatch{batch})
+
+	w := NewShareWriter(&ShareWriterConfig{Journal: journal}, r, time.Minute)
+	if err := w.Flush(); err != nil {
+		t.Errorf("Failed to replay journal: %v", err)
+	}
+	if v := r.client.HGet(r.formatKey("stats"), "roundShares").Val(); v != "10" {
+		t.Errorf("Must credit replayed batch once, got %v", v)
+	}
+	if ttl := r.Client().TTL(r.formatKey("shares", "batch", batch.Id)).Val(); ttl <= 0 || ttl > shareBatchExpiration {
+		t.Errorf("Must expire written batch marker: %v", ttl)
+	}
+}
+
+func TestShareWriterMemoryFallback(t *testing.T) {
+	w := NewShareWriter(&ShareWriterConfig{Journal: os.TempDir() + "/missing/shares.journal"}, r, time.Minute)
+	w.save([]*ShareBatch{
+		{Id: "1-a", Shares: make([]*Share, maxFailedShares)},
+		{Id: "1-b", Shares: make([]*Share, 1)},
+	})
+	if w.Pending() != 1 || w.failed[0].Id != "1-b" {
+		t.Errorf("Must drop oldest batch above the limit, kept %v shares", w.Pending())
 	}
 }
 
@@ -321,6 +446,32 @@ func TestCollectLuckStats(t *testing.T) {
 	}
 }
 
+func TestReportedHashrate(t *testing.T) {
+	reset()
+
+	r.WriteShares("2", []*Share{{Login: "x", Id: "rig-1", Diff: 1000, Height: 1008, Timestamp: util.MakeTimestamp()}}, time.Hour)
+	r.WriteReportedHashrate("x", "rig-1", 150, "0x1", time.Hour)
+	r.WriteReportedHashrate("x", "rig-2", 100, "0x2", time.Hour)
+
+	stats, err := r.CollectWorkersStats(30*time.Minute, 3*time.Hour, "x")
+	if err != nil {
+		t.Fatalf("Failed to collect workers stats: %v", err)
+	}
+	if stats["reportedHashrate"] != int64(250) {
+		t.Errorf("Invalid total reported hashrate: %v", stats["reportedHashrate"])
+	}
+	workers := stats["workers"].(map[string]Worker)
+	if workers["rig-1"].ReportedHR != 150 {
+		t.Error("Must report hashrate of worker with shares")
+	}
+	if workers["rig-1"].Offline {
+		t.Error("Worker with shares must be online")
+	}
+	if !workers["rig-2"].Offline || workers["rig-2"].ReportedHR != 100 {
+		t.Error("Must report worker without shares as offline")
+	}
+}
+
 func TestWriteReject(t *testing.T) {
 	reset()
 
@@ -330,6 +481,292 @@ func TestWriteReject(t *testing.T) {
 	}
 }
 
+func TestCheckSchema(t *testing.T) {
+	reset()
+
+	if err := r.CheckSchema(); err != nil {
+		t.Errorf("Must stamp empty database: %v", err)
+	}
+	if v, _ := r.SchemaVersion(); v != SchemaVersion {
+		t.Errorf("Invalid schema version: %v", v)
+	}
+	r.client.Set(r.formatKey("schema"), strconv.Itoa(SchemaVersion+1), 0)
+	if err := r.CheckSchema(); err == nil {
+		t.Error("Must refuse unknown schema version")
+	}
+}
+
+func TestMigrateCandidateUpstreams(t *testing.T) {
+	reset()
+
+	r.client.ZAdd(r.formatKey("blocks", "candidates"), redis.Z{Score: 10, Member: "0x1:0x2:0x3:1000:100:500"})
+	r.client.ZAdd(r.formatKey("blocks", "candidates"), redis.Z{Score: 11, Member: "0x4:0x5:0x6:1000:100:500:main:"})
+	if v, _ := r.SchemaVersion(); v != legacySchemaVersion {
+		t.Errorf("Must detect legacy schema, got: %v", v)
+	}
+	if err := r.CheckSchema(); err == nil {
+		t.Error("Must refuse outdated schema")
+	}
+
+	r.Migrate(true)
+	if v, _ := r.SchemaVersion(); v != legacySchemaVersion {
+		t.Errorf("Must not change schema version on dry run: %v", v)
+	}
+	if err := r.client.ZRank(r.formatKey("blocks", "candidates"), "0x1:0x2:0x3:1000:100:500").Err(); err != nil {
+		t.Errorf("Must not change candidates on dry run: %v", err)
+	}
+
+	if err := r.Migrate(false); err != nil {
+		t.Errorf("Migration failed: %v", err)
+	}
+	if v, _ := r.SchemaVersion(); v != SchemaVersion {
+		t.Errorf("Invalid schema version: %v", v)
+	}
+	if err := r.client.ZRank(r.formatKey("blocks", "candidates"), "0x1:0x2:0x3:1000:100:500::").Err(); err != nil {
+		t.Errorf("Must rewrite outdated candidate: %v", err)
+	}
+	if err := r.client.ZRank(r.formatKey("blocks", "candidates"), "0x4:0x5:0x6:1000:100:500:main:").Err(); err != nil {
+		t.Errorf("Must keep current candidate: %v", err)
+	}
+}
+
+func TestMigrateBalanceIndex(t *testing.T) {
+	reset()
+
+	r.setSchemaVersion(2)
+	r.client.HSet(r.formatKey("miners", "x"), "balance", "750")
+	r.client.HSet(r.formatKey("miners", "y"), "balance", "0")
+	if err := r.Migrate(false); err != nil {
+		t.Errorf("Migration failed: %v", err)
+	}
+	payees, _ := r.GetPayeesAbove(0)
+	if !reflect.DeepEqual(payees, map[string]int64{"x": 750}) {
+		t.Errorf("Invalid balance index: %v", payees)
+	}
+}
+
+func TestMigrateSoloFlag(t *testing.T) {
+	reset()
+
+	r.setSchemaVersion(3)
+	r.client.ZAdd(r.formatKey("blocks", "candidates"), redis.Z{Score: 10, Member: "0x1:0x2:0x3:1000:100:500::"})
+	if err := r.Migrate(false); err != nil {
+		t.Errorf("Migration failed: %v", err)
+	}
+	if v, _ := r.SchemaVersion(); v != 4 {
+		t.Errorf("Invalid schema version: %v", v)
+	}
+	candidates, _ := r.GetCandidates(1000)
+	if len(candidates) != 1 || candidates[0].Solo {
+		t.Errorf("Must keep pool candidate: %+v", candidates)
+	}
+}
+
+func TestGetPayeesAbove(t *testing.T) {
+	reset()
+
+	r.RollbackBalance("x", 1000)
+	r.RollbackBalance("y", 250)
+	r.UpdateBalance("x", 1000)
+	payees, _ := r.GetPayeesAbove(250)
+	if len(payees) != 0 {
+		t.Errorf("Must drop drained balance and skip one at threshold: %v", payees)
+	}
+	r.RollbackBalance("x", 500)
+	payees, _ = r.GetPayeesAbove(250)
+	if !reflect.DeepEqual(payees, map[string]int64{"x": 500}) {
+		t.Errorf("Invalid payees: %v", payees)
+	}
+}
+
+func TestPPLNSWindow(t *testing.T) {
+	reset()
+	r.SetPPLNS(2)
+	defer r.SetPPLNS(0)
+
+	ms := util.MakeTimestamp() - 1000
+	r.WriteShares("3", []*Share{
+		{Login: "z", Id: "a", Nonce: "0x10", Diff: 100, Timestamp: ms - 2},
+		{Login: "z", Id: "a", Nonce: "0x11", Diff: 200, Timestamp: ms - 1},
+		{Login: "y", Id: "a", Nonce: "0x12", Diff: 100, Timestamp: ms},
+		{Login: "x", Id: "a", Nonce: "0x13", Diff: 100, Timestamp: ms + 1},
+		// Equal shares of the same ms
+		{Login: "y", Id: "a", Nonce: "0x14", Diff: 25, Timestamp: ms + 2},
+		{Login: "y", Id: "a", Nonce: "0x15", Diff: 25, Timestamp: ms + 2},
+	}, time.Hour)
+	r.WriteBlock("x", "a", []string{"0x1", "0x2", "0x3"}, 100, 120, 0, false, 1000, time.Hour, nil, nil)
+
+	window, _ := r.GetWindowShares("0x1")
+	if !reflect.DeepEqual(window, map[string]int64{"x": 190, "y": 50}) {
+		t.Errorf("Must credit the oldest share partially: %v", window)
+	}
+	// Shares of two windows are kept for the next block, the oldest one is trimmed
+	if n := len(r.client.ZRevRangeWithScores(r.formatKey("window"), 0, -1).Val()); n != 6 {
+		t.Errorf("Must trim shares beyond retained windows, %v left", n)
+	}
+	candidates, _ := r.GetCandidates(1000)
+	if len(candidates) != 1 || candidates[0].TotalShares != 650 {
+		t.Errorf("Invalid candidate: %+v", candidates)
+	}
+}
+
+func TestPPSReserve(t *testing.T) {
+	reset()
+
+	ms := util.MakeTimestamp()
+	r.WriteShares("4", []*Share{{Login: "x", Id: "a", Diff: 100, Timestamp: ms, Reward: 300}}, time.Hour)
+	r.WriteBlock("x", "a", []string{"0x1", "0x2", "0x3"}, 100, 1000, 300, false, 1000, time.Hour, nil, nil)
+
+	if balance, _ := r.GetBalance("x"); balance != 600 {
+		t.Errorf("Must credit shares right away: %v", balance)
+	}
+	snapshot, _ := r.GetAccountingSnapshot()
+	if mismatches := snapshot.Audit(); len(mismatches) != 0 {
+		t.Errorf("Books must balance with PPS credits: %v", mismatches)
+	}
+
+	candidates, _ := r.GetCandidates(1000)
+	block := candidates[0]
+	block.Hash = "0xa"
+	block.Reward = big.NewInt(1000)
+	r.WriteImmatureBlock(block, map[string]int64{})
+	immature, _ := r.GetImmatureBlocks(1000)
+	immature[0].Reward = big.NewInt(1000)
+	r.WriteReserveBlock(immature[0], 40)
+
+	finances := r.client.HGetAllMap(r.formatKey("finances")).Val()
+	if finances["reserve"] != "400" || finances["balance"] != "600" || len(finances["exposure"]) != 0 {
+		t.Errorf("Must reconcile block into reserve: %v", finances)
+	}
+	if fees, _ := r.GetAverageTxFees(); fees != 40 {
+		t.Errorf("Invalid average tx fees: %v", fees)
+	}
+}
+
+func TestSoloRound(t *testing.T) {
+	reset()
+
+	ms := util.MakeTimestamp()
+	r.WriteShares("5", []*Share{
+		{Login: "x", Id: "a", Diff: 100, Timestamp: ms},
+		{Login: "y", Id: "a", Diff: 200, Timestamp: ms, Solo: true},
+	}, time.Hour)
+	r.WriteBlock("y", "a", []string{"0x1", "0x2", "0x3"}, 100, 1000, 0, true, 1000, time.Hour, nil, nil)
+
+	shares, _ := r.GetRoundShares(1000, "0x1")
+	if !reflect.DeepEqual(shares, map[string]int64{"y": 300}) {
+		t.Errorf("Solo round must hold shares of the finder only: %v", shares)
+	}
+	if v := r.client.HGet(r.formatKey("stats"), "roundShares").Val(); v != "100" {
+		t.Errorf("Must keep pool round running: %v", v)
+	}
+	candidates, _ := r.GetCandidates(1000)
+	if len(candidates) != 1 || !candidates[0].Solo {
+		t.Errorf("Must flag solo candidate: %+v", candidates)
+	}
+}
+
+func TestPayoutJournal(t *testing.T) {
+	reset()
+
+	r.client.HMSetMap(r.formatKey("miners:x"), map[string]string{"balance": "1000"})
+	batch := &PayoutBatch{Id: "1-0", Payees: map[string]int64{"x": 600}}
+	if err := r.PlanPayoutBatch(batch); err != nil {
+		t.Fatalf("Must plan batch: %v", err)
+	}
+	if v := r.client.Get(r.formatKey("payments:lock")).Val(); v != "1-0" {
+		t.Errorf("Batch must hold the lock: %v", v)
+	}
+	r.AdvancePayoutBatch(batch, PayoutDebited)
+	batch.RawTx = "0x01"
+	r.AdvancePayoutBatch(batch, PayoutCreated)
+
+	open, err := r.GetOpenPayoutBatch()
+	if err != nil || open.State != PayoutCreated || open.RawTx != "0x01" || open.Payees["x"] != 600 {
+		t.Errorf("Must resume journaled batch: %+v, %v", open, err)
+	}
+	if err := r.AdvancePayoutBatch(open, PayoutBroadcast); err == nil {
+		t.Error("Must not broadcast unsigned batch")
+	}
+	r.AdvancePayoutBatch(open, PayoutFailed)
+	if v := r.client.HGet(r.formatKey("miners:x"), "balance").Val(); v != "1000" {
+		t.Errorf("Must credit back failed batch: %v", v)
+	}
+	if locked, _ := r.IsPayoutsLocked(); locked {
+		t.Error("Must unlock payouts")
+	}
+	if v := r.client.HGet(r.formatKey("payouts:1-0"), "state").Val(); v != PayoutFailed {
+		t.Errorf("Must keep journal of failed batch: %v", v)
+	}
+
+	mined := &PayoutBatch{Id: "1-1", Payees: map[string]int64{"x": 400}}
+	r.PlanPayoutBatch(mined)
+	for _, state := range []string{PayoutDebited, PayoutCreated, PayoutSigned, PayoutBroadcast} {
+		if err := r.AdvancePayoutBatch(mined, state); err != nil {
+			t.Fatalf("Must advance batch to %v: %v", state, err)
+		}
+	}
+	if err := r.AdvancePayoutBatch(mined, PayoutFailed); err != nil {
+		t.Fatalf("Must fail broadcast batch: %v", err)
+	}
+	if v := r.client.HGet(r.formatKey("miners:x"), "balance").Val(); v != "1000" {
+		t.Errorf("Must credit back failed broadcast batch: %v", v)
+	}
+	if locked, _ := r.IsPayoutsLocked(); locked {
+		t.Error("Must unlock payouts")
+	}
+}
+
+func TestHashTags(t *testing.T) {
+	c := NewRedisClient(&Config{Endpoint: "127.0.0.1:6379", HashTags: true}, prefix)
+	if key := c.formatKey("miners", "x"); key != "{test}:miners:x" {
+		t.Errorf("Invalid key: %v", key)
+	}
+	if key := c.formatRound(10, "0x0"); key != "{test}:shares:round10:0x0" {
+		t.Errorf("Invalid round key: %v", key)
+	}
+	if c.cluster {
+		t.Error("Must not use cluster client")
+	}
+}
+
+func TestHistory(t *testing.T) {
+	reset()
+
+	ts := int64(1500000000)
+	r.WriteShares("6", []*Share{
+		{Login: "x", Id: "a", Diff: 100, Timestamp: ts * 1000},
+		{Login: "x", Id: "b", Diff: 100, Timestamp: (ts + 600) * 1000},
+	}, time.Hour)
+	shares, _ := r.CollectShares(ts, ts+600)
+	if len(shares["x"]) != 1 || *shares["x"]["a"] != (ShareTotal{Difficulty: 100, Count: 1}) {
+		t.Errorf("Must collect shares within bucket only: %v", shares["x"])
+	}
+
+	bucket := &HistoryBucket{
+		Timestamp: ts,
+		Pool:      &HistoryPoint{Hashrate: 1, Shares: 1, Miners: 1, Workers: 1},
+		Miners:    map[string]*HistoryPoint{"x": {Hashrate: 1, Shares: 1, Workers: 1}},
+		Workers:   map[string]map[string]*HistoryPoint{"x": {"a": {Hashrate: 1, Shares: 1}}},
+	}
+	r.WriteHistory("10m", time.Hour, bucket)
+	bucket.Pool.Hashrate = 3
+	r.WriteHistory("10m", time.Hour, bucket)
+	pool, _ := r.GetPoolHistory("10m", 0)
+	if len(pool) != 1 || pool[0].Hashrate != 3 {
+		t.Errorf("Must rewrite point of the same bucket: %+v", pool)
+	}
+
+	series, _ := r.GetHistory("10m", ts, ts+600)
+	if len(series.Pool) != 1 || len(series.Miners["x"]) != 1 || series.Workers["x"]["a"][0].Shares != 1 {
+		t.Errorf("Invalid history series: %+v", series)
+	}
+	miner, workers, _ := r.GetMinerHistory("10m", "x", 0)
+	if len(miner) != 1 || len(workers["a"]) != 1 {
+		t.Errorf("Invalid miner history: %+v %+v", miner, workers)
+	}
+}
+
 func reset() {
 	keys := r.client.Keys(r.prefix + ":*").Val()
 	for _, k := range keys {
@@ -0,0 +1,219 @@
+package storage
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"gopkg.in/redis.v3"
+)
+
+// Version of key layout and member encodings written by this build.
+// Bump it together with a new entry in migrations whenever a format changes.
+const SchemaVersion = 4
+
+// Data written before schema was versioned
+const legacySchemaVersion = 1
+
+// Upgrades data from Version-1 to Version. Must be idempotent, migration is rerun if
+// the process dies before version is stored. Returns number of changed entries.
+type Migration struct {
+	Version     int
+	Description string
+	Apply       func(r *RedisClient, dryRun bool) (int, error)
+}
+
+var migrations = []Migration{
+	{Version: 2, Description: "Add upstream answers to block candidates", Apply: migrateCandidateUpstreams},
+	{Version: 3, Description: "Index miner balances for payee selection", Apply: migrateBalanceIndex},
+	{Version: 4, Description: "Flag solo candidates and blocks", Apply: migrateSoloFlag},
+}
+
+func (r *RedisClient) SchemaVersion() (int, error) {
+	v, err := r.client.Get(r.formatKey("schema")).Result()
+	if err == redis.Nil {
+		empty, err := r.isEmpty()
+		if err != nil {
+			return 0, err
+		}
+		if empty {
+			return 0, nil
+		}
+		return legacySchemaVersion, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(v)
+}
+
+func (r *RedisClient) setSchemaVersion(version int) error {
+	return r.client.Set(r.formatKey("schema"), strconv.Itoa(version), 0).Err()
+}
+
+func (r *RedisClient) isEmpty() (bool, error) {
+	var c int64
+	for {
+		var keys []string
+		var err error
+		c, keys, err = r.scan(c, r.formatKey("*"), 100)
+		if err != nil {
+			return false, err
+		}
+		if len(keys) > 0 {
+			return false, nil
+		}
+		if c == 0 {
+			return true, nil
+		}
+	}
+}
+
+// Stamps current version on empty database, refuses to work with outdated or unknown data
+func (r *RedisClient) CheckSchema() error {
+	version, err := r.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	switch {
+	case version == 0:
+		return r.setSchemaVersion(SchemaVersion)
+	case version < SchemaVersion:
+		return fmt.Errorf("Schema version %v is outdated, run migrate to upgrade it to %v", version, SchemaVersion)
+	case version > SchemaVersion:
+		return fmt.Errorf("Schema version %v is unknown, this build supports up to %v", version, SchemaVersion)
+	}
+	return nil
+}
+
+// Applies pending migrations in order, nothing is written on dry run
+func (r *RedisClient) Migrate(dryRun bool) error {
+	version, err := r.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	if version == 0 {
+		log.Printf("Database is empty, setting schema version %v", SchemaVersion)
+		if dryRun {
+			return nil
+		}
+		return r.setSchemaVersion(SchemaVersion)
+	}
+	if version > SchemaVersion {
+		return fmt.Errorf("Schema version %v is unknown, this build supports up to %v", version, SchemaVersion)
+	}
+	if version == SchemaVersion {
+		log.Printf("Schema version %v is up to date", version)
+		return nil
+	}
+	for _, m := range migrations {
+		if m.Version <= version {
+			continue
+		}
+		log.Printf("Migrating schema to version %v: %v", m.Version, m.Description)
+		n, err := m.Apply(r, dryRun)
+		if err != nil {
+			return fmt.Errorf("Migration to version %v failed: %v", m.Version, err)
+		}
+		if dryRun {
+			log.Printf("Would change %v entries", n)
+			continue
+		}
+		if err := r.setSchemaVersion(m.Version); err != nil {
+			return err
+		}
+		log.Printf("Changed %v entries, schema version is %v", n, m.Version)
+	}
+	return nil
+}
+
+// Candidates written before upstream broadcast have no "acceptedBy:rejectedBy" fields
+func migrateCandidateUpstreams(r *RedisClient, dryRun bool) (int, error) {
+	key := r.formatKey("blocks", "candidates")
+	candidates, err := r.client.ZRangeByScoreWithScores(key, redis.ZRangeByScore{Min: "-inf", Max: "+inf"}).Result()
+	if err != nil {
+		return 0, err
+	}
+	var outdated []redis.Z
+	for _, v := range candidates {
+		if len(strings.Split(v.Member.(string), ":")) == 6 {
+			outdated = append(outdated, v)
+		}
+	}
+	if dryRun || len(outdated) == 0 {
+		return len(outdated), nil
+	}
+
+	tx, err := r.multi()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Close()
+
+	_, err = tx.Exec(func() error {
+		for _, v := range outdated {
+			tx.ZRem(key, v.Member.(string))
+			tx.ZAdd(key, redis.Z{Score: v.Score, Member: join(v.Member.(string), "", "")})
+		}
+		return nil
+	})
+	return len(outdated), err
+}
+
+// Balances were kept in miner hashes only, index is rebuilt from them from scratch
+func migrateBalanceIndex(r *RedisClient, dryRun bool) (int, error) {
+	keys, err := r.scanKeys(r.formatKey("miners", "*"))
+	if err != nil {
+		return 0, err
+	}
+	if len(keys) == 0 {
+		return 0, nil
+	}
+
+	tx, err := r.multi()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Close()
+
+	cmds, err := tx.Exec(func() error {
+		for _, key := range keys {
+			tx.HGetAllMap(key)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	var balances []redis.Z
+	for i, key := range keys {
+		balance, _ := strconv.ParseInt(cmds[i].(*redis.StringStringMapCmd).Val()["balance"], 10, 64)
+		if balance != 0 {
+			balances = append(balances, redis.Z{Score: float64(balance), Member: strings.Split(key, ":")[2]})
+		}
+	}
+	if dryRun {
+		return len(balances), nil
+	}
+
+	wtx, err := r.multi()
+	if err != nil {
+		return 0, err
+	}
+	defer wtx.Close()
+
+	_, err = wtx.Exec(func() error {
+		wtx.Del(r.formatKey("balances"))
+		for _, v := range balances {
+			wtx.ZAdd(r.formatKey("balances"), v)
+		}
+		return nil
+	})
+	return len(balances), err
+}
+
+// Blocks written before solo mining are pool blocks and carry no flag, nothing to rewrite.
+// Version keeps older builds from paying solo blocks to the whole pool.
+func migrateSoloFlag(r *RedisClient, dryRun bool) (int, error) {
+	return 0, nil
+}
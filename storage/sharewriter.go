@@ -0,0 +1,308 @@
+package storage
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sammy007/open-ethereum-pool/util"
+)
+
+// PoW of this number of blocks back is kept for duplicate check, same as in redis sweep
+const powBacklog = 8
+
+// Written batch ids are kept this long, a batch replayed later is written again
+const shareBatchExpiration = 24 * time.Hour
+
+const defaultShareJournal = "shares.journal"
+
+// Shares are kept in memory only if journal can't be written, oldest are dropped above this
+const maxFailedShares = 100000
+
+type ShareWriterConfig struct {
+	// Flush once this number of shares is buffered
+	BatchSize int `json:"batchSize"`
+	// Flush at least this often
+	FlushInterval string `json:"flushInterval"`
+	// Shares which failed to flush are appended to this file and replayed once redis is back,
+	// "shares.journal" in working directory if not set
+	Journal string `json:"journal"`
+}
+
+type Share struct {
+	Login     string `json:"login"`
+	Id        string `json:"id"`
+	Nonce     string `json:"nonce"`
+	Diff      int64  `json:"diff"`
+	Height    uint64 `json:"height"`
+	Stale     bool   `json:"stale,omitempty"`
+	Timestamp int64  `json:"ts"`
+	// PPS credit, 0 unless pool pays per share
+	Reward int64 `json:"reward,omitempty"`
+	// Credited to the round of its login only
+	Solo bool `json:"solo,omitempty"`
+}
+
+// Shares flushed in one transaction, replay of a batch with the same id is a no-op
+type ShareBatch struct {
+	Id     string   `json:"id"`
+	Shares []*Share `json:"shares"`
+}
+
+// Buffers valid shares and writes them to redis in batches, duplicates are checked locally
+type ShareWriter struct {
+	sync.Mutex
+	backend   Backend
+	batchSize int
+	interval  time.Duration
+	journal   string
+	expire    time.Duration
+
+	pending []*Share
+	failed  []*ShareBatch
+	pow     map[uint64]map[string]struct{}
+
+	flushMu sync.Mutex
+	flush   chan struct{}
+	quit    chan struct{}
+	done    chan struct{}
+}
+
+func NewShareWriter(cfg *ShareWriterConfig, backend Backend, expire time.Duration) *ShareWriter {
+	w := &ShareWriter{
+		backend:   backend,
+		batchSize: cfg.BatchSize,
+		interval:  time.Second,
+		journal:   cfg.Journal,
+		expire:    expire,
+		pow:       make(map[uint64]map[string]struct{}),
+		flush:     make(chan struct{}, 1),
+		quit:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	if len(cfg.FlushInterval) > 0 {
+		w.interval = util.MustParseDuration(cfg.FlushInterval)
+	}
+	if w.batchSize <= 0 {
+		w.batchSize = 100
+	}
+	if len(w.journal) == 0 {
+		w.journal = defaultShareJournal
+	}
+	return w
+}
+
+func (w *ShareWriter) Start() {
+	log.Printf("Writing shares in batches of %v every %v, journal %v", w.batchSize, w.interval, w.journal)
+	go func() {
+		defer close(w.done)
+		timer := time.NewTimer(w.interval)
+		for {
+			select {
+			case <-w.quit:
+				timer.Stop()
+				w.Flush()
+				return
+			case <-w.flush:
+				w.Flush()
+			case <-timer.C:
+				w.Flush()
+				timer.Reset(w.interval)
+			}
+		}
+	}()
+}
+
+// Flushes buffered shares and stops
+func (w *ShareWriter) Stop() {
+	close(w.quit)
+	<-w.done
+}
+
+// Buffers valid share, returns true if the same PoW was submitted already
+func (w *ShareWriter) Add(login, id string, params []string, diff int64, height uint64, stale bool, reward int64, solo bool) bool {
+	key := strings.Join(params, ":")
+
+	w.Lock()
+	defer w.Unlock()
+
+	for h := range w.pow {
+		if h+powBacklog < height {
+			delete(w.pow, h)
+		}
+	}
+	for _, v := range w.pow {
+		if _, ok := v[key]; ok {
+			return true
+		}
+	}
+	if _, ok := w.pow[height]; !ok {
+		w.pow[height] = make(map[string]struct{})
+	}
+	w.pow[height][key] = struct{}{}
+
+	share := &Share{Login: login, Id: id, Nonce: params[0], Diff: diff, Height: height, Stale: stale, Timestamp: util.MakeTimestamp(), Reward: reward, Solo: solo}
+	w.pending = append(w.pending, share)
+	if len(w.pending) >= w.batchSize {
+		select {
+		case w.flush <- struct{}{}:
+		default:
+		}
+	}
+	return false
+}
+
+func (w *ShareWriter) Pending() int {
+	w.Lock()
+	defer w.Unlock()
+	n := len(w.pending)
+	for _, b := range w.failed {
+		n += len(b.Shares)
+	}
+	return n
+}
+
+// Writes buffered shares, batches which failed to flush before go first and keep their ids.
+// Shares replayed after a block was found are credited to the current round.
+func (w *ShareWriter) Flush() error {
+	w.flushMu.Lock()
+	defer w.flushMu.Unlock()
+
+	w.Lock()
+	batches := w.failed
+	if len(w.pending) > 0 {
+		batches = append(batches, &ShareBatch{Id: newBatchId(), Shares: w.pending})
+	}
+	w.failed = nil
+	w.pending = nil
+	w.Unlock()
+
+	err := w.replayJournal()
+	for i, batch := range batches {
+		if err == nil {
+			err = w.backend.WriteShares(batch.Id, batch.Shares, w.expire)
+		}
+		if err != nil {
+			log.Printf("Failed to flush %v shares to backend: %v", len(batch.Shares), err)
+			w.save(batches[i:])
+			break
+		}
+	}
+	return err
+}
+
+func (w *ShareWriter) save(batches []*ShareBatch) {
+	err := appendJournal(w.journal, batches)
+	if err == nil {
+		return
+	}
+	log.Printf("Failed to write %v share batches to journal %v: %v", len(batches), w.journal, err)
+
+	w.Lock()
+	defer w.Unlock()
+	w.failed = append(batches, w.failed...)
+	n := 0
+	for _, b := range w.failed {
+		n += len(b.Shares)
+	}
+	for n > maxFailedShares {
+		log.Printf("Dropping %v shares of batch %v, too many shares failed to flush", len(w.failed[0].Shares), w.failed[0].Id)
+		n -= len(w.failed[0].Shares)
+		w.failed = w.failed[1:]
+	}
+}
+
+func (w *ShareWriter) replayJournal() error {
+	batches, err := readJournal(w.journal)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for i, batch := range batches {
+		err := w.backend.WriteShares(batch.Id, batch.Shares, w.expire)
+		if err != nil {
+			// Keep only what is left, batch which was written before its error is skipped on next replay
+			if werr := writeJournal(w.journal, batches[i:]); werr != nil {
+				log.Printf("Failed to rewrite journal %v: %v", w.journal, werr)
+			}
+			return err
+		}
+	}
+	log.Printf("Replayed share journal %v", w.journal)
+	return os.Remove(w.journal)
+}
+
+func newBatchId() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return strconv.FormatInt(util.MakeTimestamp(), 10) + "-" + hex.EncodeToString(b)
+}
+
+func appendJournal(path string, batches []*ShareBatch) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return encodeJournal(f, batches)
+}
+
+func writeJournal(path string, batches []*ShareBatch) error {
+	f, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	err = encodeJournal(f, batches)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// One batch per line
+func encodeJournal(f *os.File, batches []*ShareBatch) error {
+	buf := bufio.NewWriter(f)
+	enc := json.NewEncoder(buf)
+	for _, b := range batches {
+		if err := enc.Encode(b); err != nil {
+			return err
+		}
+	}
+	if err := buf.Flush(); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+func readJournal(path string) ([]*ShareBatch, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var batches []*ShareBatch
+	scanner := bufio.NewScanner(f)
+	// Line holds the whole batch
+	scanner.Buffer(nil, 64*1024*1024)
+	for scanner.Scan() {
+		var b ShareBatch
+		// Torn write at the end of file on crash
+		if err := json.Unmarshal(scanner.Bytes(), &b); err != nil {
+			log.Printf("Skipping malformed share batch in journal %v: %v", path, err)
+			continue
+		}
+		batches = append(batches, &b)
+	}
+	return batches, scanner.Err()
+}
@@ -0,0 +1,59 @@
+package storage
+
+import (
+	"strconv"
+	"strings"
+
+	"gopkg.in/redis.v3"
+)
+
+// Rolling PPLNS share window, members are "diff:login:id:ms:nonce" scored by ms.
+// Snapshot of the window is taken when block is found and kept until the block matures.
+
+// Number of window entries read at once
+const windowChunk = 1000
+
+// Next block may have higher difficulty, shares summing up to this many windows are kept
+const windowRetain = 2
+
+// Window is trimmed to this number of newest shares on every write
+const maxWindowShares = 1000000
+
+// Credits shares newest first until they sum up to size, the oldest one is credited partially.
+// Returns new total.
+func fillWindow(shares map[string]int64, total, size int64, raw []redis.Z) int64 {
+	for _, v := range raw {
+		if total >= size {
+			break
+		}
+		parts := strings.Split(v.Member.(string), ":")
+		diff, _ := strconv.ParseInt(parts[0], 10, 64)
+		if total+diff > size {
+			diff = size - total
+		}
+		shares[parts[1]] += diff
+		total += diff
+	}
+	return total
+}
+
+// Sums shares newest first until they sum up to size.
+// Returns new sum and score of the share which reached size, 0 if window is shorter.
+func windowEdge(sum, size int64, raw []redis.Z) (int64, int64) {
+	for _, v := range raw {
+		diff, _ := strconv.ParseInt(strings.SplitN(v.Member.(string), ":", 2)[0], 10, 64)
+		sum += diff
+		if sum >= size {
+			return sum, int64(v.Score)
+		}
+	}
+	return sum, 0
+}
+
+func formatWindowShares(shares map[string]int64) map[string]string {
+	result := make(map[string]string)
+	for login, n := range shares {
+		result[login] = strconv.FormatInt(n, 10)
+	}
+	return result
+}